@@ -1,5 +1,5 @@
 module github.com/spearman/pgrest/clientApp
 
-go 1.20
+go 1.21
 
 require github.com/goccy/go-json v0.10.2
@@ -1,6 +1,7 @@
 package main
 
 import (
+  "context"
   "log"
   "net/http"
   json "github.com/goccy/go-json"
@@ -32,46 +33,47 @@ func serve_sql_stmt() {
 func main() {
   log.Println("main...")
   client := client.MakeClient("http://127.0.0.1:12345")
+  ctx := context.Background()
 
   go serve_sql_stmt()
 
   log.Printf("dt -------------------------------------------------------------")
-  tables, err := client.Dt()
+  tables, err := client.Dt(ctx)
   if err != nil {
     log.Println(err)
   }
   show("dt", tables)
 
   log.Printf("dn -------------------------------------------------------------")
-  schemas, err := client.Dn()
+  schemas, err := client.Dn(ctx)
   if err != nil {
     log.Println(err)
   }
   show("dn", schemas)
 
   log.Printf("df -------------------------------------------------------------")
-  functions, err := client.Df()
+  functions, err := client.Df(ctx)
   if err != nil {
     log.Println(err)
   }
   show("df", functions)
 
   log.Printf("d --------------------------------------------------------------")
-  columns, err := client.D("document")
+  table, err := client.D(ctx, "", "document")
   if err != nil {
     log.Println(err)
   }
-  show("d", columns)
+  show("d", table)
 
   log.Printf("dc -------------------------------------------------------------")
-  data_type, err := client.Dc("foo", "mycol")
+  data_type, err := client.Dc(ctx, "foo", "mycol")
   if err != nil {
     log.Println(err)
   }
   show("dc", data_type)
 
   log.Printf("idx ------------------------------------------------------------")
-  indexes, err := client.Idx("document")
+  indexes, err := client.Idx(ctx, "document")
   if err != nil {
     log.Println(err)
   }
@@ -79,7 +81,7 @@ func main() {
 
   log.Printf("create ---------------------------------------------------------")
   {
-    res, err := client.Create("foo")
+    res, err := client.Create(ctx, "foo")
     if err != nil {
       log.Println(err)
     }
@@ -88,7 +90,7 @@ func main() {
 
   log.Printf("createIndex ----------------------------------------------------")
   {
-    res, err := client.CreateIndex("myindex", "foo", "mycol")
+    res, err := client.CreateIndex(ctx, "myindex", "foo", "mycol")
     if err != nil {
       log.Println(err)
     }
@@ -97,7 +99,7 @@ func main() {
 
   log.Printf("read ---------------------------------------------------------")
   {
-    res, err := client.Read("foo", []string{"mycol2", "mycol3"})
+    res, err := client.Read(ctx, "foo", []string{"mycol2", "mycol3"})
     if err != nil {
       log.Println(err)
     }
@@ -108,7 +110,7 @@ func main() {
     var col_vals []pgrest.ColVal
     col_vals = append(col_vals, pgrest.ColVal { ColumnName: "mycol", Value: "99" })
     col_vals = append(col_vals, pgrest.ColVal { ColumnName: "mycol2", Value: "98" })
-    res, err := client.Insert("foo", col_vals)
+    res, err := client.Insert(ctx, "foo", col_vals)
     if err != nil {
       log.Println(err)
     }
@@ -119,7 +121,7 @@ func main() {
     var col_vals []pgrest.ColVal
     col_vals = append(col_vals, pgrest.ColVal { ColumnName: "foo", Value: "2.2" })
     col_vals = append(col_vals, pgrest.ColVal { ColumnName: "bar", Value: "3" })
-    res, err := client.Upsert("mytable", col_vals)
+    res, err := client.Upsert(ctx, "mytable", col_vals)
     if err != nil {
       log.Println(err)
     }
@@ -128,7 +130,7 @@ func main() {
 
   log.Printf("delete ---------------------------------------------------------")
   {
-    res, err := client.Delete("foo", []string{"mycol4"})
+    res, err := client.Delete(ctx, "foo", []string{"mycol4"})
     if err != nil {
       log.Println(err)
     }
@@ -137,7 +139,7 @@ func main() {
 
   log.Printf("execSql --------------------------------------------------------")
   {
-    res, err := client.ExecSql("SELECT * FROM foo")
+    res, err := client.ExecSql(ctx, "SELECT * FROM foo")
     if err != nil {
       log.Println(err)
     }
@@ -146,7 +148,7 @@ func main() {
 
   log.Printf("exec -----------------------------------------------------------")
   {
-    res, err := client.Exec("http://localhost:8080/test.sql")
+    res, err := client.Exec(ctx, "http://localhost:8080/test.sql")
     if err != nil {
       log.Println(err)
     }
@@ -155,7 +157,7 @@ func main() {
 
   log.Printf("own ------------------------------------------------------------")
   {
-    res, err := client.Own("foo", "nixcloud")
+    res, err := client.Own(ctx, "foo", "nixcloud")
     if err != nil {
       log.Println(err)
     }
@@ -163,7 +165,7 @@ func main() {
   }
 
   log.Printf("du -------------------------------------------------------------")
-  users, err := client.Du()
+  users, err := client.Du(ctx)
   if err != nil {
     log.Println(err)
   }
@@ -171,12 +173,48 @@ func main() {
 
   log.Printf("add ------------------------------------------------------------")
   {
-    res, err := client.Add("user_foo")
+    res, err := client.Add(ctx, "user_foo")
     if err != nil {
       log.Println(err)
     }
     show("add", res)
   }
 
+  log.Printf("defineQuery ----------------------------------------------------")
+  {
+    query := pgrest.NamedQuery {
+      Name: "foo_by_mycol",
+      Sql: "SELECT * FROM foo WHERE mycol = $1",
+      Params: []pgrest.QueryParam { { Name: "mycol", Type: "integer" } },
+    }
+    res, err := client.DefineQuery(ctx, query)
+    if err != nil {
+      log.Println(err)
+    }
+    show("defineQuery", res)
+  }
+
+  log.Printf("query ----------------------------------------------------------")
+  {
+    res, err := client.Query(ctx, "foo_by_mycol", map[string]interface{} {
+      "mycol": 99,
+    })
+    if err != nil {
+      log.Println(err)
+    }
+    show("query", res)
+  }
+
+  log.Printf("call -----------------------------------------------------------")
+  {
+    var rows []map[string]interface{}
+    err := client.Call(ctx, "pg_catalog", "pg_postmaster_start_time", nil,
+      &rows)
+    if err != nil {
+      log.Println(err)
+    }
+    show("call", rows)
+  }
+
   log.Println("...main")
 }
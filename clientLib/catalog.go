@@ -0,0 +1,100 @@
+package client
+
+import (
+  "context"
+  "net/url"
+  pgrest "pgrest/pgrestLib"
+)
+
+// catalog listings of a schema, public when schema is empty; triggers and
+// constraints are limited to table when it is not empty
+
+func catalog_path(path string, schema string, table string) string {
+  query := url.Values{}
+  if schema != "" {
+    query.Set("schema", schema)
+  }
+  if table != "" {
+    query.Set("table", table)
+  }
+  if len(query) == 0 {
+    return path
+  }
+  return path + "?" + query.Encode()
+}
+
+func (client *Client) Dv(ctx context.Context, schema string) (
+  []pgrest.View, error,
+) {
+  var views []pgrest.View
+  err := client.request_json(ctx, "GET", catalog_path("/dv", schema, ""), nil,
+    &views, "views", true)
+  if err != nil {
+    return nil, err
+  }
+  return views, nil
+}
+
+func (client *Client) Dm(ctx context.Context, schema string) (
+  []pgrest.MaterializedView, error,
+) {
+  var matviews []pgrest.MaterializedView
+  err := client.request_json(ctx, "GET", catalog_path("/dm", schema, ""), nil,
+    &matviews, "materialized views", true)
+  if err != nil {
+    return nil, err
+  }
+  return matviews, nil
+}
+
+func (client *Client) Ds(ctx context.Context, schema string) (
+  []pgrest.Sequence, error,
+) {
+  var sequences []pgrest.Sequence
+  err := client.request_json(ctx, "GET", catalog_path("/ds", schema, ""), nil,
+    &sequences, "sequences", true)
+  if err != nil {
+    return nil, err
+  }
+  return sequences, nil
+}
+
+func (client *Client) Triggers(
+  ctx context.Context, schema string, table_name string,
+) ([]pgrest.Trigger, error) {
+  var triggers []pgrest.Trigger
+  err := client.request_json(ctx, "GET",
+    catalog_path("/triggers", schema, table_name), nil, &triggers, "triggers",
+    true)
+  if err != nil {
+    return nil, err
+  }
+  return triggers, nil
+}
+
+func (client *Client) Constraints(
+  ctx context.Context, schema string, table_name string,
+) ([]pgrest.Constraint, error) {
+  var constraints []pgrest.Constraint
+  err := client.request_json(ctx, "GET",
+    catalog_path("/constraints", schema, table_name), nil, &constraints,
+    "constraints", true)
+  if err != nil {
+    return nil, err
+  }
+  return constraints, nil
+}
+
+// the sql script creating the schema: every user schema when schema and
+// table_name are empty, one schema, or one table with its sequences, indexes,
+// constraints and triggers (found on the search path when schema is empty)
+func (client *Client) Ddl(
+  ctx context.Context, schema string, table_name string,
+) (string, error) {
+  body, err := client.do(ctx, "GET", catalog_path("/ddl", schema, table_name),
+    nil, true)
+  if err != nil {
+    return "", err
+  }
+  return string(body), nil
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+  "context"
+  "fmt"
+  "net/url"
+  pgrest "pgrest/pgrestLib"
+  json "github.com/goccy/go-json"
+)
+
+// the changes of a replication slot; Changes is closed when the stream ends,
+// after which Err returns the reason
+type ChangeStream struct {
+  Changes <-chan pgrest.Change
+  stream
+}
+
+// streams the changes of slot published by publication, limited to tables
+// (schema.table, or table in public) when given, after the change with the
+// resume token when it is not empty. The stream ends with ctx, on Close or
+// when the server ends it; reopen it with the token of the last change
+// processed. The client timeout does not apply
+func (client *Client) Changes(
+  ctx context.Context, slot string, publication string, tables []string,
+  resume string,
+) (*ChangeStream, error) {
+  query := url.Values {
+    "slot": { slot }, "publication": { publication }, "table": tables,
+  }
+  if resume != "" {
+    query.Set("resume", resume)
+  }
+  changes := make(chan pgrest.Change)
+  change_stream := &ChangeStream { Changes: changes }
+  event := func(ctx context.Context, data []byte) error {
+    var change pgrest.Change
+    err := json.Unmarshal(data, &change)
+    if err != nil {
+      return fmt.Errorf("error converting json to change: %w", err)
+    }
+    select {
+      case changes <- change:
+        return nil
+      case <-ctx.Done():
+        return ctx.Err()
+    }
+  }
+  err := client.open_events(ctx, "/changes", query, &change_stream.stream,
+    event, func() { close(changes) })
+  if err != nil {
+    return nil, err
+  }
+  return change_stream, nil
+}
+
+// acknowledges the changes of slot up to the one with token, letting postgres
+// release their wal
+func (client *Client) AckChanges(
+  ctx context.Context, slot string, token string,
+) (*pgrest.Result, error) {
+  ack := pgrest.AckChanges { Slot: slot, Token: token }
+  return client.post_result(ctx, "/ackChanges", ack)
+}
+
+func (client *Client) Slots(ctx context.Context) (
+  []pgrest.ReplicationSlot, error,
+) {
+  var slots []pgrest.ReplicationSlot
+  err := client.request_json(ctx, "GET", "/slots", nil, &slots,
+    "replication slots", true)
+  if err != nil {
+    return nil, err
+  }
+  return slots, nil
+}
+
+// sent without an idempotency key, which slot creation can't run with;
+// repeating it fails rather than creating the slot twice
+func (client *Client) CreateSlot(ctx context.Context, slot_name string) (
+  *pgrest.Result, error,
+) {
+  var result pgrest.Result
+  err := client.request_json(ctx, "POST", "/createSlot",
+    pgrest.ReqSlot { Name: slot_name }, &result, "result", true)
+  if err != nil {
+    return nil, err
+  }
+  return &result, nil
+}
+
+func (client *Client) DropSlot(ctx context.Context, slot_name string) (
+  *pgrest.Result, error,
+) {
+  return client.post_result(ctx, "/dropSlot",
+    pgrest.ReqSlot { Name: slot_name })
+}
+
+func (client *Client) Publications(ctx context.Context) (
+  []pgrest.Publication, error,
+) {
+  var publications []pgrest.Publication
+  err := client.request_json(ctx, "GET", "/publications", nil, &publications,
+    "publications", true)
+  if err != nil {
+    return nil, err
+  }
+  return publications, nil
+}
+
+// an empty tables publishes all tables
+func (client *Client) CreatePublication(
+  ctx context.Context, publication_name string, tables []string,
+) (*pgrest.Result, error) {
+  create_pub := pgrest.CreatePublication {
+    Name: publication_name, Tables: tables,
+  }
+  return client.post_result(ctx, "/createPublication", create_pub)
+}
+
+func (client *Client) DropPublication(
+  ctx context.Context, publication_name string,
+) (*pgrest.Result, error) {
+  return client.post_result(ctx, "/dropPublication",
+    pgrest.ReqPublication { Name: publication_name })
+}
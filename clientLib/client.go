@@ -2,631 +2,498 @@ package client
 
 import (
   "bytes"
+  "context"
   "errors"
   "fmt"
+  "io"
   "io/ioutil"
   "log"
   "net/http"
   "net/url"
+  "strings"
   pgrest "pgrest/pgrestLib"
   json "github.com/goccy/go-json"
 )
 
 type Client struct {
-  url    string
-  client *http.Client
+  url     string
+  client  *http.Client
+  headers http.Header
+  logger  Logger
+  retry   retry_policy
 }
 
-func MakeClient (url string) Client {
-  client := &http.Client{}
-  return Client { url, client }
+// without options requests are sent once with http.DefaultTransport and no
+// timeout, and errors are logged with the standard logger
+func MakeClient (url string, opts ...Option) Client {
+  options := options {
+    headers: make(http.Header),
+    logger: log.Default(),
+    retry: retry_policy { max_attempts: 1 },
+  }
+  for _, opt := range opts {
+    opt(&options)
+  }
+  client := build_http_client(&options)
+  return Client { url, client, options.headers, options.logger, options.retry }
 }
 
-func (client *Client) Dt() ([]pgrest.Table, error) {
-  resp, err := client.client.Get(client.url + "/dt")
-  if err != nil {
-    log.Println("error sending request:", err)
-    return nil, err
-  }
-  log.Printf("resp: %+v\n", resp)
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
-  if err != nil {
-    log.Println("error reading response:", err)
-    return nil, err
-  }
-  if resp.StatusCode != 200 {
-    err_string := fmt.Sprintf("error http status code %d: %s", resp.StatusCode,
-      string(body))
-    err = errors.New(err_string)
-    return nil, err
-  }
+func (client *Client) Dt(ctx context.Context) ([]pgrest.Table, error) {
   var tables []pgrest.Table
-  err = json.Unmarshal(body, &tables)
+  err := client.request_json(ctx, "GET", "/dt", nil, &tables, "tables", true)
   if err != nil {
-    log.Println("error converting json to tables:", err)
     return nil, err
   }
-  return tables, err
+  return tables, nil
 }
 
-func (client *Client) Dn() ([]pgrest.Schema, error) {
-  resp, err := client.client.Get(client.url + "/dn")
-  if err != nil {
-    log.Println("error sending request:", err)
-    return nil, err
+// lists the tables of schema, public when empty, with their sizes, row
+// estimates and activity, largest first when by_size is set
+func (client *Client) DtStats(
+  ctx context.Context, schema string, by_size bool,
+) ([]pgrest.Table, error) {
+  query := url.Values { "stats": { "true" } }
+  if schema != "" {
+    query.Set("schema", schema)
+  }
+  if by_size {
+    query.Set("sort", "size")
   }
-  log.Printf("resp: %+v\n", resp)
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
+  var tables []pgrest.Table
+  err := client.request_json(ctx, "GET", "/dt?" + query.Encode(), nil,
+    &tables, "tables", true)
   if err != nil {
-    log.Println("error reading response:", err)
-    return nil, err
-  }
-  if resp.StatusCode != 200 {
-    err_string := fmt.Sprintf("error http status code %d: %s", resp.StatusCode,
-      string(body))
-    err = errors.New(err_string)
     return nil, err
   }
+  return tables, nil
+}
+
+func (client *Client) Dn(ctx context.Context) ([]pgrest.Schema, error) {
   var schemas []pgrest.Schema
-  err = json.Unmarshal(body, &schemas)
+  err := client.request_json(ctx, "GET", "/dn", nil, &schemas, "schemas",
+    true)
   if err != nil {
-    log.Println("error converting json to schemas:", err)
     return nil, err
   }
-  return schemas, err
+  return schemas, nil
 }
 
-func (client *Client) Df() ([]pgrest.Function, error) {
-  resp, err := client.client.Get(client.url + "/df")
-  if err != nil {
-    log.Println("error sending request:", err)
-    return nil, err
-  }
-  log.Printf("resp: %+v\n", resp)
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
-  if err != nil {
-    log.Println("error reading response:", err)
-    return nil, err
-  }
-  if resp.StatusCode != 200 {
-    err_string := fmt.Sprintf("error http status code %d: %s", resp.StatusCode,
-      string(body))
-    err = errors.New(err_string)
-    return nil, err
-  }
+func (client *Client) Df(ctx context.Context) ([]pgrest.Function, error) {
   var functions []pgrest.Function
-  err = json.Unmarshal(body, &functions)
+  err := client.request_json(ctx, "GET", "/df", nil, &functions, "functions",
+    true)
   if err != nil {
-    log.Println("error converting json to functions:", err)
     return nil, err
   }
-  return functions, err
+  return functions, nil
 }
 
-func (client *Client) D(table_name string) ([]pgrest.Column, error) {
-  req_table := pgrest.ReqTable { TableName: table_name }
-  body_json, err := json.Marshal(req_table)
-  if err != nil {
-    log.Println("error marshaling body:", err)
-    return nil, err
-  }
-  req_body := bytes.NewReader(body_json)
-  req, err := http.NewRequest("GET", client.url + "/d", req_body)
+// describes a table in schema, or on the search path when schema is empty
+func (client *Client) D(
+  ctx context.Context, schema string, table_name string,
+) (*pgrest.TableDescription, error) {
+  req_table := pgrest.ReqTable { Schema: schema, TableName: table_name }
+  var table pgrest.TableDescription
+  err := client.request_json(ctx, "GET", "/d", req_table, &table, "table",
+    true)
   if err != nil {
-    log.Println("error creating request:", err)
     return nil, err
   }
-  resp, err := client.client.Do(req)
-  if err != nil {
-    log.Println("error sending request:", err)
-    return nil, err
-  }
-  log.Printf("resp: %+v\n", resp)
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
-  if err != nil {
-    log.Println("error reading response:", err)
-    return nil, err
-  }
-  if resp.StatusCode != 200 {
-    err_string := fmt.Sprintf("error http status code %d: %s", resp.StatusCode,
-      string(body))
-    err = errors.New(err_string)
-    return nil, err
-  }
-  var columns []pgrest.Column
-  err = json.Unmarshal(body, &columns)
-  if err != nil {
-    log.Println("error converting json to columns:", err)
-    return nil, err
-  }
-  return columns, err
+  return &table, nil
 }
 
-func (client *Client) Dc(table_name string, column_name string) (
-  *pgrest.DataType, error,
-) {
+func (client *Client) Dc(
+  ctx context.Context, table_name string, column_name string,
+) (*pgrest.DataType, error) {
   req_col := pgrest.ReqColumn { TableName: table_name, ColumnName: column_name }
-  body_json, err := json.Marshal(req_col)
-  if err != nil {
-    log.Println("error marshaling body:", err)
-    return nil, err
-  }
-  req_body := bytes.NewReader(body_json)
-  req, err := http.NewRequest("GET", client.url + "/dc", req_body)
-  if err != nil {
-    log.Println("error creating request:", err)
-    return nil, err
-  }
-  resp, err := client.client.Do(req)
-  if err != nil {
-    log.Println("error sending request:", err)
-    return nil, err
-  }
-  log.Printf("resp: %+v\n", resp)
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
-  if err != nil {
-    log.Println("error reading response:", err)
-    return nil, err
-  }
-  if resp.StatusCode != 200 {
-    err_string := fmt.Sprintf("error http status code %d: %s", resp.StatusCode,
-      string(body))
-    err = errors.New(err_string)
-    return nil, err
-  }
   var data_type pgrest.DataType
-  err = json.Unmarshal(body, &data_type)
+  err := client.request_json(ctx, "GET", "/dc", req_col, &data_type,
+    "data type", true)
   if err != nil {
-    log.Println("error converting json to data type:", err)
     return nil, err
   }
-  return &data_type, err
+  return &data_type, nil
 }
 
-func (client *Client) Idx(table_name string) ([]pgrest.Index, error) {
+func (client *Client) Idx(ctx context.Context, table_name string) (
+  []pgrest.Index, error,
+) {
   req_table := pgrest.ReqTable { TableName: table_name }
-  body_json, err := json.Marshal(req_table)
-  if err != nil {
-    log.Println("error marshaling body:", err)
-    return nil, err
-  }
-  req_body := bytes.NewReader(body_json)
-  req, err := http.NewRequest("GET", client.url + "/idx", req_body)
-  if err != nil {
-    log.Println("error creating request:", err)
-    return nil, err
-  }
-  resp, err := client.client.Do(req)
-  if err != nil {
-    log.Println("error sending request:", err)
-    return nil, err
-  }
-  log.Printf("resp: %+v\n", resp)
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
-  if err != nil {
-    log.Println("error reading response:", err)
-    return nil, err
-  }
-  if resp.StatusCode != 200 {
-    err_string := fmt.Sprintf("error http status code %d: %s", resp.StatusCode,
-      string(body))
-    err = errors.New(err_string)
-    return nil, err
-  }
   var indexes []pgrest.Index
-  err = json.Unmarshal(body, &indexes)
+  err := client.request_json(ctx, "GET", "/idx", req_table, &indexes,
+    "indexes", true)
   if err != nil {
-    log.Println("error converting json to indexes:", err)
     return nil, err
   }
-  return indexes, err
+  return indexes, nil
 }
 
-func (client *Client) Create(table_name string) (*pgrest.Result, error) {
+func (client *Client) Create(ctx context.Context, table_name string) (
+  *pgrest.Result, error,
+) {
   req_table := pgrest.ReqTable { TableName: table_name }
-  body_json, err := json.Marshal(req_table)
-  if err != nil {
-    log.Println("error marshaling body:", err)
-    return nil, err
-  }
-  req_body := bytes.NewReader(body_json)
-  resp, err := http.Post(client.url + "/create", "", req_body)
-  if err != nil {
-    log.Println("error sending request:", err)
-    return nil, err
-  }
-  log.Printf("resp: %+v\n", resp)
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
-  if err != nil {
-    log.Println("error reading response:", err)
-    return nil, err
-  }
-  if resp.StatusCode != 200 {
-    err_string := fmt.Sprintf("error http status code %d: %s", resp.StatusCode,
-      string(body))
-    err = errors.New(err_string)
-    return nil, err
-  }
-  var result pgrest.Result
-  err = json.Unmarshal(body, &result)
-  if err != nil {
-    log.Println("error converting json to result:", err)
-    return nil, err
-  }
-  return &result, err
+  return client.post_result(ctx, "/create", req_table)
 }
 
 func (client *Client) CreateIndex(
-  index_name string, table_name string, column_name string,
+  ctx context.Context, index_name string, table_name string,
+  column_name string,
 ) (*pgrest.Result, error) {
   cre_idx := pgrest.CreateIndex {
     IndexName: index_name, TableName: table_name, ColumnName: column_name,
   }
-  body_json, err := json.Marshal(cre_idx)
-  if err != nil {
-    log.Println("error marshaling body:", err)
-    return nil, err
-  }
-  req_body := bytes.NewReader(body_json)
-  resp, err := http.Post(client.url + "/createIndex", "", req_body)
-  if err != nil {
-    log.Println("error sending request:", err)
-    return nil, err
-  }
-  log.Printf("resp: %+v\n", resp)
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
+  return client.post_result(ctx, "/createIndex", cre_idx)
+}
+
+// creates an index from a full spec; concurrent builds are sent without an
+// idempotency key, which they can't run with, and repeating one fails
+// rather than building the index twice
+func (client *Client) CreateIndexSpec(
+  ctx context.Context, spec pgrest.CreateIndex,
+) (*pgrest.Result, error) {
+  var result pgrest.Result
+  err := client.request_json(ctx, "POST", "/createIndex", spec, &result,
+    "result", spec.Concurrently)
   if err != nil {
-    log.Println("error reading response:", err)
-    return nil, err
-  }
-  if resp.StatusCode != 200 {
-    err_string := fmt.Sprintf("error http status code %d: %s", resp.StatusCode,
-      string(body))
-    err = errors.New(err_string)
     return nil, err
   }
+  return &result, nil
+}
+
+// concurrent drops are sent without an idempotency key, like concurrent
+// builds
+func (client *Client) DropIndex(
+  ctx context.Context, drop_idx pgrest.DropIndex,
+) (*pgrest.Result, error) {
   var result pgrest.Result
-  err = json.Unmarshal(body, &result)
+  err := client.request_json(ctx, "POST", "/dropIndex", drop_idx, &result,
+    "result", drop_idx.Concurrently)
   if err != nil {
-    log.Println("error converting json to result:", err)
     return nil, err
   }
-  return &result, err
+  return &result, nil
 }
 
 func (client *Client) Read(
-  table_name string, column_names []string,
+  ctx context.Context, table_name string, column_names []string,
 ) (*pgrest.Result, error) {
   read := pgrest.ReadColumns {
     TableName: table_name, ColumnNames: column_names,
   }
-  body_json, err := json.Marshal(read)
-  if err != nil {
-    log.Println("error marshaling body:", err)
-    return nil, err
-  }
-  req_body := bytes.NewReader(body_json)
-  resp, err := http.Post(client.url + "/read", "", req_body)
+  var result pgrest.Result
+  err := client.request_json(ctx, "POST", "/read", read, &result, "result",
+    true)
   if err != nil {
-    log.Println("error sending request:", err)
     return nil, err
   }
-  log.Printf("resp: %+v\n", resp)
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
+  return &result, nil
+}
+
+// reads rows with filters, order, limit and embedded related rows
+func (client *Client) ReadSpec(
+  ctx context.Context, read pgrest.ReadColumns,
+) (*pgrest.Result, error) {
+  var result pgrest.Result
+  err := client.request_json(ctx, "POST", "/read", read, &result, "result",
+    true)
   if err != nil {
-    log.Println("error reading response:", err)
-    return nil, err
-  }
-  if resp.StatusCode != 200 {
-    err_string := fmt.Sprintf("error http status code %d: %s", resp.StatusCode,
-      string(body))
-    err = errors.New(err_string)
     return nil, err
   }
+  return &result, nil
+}
+
+// aggregates the rows of a table per group; the rows of the result are the
+// groups with their aggregates
+func (client *Client) Aggregate(
+  ctx context.Context, agg pgrest.Aggregate,
+) (*pgrest.Result, error) {
   var result pgrest.Result
-  err = json.Unmarshal(body, &result)
+  err := client.request_json(ctx, "POST", "/aggregate", agg, &result,
+    "result", true)
   if err != nil {
-    log.Println("error converting json to result:", err)
     return nil, err
   }
-  return &result, err
+  return &result, nil
 }
 
 func (client *Client) Insert(
-  table_name string, values []pgrest.ColVal,
+  ctx context.Context, table_name string, values []pgrest.ColVal,
 ) (*pgrest.Result, error) {
   insert := pgrest.Insert {
     TableName: table_name, Values: values,
   }
-  body_json, err := json.Marshal(insert)
-  if err != nil {
-    log.Println("error marshaling body:", err)
-    return nil, err
-  }
-  req_body := bytes.NewReader(body_json)
-  resp, err := http.Post(client.url + "/insert", "", req_body)
-  if err != nil {
-    log.Println("error sending request:", err)
-    return nil, err
-  }
-  log.Printf("resp: %+v\n", resp)
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
-  if err != nil {
-    log.Println("error reading response:", err)
-    return nil, err
-  }
-  if resp.StatusCode != 200 {
-    err_string := fmt.Sprintf("error http status code %d: %s", resp.StatusCode,
-      string(body))
-    err = errors.New(err_string)
-    return nil, err
-  }
-  var result pgrest.Result
-  err = json.Unmarshal(body, &result)
-  if err != nil {
-    log.Println("error converting json to result:", err)
-    return nil, err
-  }
-  return &result, err
+  return client.post_result(ctx, "/insert", insert)
 }
 
 func (client *Client) Upsert(
-  table_name string, values []pgrest.ColVal,
+  ctx context.Context, table_name string, values []pgrest.ColVal,
 ) (*pgrest.Result, error) {
   insert := pgrest.Insert {
     TableName: table_name, Values: values,
   }
-  body_json, err := json.Marshal(insert)
-  if err != nil {
-    log.Println("error marshaling body:", err)
-    return nil, err
-  }
-  req_body := bytes.NewReader(body_json)
-  resp, err := http.Post(client.url + "/upsert", "", req_body)
-  if err != nil {
-    log.Println("error sending request:", err)
-    return nil, err
-  }
-  log.Printf("resp: %+v\n", resp)
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
-  if err != nil {
-    log.Println("error reading response:", err)
-    return nil, err
-  }
-  if resp.StatusCode != 200 {
-    err_string := fmt.Sprintf("error http status code %d: %s", resp.StatusCode,
-      string(body))
-    err = errors.New(err_string)
-    return nil, err
-  }
-  var result pgrest.Result
-  err = json.Unmarshal(body, &result)
-  if err != nil {
-    log.Println("error converting json to result:", err)
-    return nil, err
-  }
-  return &result, err
+  return client.post_result(ctx, "/upsert", insert)
 }
-func (client *Client) Delete(table_name string, columns []string) (
-  *pgrest.Result, error,
-) {
+
+func (client *Client) Delete(
+  ctx context.Context, table_name string, columns []string,
+) (*pgrest.Result, error) {
   delete := pgrest.Delete {
     TableName: table_name, Cols: columns,
   }
-  body_json, err := json.Marshal(delete)
-  if err != nil {
-    log.Println("error marshaling body:", err)
-    return nil, err
-  }
-  req_body := bytes.NewReader(body_json)
-  resp, err := http.Post(client.url + "/delete", "", req_body)
-  if err != nil {
-    log.Println("error sending request:", err)
-    return nil, err
-  }
-  log.Printf("resp: %+v\n", resp)
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
-  if err != nil {
-    log.Println("error reading response:", err)
-    return nil, err
-  }
-  if resp.StatusCode != 200 {
-    err_string := fmt.Sprintf("error http status code %d: %s", resp.StatusCode,
-      string(body))
-    err = errors.New(err_string)
-    return nil, err
-  }
-  var result pgrest.Result
-  err = json.Unmarshal(body, &result)
-  if err != nil {
-    log.Println("error converting json to result:", err)
-    return nil, err
-  }
-  return &result, err
+  return client.post_result(ctx, "/delete", delete)
 }
 
-func (client *Client) ExecSql(stmt string) (*pgrest.Result, error) {
-  req_body := bytes.NewReader([]byte(stmt))
-  resp, err := http.Post(client.url + "/execSql", "", req_body)
-  if err != nil {
-    log.Println("error sending request:", err)
-    return nil, err
-  }
-  log.Printf("resp: %+v\n", resp)
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
+func (client *Client) ExecSql(ctx context.Context, stmt string) (
+  *pgrest.Result, error,
+) {
+  body, err := client.do(ctx, "POST", "/execSql", []byte(stmt), false)
   if err != nil {
-    log.Println("error reading response:", err)
-    return nil, err
-  }
-  if resp.StatusCode != 200 {
-    err_string := fmt.Sprintf("error http status code %d: %s", resp.StatusCode,
-      string(body))
-    err = errors.New(err_string)
     return nil, err
   }
   var result pgrest.Result
   err = json.Unmarshal(body, &result)
   if err != nil {
-    log.Println("error converting json to result:", err)
+    client.logf("error converting json to result: %v\n", err)
     return nil, err
   }
-  return &result, err
+  return &result, nil
 }
 
-func (client *Client) Exec(url_string string) (*pgrest.Result, error) {
+func (client *Client) Exec(ctx context.Context, url_string string) (
+  *pgrest.Result, error,
+) {
   exec_url, err := url.Parse(url_string)
   if err != nil {
-    log.Println("error parsing exec url string:", url_string)
+    client.logf("error parsing exec url string: %s\n", url_string)
     return nil, err
   }
   exec := pgrest.Exec {
     Url: *exec_url,
   }
-  body_json, err := json.Marshal(exec)
-  if err != nil {
-    log.Println("error marshaling body:", err)
-    return nil, err
+  return client.post_result(ctx, "/exec", exec)
+}
+
+func (client *Client) Own(
+  ctx context.Context, table_name string, new_owner string,
+) (*pgrest.Result, error) {
+  own := pgrest.Own {
+    TableName: table_name, Owner: new_owner,
   }
-  req_body := bytes.NewReader(body_json)
-  resp, err := http.Post(client.url + "/exec", "", req_body)
+  return client.post_result(ctx, "/own", own)
+}
+
+func (client *Client) Du(ctx context.Context) ([]pgrest.User, error) {
+  var users []pgrest.User
+  err := client.request_json(ctx, "GET", "/du", nil, &users, "users", true)
   if err != nil {
-    log.Println("error sending request:", err)
     return nil, err
   }
-  log.Printf("resp: %+v\n", resp)
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
+  return users, nil
+}
+
+// the quota state of the callers seen recently
+func (client *Client) QuotaUsage(ctx context.Context) (
+  []pgrest.QuotaUsage, error,
+) {
+  var usage []pgrest.QuotaUsage
+  err := client.request_json(ctx, "GET", "/admin/quotas", nil, &usage,
+    "quota usage", true)
   if err != nil {
-    log.Println("error reading response:", err)
-    return nil, err
-  }
-  if resp.StatusCode != 200 {
-    err_string := fmt.Sprintf("error http status code %d: %s", resp.StatusCode,
-      string(body))
-    err = errors.New(err_string)
     return nil, err
   }
-  var result pgrest.Result
-  err = json.Unmarshal(body, &result)
+  return usage, nil
+}
+
+func (client *Client) Add(ctx context.Context, user_name string) (
+  *pgrest.Result, error,
+) {
+  create_user := pgrest.CreateUser { UserName: user_name }
+  return client.post_result(ctx, "/add", create_user)
+}
+
+func (client *Client) Queries(ctx context.Context) (
+  []pgrest.NamedQuery, error,
+) {
+  var queries []pgrest.NamedQuery
+  err := client.request_json(ctx, "GET", "/queries", nil, &queries,
+    "queries", true)
   if err != nil {
-    log.Println("error converting json to result:", err)
     return nil, err
   }
-  return &result, err
+  return queries, nil
+}
+
+func (client *Client) DefineQuery(
+  ctx context.Context, query pgrest.NamedQuery,
+) (*pgrest.Result, error) {
+  return client.post_result(ctx, "/defineQuery", query)
 }
 
-func (client *Client) Own(table_name string, new_owner string) (
+func (client *Client) DropQuery(ctx context.Context, query_name string) (
   *pgrest.Result, error,
 ) {
-  own := pgrest.Own {
-    TableName: table_name, Owner: new_owner,
-  }
-  body_json, err := json.Marshal(own)
+  req_query := pgrest.ReqQuery { Name: query_name }
+  return client.post_result(ctx, "/dropQuery", req_query)
+}
+
+// runs a named query; args are matched to the declared query parameters by
+// name
+func (client *Client) Query(
+  ctx context.Context, query_name string, args map[string]interface{},
+) (*pgrest.Result, error) {
+  return client.post_result(ctx, "/query/" + url.PathEscape(query_name), args)
+}
+
+// calls a database function with named arguments; the result rows are
+// returned as json lines
+func (client *Client) Rpc(
+  ctx context.Context, schema_name string, function_name string,
+  args map[string]interface{},
+) (*pgrest.Result, error) {
+  return client.post_result(ctx, "/rpc/" + url.PathEscape(schema_name) + "/" +
+    url.PathEscape(function_name), args)
+}
+
+// calls a database function and decodes the result rows into out, which must
+// be a pointer to a slice of structs or maps
+func (client *Client) Call(
+  ctx context.Context, schema_name string, function_name string,
+  args map[string]interface{}, out interface{},
+) error {
+  result, err := client.Rpc(ctx, schema_name, function_name, args)
   if err != nil {
-    log.Println("error marshaling body:", err)
-    return nil, err
+    return err
   }
-  req_body := bytes.NewReader(body_json)
-  resp, err := http.Post(client.url + "/own", "", req_body)
-  if err != nil {
-    log.Println("error sending request:", err)
-    return nil, err
+  if result.Error != nil {
+    return errors.New(*result.Error)
   }
-  log.Printf("resp: %+v\n", resp)
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
+  err = unmarshal_jsonl(result.Success, out)
   if err != nil {
-    log.Println("error reading response:", err)
-    return nil, err
-  }
-  if resp.StatusCode != 200 {
-    err_string := fmt.Sprintf("error http status code %d: %s", resp.StatusCode,
-      string(body))
-    err = errors.New(err_string)
-    return nil, err
+    client.logf("error converting json lines to result rows: %v\n", err)
+    return err
   }
+  return nil
+}
+
+func unmarshal_jsonl(jsonl *string, out interface{}) error {
+  var lines []string
+  if jsonl != nil {
+    lines = strings.Split(strings.TrimSpace(*jsonl), "\n")
+    if len(lines) == 1 && lines[0] == "" {
+      lines = nil
+    }
+  }
+  return json.Unmarshal([]byte("[" + strings.Join(lines, ",") + "]"), out)
+}
+
+func (client *Client) post_result(
+  ctx context.Context, path string, req interface{},
+) (*pgrest.Result, error) {
   var result pgrest.Result
-  err = json.Unmarshal(body, &result)
+  err := client.request_json(ctx, "POST", path, req, &result, "result",
+    false)
   if err != nil {
-    log.Println("error converting json to result:", err)
     return nil, err
   }
-  return &result, err
+  return &result, nil
 }
 
-func (client *Client) Du() ([]pgrest.User, error) {
-  resp, err := client.client.Get(client.url + "/du")
-  if err != nil {
-    log.Println("error sending request:", err)
-    return nil, err
+// sends req as the json request body, or no body if req is nil, and converts
+// the json response to v
+func (client *Client) request_json(
+  ctx context.Context, method string, path string, req interface{},
+  v interface{}, name string, idempotent bool,
+) error {
+  var body_json []byte
+  if req != nil {
+    var err error
+    body_json, err = json.Marshal(req)
+    if err != nil {
+      client.logf("error marshaling body: %v\n", err)
+      return err
+    }
+  }
+  body, err := client.do(ctx, method, path, body_json, idempotent)
+  if err != nil {
+    return err
+  }
+  err = json.Unmarshal(body, v)
+  if err != nil {
+    client.logf("error converting json to %s: %v\n", name, err)
+    return err
+  }
+  return nil
+}
+
+// returns the response body, retrying according to the retry policy; a
+// response status other than 200 is returned as an error
+//
+// When retries are enabled, non-idempotent calls are sent with an
+// Idempotency-Key header so the server replays the response of an attempt
+// that succeeded instead of repeating the mutation.
+func (client *Client) do(
+  ctx context.Context, method string, path string, req_body []byte,
+  idempotent bool,
+) ([]byte, error) {
+  var key string
+  if !idempotent && client.retry.max_attempts > 1 {
+    key = new_idempotency_key()
+    idempotent = true
+  }
+  var body []byte
+  var retry bool
+  var err error
+  for attempt := 0; ; attempt++ {
+    body, retry, err = client.attempt(ctx, method, path, req_body, idempotent,
+      key)
+    if err == nil || !retry || attempt + 1 >= client.retry.max_attempts {
+      break
+    }
+    client.logf("retrying %s %s after error: %v\n", method, path, err)
+    if !client.retry.wait(ctx, attempt) {
+      break
+    }
+  }
+  return body, err
+}
+
+// sends the request once; returns whether a failure may be retried
+func (client *Client) attempt(
+  ctx context.Context, method string, path string, req_body []byte,
+  idempotent bool, key string,
+) ([]byte, bool, error) {
+  var body_reader io.Reader
+  if req_body != nil {
+    body_reader = bytes.NewReader(req_body)
   }
-  log.Printf("resp: %+v\n", resp)
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
+  req, err := http.NewRequestWithContext(ctx, method, client.url + path,
+    body_reader)
   if err != nil {
-    log.Println("error reading response:", err)
-    return nil, err
-  }
-  if resp.StatusCode != 200 {
-    err_string := fmt.Sprintf("error http status code %d: %s", resp.StatusCode,
-      string(body))
-    err = errors.New(err_string)
-    return nil, err
+    client.logf("error creating request: %v\n", err)
+    return nil, false, err
   }
-  var users []pgrest.User
-  err = json.Unmarshal(body, &users)
-  if err != nil {
-    log.Println("error converting json to users:", err)
-    return nil, err
+  for name, values := range client.headers {
+    req.Header[name] = values
   }
-  return users, err
-}
-
-func (client *Client) Add(user_name string) (*pgrest.Result, error) {
-  create_user := pgrest.CreateUser { UserName: user_name }
-  body_json, err := json.Marshal(create_user)
-  if err != nil {
-    log.Println("error marshaling body:", err)
-    return nil, err
+  if key != "" {
+    req.Header.Set("Idempotency-Key", key)
   }
-  req_body := bytes.NewReader(body_json)
-  resp, err := http.Post(client.url + "/add", "", req_body)
+  resp, err := client.client.Do(req)
   if err != nil {
-    log.Println("error sending request:", err)
-    return nil, err
+    client.logf("error sending request: %v\n", err)
+    return nil, idempotent && ctx.Err() == nil, err
   }
-  log.Printf("resp: %+v\n", resp)
   defer resp.Body.Close()
   body, err := ioutil.ReadAll(resp.Body)
   if err != nil {
-    log.Println("error reading response:", err)
-    return nil, err
+    client.logf("error reading response: %v\n", err)
+    return nil, idempotent && ctx.Err() == nil, err
   }
   if resp.StatusCode != 200 {
     err_string := fmt.Sprintf("error http status code %d: %s", resp.StatusCode,
       string(body))
     err = errors.New(err_string)
-    return nil, err
+    return nil, idempotent && retry_statuses[resp.StatusCode], err
   }
-  var result pgrest.Result
-  err = json.Unmarshal(body, &result)
-  if err != nil {
-    log.Println("error converting json to result:", err)
-    return nil, err
-  }
-  return &result, err
+  return body, false, nil
 }
-
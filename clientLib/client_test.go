@@ -0,0 +1,80 @@
+package client
+
+import (
+  "context"
+  "io"
+  "log"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+func TestD(t *testing.T) {
+  tests := []struct {
+    name   string
+    schema string
+    body   string
+    status int
+  } {
+    {
+      name: "search path",
+      body: `{"TableName":"users"}`,
+      status: http.StatusOK,
+    },
+    {
+      name: "schema",
+      schema: "app",
+      body: `{"Schema":"app","TableName":"users"}`,
+      status: http.StatusOK,
+    },
+    {
+      name: "no such table",
+      body: `{"TableName":"users"}`,
+      status: http.StatusNotFound,
+    },
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      handler := func(w http.ResponseWriter, r *http.Request) {
+        body, _ := io.ReadAll(r.Body)
+        if r.Method != "GET" || r.URL.Path != "/d" ||
+          string(body) != test.body {
+          t.Errorf("request %s %s %s, expected GET /d %s", r.Method,
+            r.URL.Path, body, test.body)
+        }
+        if test.status != http.StatusOK {
+          http.Error(w, "error no such table 'users'", test.status)
+          return
+        }
+        io.WriteString(w, `{"Schemaname":"app","Tablename":"users",` +
+          `"Kind":"table","Primary_key":["id"],"Columns":[` +
+          `{"Column_name":"id","Ordinal_position":1,"Udt_name":"int4",` +
+          `"Is_primary_key":true,"Foreign_keys":null}]}`)
+      }
+      server := httptest.NewServer(http.HandlerFunc(handler))
+      defer server.Close()
+      client := MakeClient(server.URL,
+        WithLogger(log.New(io.Discard, "", 0)))
+      table, err := client.D(context.Background(), test.schema, "users")
+      if test.status != http.StatusOK {
+        if err == nil {
+          t.Fatalf("expected an error, got %+v", table)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatal(err)
+      }
+      if table.Tablename.String != "users" || table.Kind.String != "table" ||
+        len(table.Primary_key) != 1 || len(table.Columns) != 1 {
+        t.Fatalf("table %+v", table)
+      }
+      column := table.Columns[0]
+      if column.Column_name.String != "id" ||
+        column.Ordinal_position.Int32 != 1 ||
+        column.Udt_name.String != "int4" || !column.Is_primary_key {
+        t.Errorf("column %+v", column)
+      }
+    })
+  }
+}
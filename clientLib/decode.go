@@ -0,0 +1,213 @@
+package client
+
+import (
+  "bytes"
+  "context"
+  "database/sql"
+  "errors"
+  "fmt"
+  "reflect"
+  "sort"
+  "strings"
+  "time"
+  pgrest "pgrest/pgrestLib"
+  json "github.com/goccy/go-json"
+)
+
+// returned together with the decoded rows when some result columns have no
+// matching struct field
+type UnmappedColumnsError struct {
+  Columns []string
+}
+
+func (err *UnmappedColumnsError) Error() string {
+  return fmt.Sprintf("columns not mapped to struct fields: %s",
+    strings.Join(err.Columns, ", "))
+}
+
+type struct_field struct {
+  name  string
+  index []int
+}
+
+var scanner_type = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+var unmarshaler_type = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// reads the columns of a table into structs of type T, see DecodeRows
+func ReadInto[T any](
+  ctx context.Context, client *Client, table_name string,
+  column_names []string,
+) ([]T, error) {
+  result, err := client.Read(ctx, table_name, column_names)
+  if err != nil {
+    return nil, err
+  }
+  return DecodeRows[T](result)
+}
+
+// runs a SELECT statement and decodes the rows into structs of type T, see
+// DecodeRows
+func QueryInto[T any](
+  ctx context.Context, client *Client, stmt string,
+) ([]T, error) {
+  result, err := client.ExecSql(ctx, stmt)
+  if err != nil {
+    return nil, err
+  }
+  return DecodeRows[T](result)
+}
+
+// decodes the json lines rows of a result into structs of type T
+//
+// Columns are matched to fields by the field's `db` tag, then its `json` tag,
+// then its name, ignoring case. NULL can be decoded into pointers, maps,
+// slices, interfaces, sql.Null* types and types like pgtype.Text that
+// unmarshal json null; other fields return an error. If some columns have no
+// field the rows are still returned, together with an *UnmappedColumnsError.
+func DecodeRows[T any](result *pgrest.Result) ([]T, error) {
+  if result.Error != nil {
+    return nil, errors.New(*result.Error)
+  }
+  rows := make([]T, 0)
+  if result.Success == nil {
+    return rows, nil
+  }
+  t := reflect.TypeOf((*T)(nil)).Elem()
+  if t.Kind() != reflect.Struct {
+    return nil, fmt.Errorf("cannot decode rows into %v, not a struct", t)
+  }
+  fields, folded := struct_fields(t)
+  unmapped := make(map[string]bool)
+  for _, line := range strings.Split(*result.Success, "\n") {
+    if strings.TrimSpace(line) == "" {
+      continue
+    }
+    values := make(map[string]json.RawMessage)
+    err := json.Unmarshal([]byte(line), &values)
+    if err != nil {
+      return nil, fmt.Errorf("result is not json lines rows: %v", err)
+    }
+    var row T
+    row_value := reflect.ValueOf(&row).Elem()
+    for column, raw := range values {
+      field, ok := fields[column]
+      if !ok {
+        field, ok = folded[strings.ToLower(column)]
+      }
+      if !ok {
+        unmapped[column] = true
+        continue
+      }
+      err := decode_value(row_value.FieldByIndex(field.index), raw)
+      if err != nil {
+        return nil, fmt.Errorf("error decoding column '%s' into field %s: %v",
+          column, field.name, err)
+      }
+    }
+    rows = append(rows, row)
+  }
+  if len(unmapped) > 0 {
+    columns := make([]string, 0, len(unmapped))
+    for column := range unmapped {
+      columns = append(columns, column)
+    }
+    sort.Strings(columns)
+    return rows, &UnmappedColumnsError { Columns: columns }
+  }
+  return rows, nil
+}
+
+// returns the fields by column name and by lower case column name
+func struct_fields(t reflect.Type) (
+  map[string]struct_field, map[string]struct_field,
+) {
+  fields := make(map[string]struct_field)
+  folded := make(map[string]struct_field)
+  for _, field := range reflect.VisibleFields(t) {
+    if field.Anonymous || !field.IsExported() || through_pointer(t, field) {
+      continue
+    }
+    column := field.Name
+    if tag, ok := field.Tag.Lookup("db"); ok {
+      column, _, _ = strings.Cut(tag, ",")
+    } else if tag, ok := field.Tag.Lookup("json"); ok {
+      name, _, _ := strings.Cut(tag, ",")
+      if name != "" {
+        column = name
+      }
+    }
+    if column == "-" {
+      continue
+    }
+    info := struct_field { name: field.Name, index: field.Index }
+    fields[column] = info
+    if _, ok := folded[strings.ToLower(column)]; !ok {
+      folded[strings.ToLower(column)] = info
+    }
+  }
+  return fields, folded
+}
+
+// true if the field is promoted through an embedded pointer, which may be nil
+func through_pointer(t reflect.Type, field reflect.StructField) bool {
+  for _, i := range field.Index[:len(field.Index) - 1] {
+    embedded := t.Field(i)
+    if embedded.Type.Kind() == reflect.Pointer {
+      return true
+    }
+    t = embedded.Type
+  }
+  return false
+}
+
+func decode_value(field reflect.Value, raw json.RawMessage) error {
+  is_null := bytes.Equal(bytes.TrimSpace(raw), []byte("null"))
+  ptr := field.Addr()
+  // sql.Null* types implement sql.Scanner but not json.Unmarshaler
+  if ptr.Type().Implements(scanner_type) &&
+    !ptr.Type().Implements(unmarshaler_type) {
+    scanner := ptr.Interface().(sql.Scanner)
+    if is_null {
+      return scanner.Scan(nil)
+    }
+    return scan_json(scanner, raw)
+  }
+  if is_null {
+    switch field.Kind() {
+      case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Interface:
+        field.Set(reflect.Zero(field.Type()))
+        return nil
+    }
+    if !ptr.Type().Implements(unmarshaler_type) {
+      return fmt.Errorf("NULL value for non-nullable field of type %v",
+        field.Type())
+    }
+  }
+  return json.Unmarshal(raw, ptr.Interface())
+}
+
+func scan_json(scanner sql.Scanner, raw json.RawMessage) error {
+  decoder := json.NewDecoder(bytes.NewReader(raw))
+  decoder.UseNumber()
+  var value interface{}
+  err := decoder.Decode(&value)
+  if err != nil {
+    return err
+  }
+  switch v := value.(type) {
+    case json.Number:
+      return scanner.Scan(v.String())
+    case string:
+      err := scanner.Scan(v)
+      if err != nil {
+        // timestamps are encoded as RFC 3339 strings
+        if t, time_err := time.Parse(time.RFC3339Nano, v); time_err == nil {
+          return scanner.Scan(t)
+        }
+      }
+      return err
+    case bool:
+      return scanner.Scan(v)
+  }
+  return scanner.Scan(string(raw))
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+  "database/sql"
+  "errors"
+  "reflect"
+  "testing"
+  "time"
+  pgrest "pgrest/pgrestLib"
+)
+
+type decode_base struct {
+  Id int64 `db:"id"`
+}
+
+type decode_row struct {
+  decode_base
+  Name    string          `json:"name"`
+  Email   *string
+  Score   sql.NullFloat64 `db:"score"`
+  Created sql.NullTime    `db:"created_at"`
+  Tags    []string        `db:"tags"`
+  Ignored string          `db:"-"`
+}
+
+func result_of(lines string) *pgrest.Result {
+  return &pgrest.Result { Success: &lines }
+}
+
+func TestDecodeRows(t *testing.T) {
+  email := "a@example.com"
+  created := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+  tests := []struct {
+    name     string
+    result   *pgrest.Result
+    rows     []decode_row
+    unmapped []string
+    err      bool
+  } {
+    {
+      name: "empty",
+      result: result_of(""),
+      rows: []decode_row {},
+    },
+    {
+      name: "no success",
+      result: &pgrest.Result {},
+      rows: []decode_row {},
+    },
+    {
+      name: "tags, names and embedded fields",
+      result: result_of(`{"id":1,"name":"a","EMAIL":"a@example.com",` +
+        `"score":1.5,"created_at":"2024-05-01T12:30:00Z","tags":["x"]}` +
+        "\n" + `{"id":2,"name":"b","email":null,"score":null,` +
+        `"created_at":null,"tags":null}` + "\n"),
+      rows: []decode_row {
+        {
+          decode_base: decode_base { Id: 1 }, Name: "a", Email: &email,
+          Score: sql.NullFloat64 { Float64: 1.5, Valid: true },
+          Created: sql.NullTime { Time: created, Valid: true },
+          Tags: []string { "x" },
+        },
+        { decode_base: decode_base { Id: 2 }, Name: "b" },
+      },
+    },
+    {
+      name: "unmapped columns",
+      result: result_of(`{"id":1,"extra":2,"Ignored":"x"}` + "\n"),
+      rows: []decode_row { { decode_base: decode_base { Id: 1 } } },
+      unmapped: []string { "Ignored", "extra" },
+    },
+    {
+      name: "null into a non-nullable field",
+      result: result_of(`{"id":null}` + "\n"),
+      err: true,
+    },
+    {
+      name: "not json",
+      result: result_of("id=1\n"),
+      err: true,
+    },
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      rows, err := DecodeRows[decode_row](test.result)
+      var unmapped *UnmappedColumnsError
+      switch {
+        case test.err:
+          if err == nil {
+            t.Fatalf("expected an error, got %+v", rows)
+          }
+          return
+        case test.unmapped != nil:
+          if !errors.As(err, &unmapped) {
+            t.Fatalf("expected unmapped columns, got %v", err)
+          }
+          if !reflect.DeepEqual(unmapped.Columns, test.unmapped) {
+            t.Errorf("unmapped %v, expected %v", unmapped.Columns,
+              test.unmapped)
+          }
+        case err != nil:
+          t.Fatal(err)
+      }
+      if !reflect.DeepEqual(rows, test.rows) {
+        t.Errorf("rows %+v, expected %+v", rows, test.rows)
+      }
+    })
+  }
+}
+
+func TestDecodeRowsErrorResult(t *testing.T) {
+  msg := "relation does not exist"
+  _, err := DecodeRows[decode_row](&pgrest.Result { Error: &msg })
+  if err == nil || err.Error() != msg {
+    t.Errorf("error %v, expected %q", err, msg)
+  }
+}
+
+func TestDecodeRowsNotStruct(t *testing.T) {
+  _, err := DecodeRows[int](result_of(`{"id":1}` + "\n"))
+  if err == nil {
+    t.Error("expected an error decoding into an int")
+  }
+}
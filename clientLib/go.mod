@@ -1,5 +1,5 @@
 module pgrest/clientLib
 
-go 1.20
+go 1.21
 
 require github.com/goccy/go-json v0.10.2
@@ -0,0 +1,27 @@
+package client
+
+import (
+  "context"
+  pgrest "pgrest/pgrestLib"
+)
+
+// runs a migration action (up, down or status) on the server's migrations and
+// returns the status of every migration afterwards. Up applies the pending
+// migrations up to version target, or all of them when target is nil; down
+// rolls back the applied migrations after version target, or only the latest
+// when target is nil
+func (client *Client) Migrate(
+  ctx context.Context, action string, target *int64,
+) ([]pgrest.MigrationStatus, error) {
+  var statuses []pgrest.MigrationStatus
+  migrate := pgrest.Migrate { Action: action, Target: target }
+  // repeating a run is harmless except for a down without a target, which
+  // would roll back one more migration
+  idempotent := action != "down" || target != nil
+  err := client.request_json(ctx, "POST", "/migrate", migrate, &statuses,
+    "migration statuses", idempotent)
+  if err != nil {
+    return nil, err
+  }
+  return statuses, nil
+}
@@ -0,0 +1,160 @@
+package client
+
+import (
+  "context"
+  crypto_rand "crypto/rand"
+  "crypto/tls"
+  "encoding/hex"
+  "math/rand"
+  "net/http"
+  "time"
+)
+
+// anything that can print log lines, e.g. *log.Logger
+type Logger interface {
+  Printf(format string, v ...interface{})
+}
+
+type Option func(*options)
+
+type options struct {
+  transport    http.RoundTripper
+  timeout      time.Duration
+  tls_config   *tls.Config
+  certificates []tls.Certificate
+  headers      http.Header
+  logger       Logger
+  retry        retry_policy
+}
+
+// retries with exponential backoff with full jitter between min_backoff and
+// max_backoff
+type retry_policy struct {
+  max_attempts int
+  min_backoff  time.Duration
+  max_backoff  time.Duration
+}
+
+// statuses worth retrying for idempotent calls
+var retry_statuses = map[int]bool {
+  http.StatusTooManyRequests: true,
+  http.StatusBadGateway: true,
+  http.StatusServiceUnavailable: true,
+  http.StatusGatewayTimeout: true,
+}
+
+// the round tripper the client sends requests with; TLS options are applied
+// to it when it is an *http.Transport
+func WithTransport(transport http.RoundTripper) Option {
+  return func(opts *options) { opts.transport = transport }
+}
+
+// the timeout of each attempt, including reading the response body
+func WithTimeout(timeout time.Duration) Option {
+  return func(opts *options) { opts.timeout = timeout }
+}
+
+func WithTLSConfig(tls_config *tls.Config) Option {
+  return func(opts *options) { opts.tls_config = tls_config }
+}
+
+// a certificate presented to servers that verify client certificates; load
+// one with tls.LoadX509KeyPair
+func WithClientCertificate(certificate tls.Certificate) Option {
+  return func(opts *options) {
+    opts.certificates = append(opts.certificates, certificate)
+  }
+}
+
+// a header sent with every request
+func WithHeader(key string, value string) Option {
+  return func(opts *options) { opts.headers.Add(key, value) }
+}
+
+// sends the token as a bearer token in the Authorization header
+func WithAuthToken(token string) Option {
+  return func(opts *options) {
+    opts.headers.Set("Authorization", "Bearer " + token)
+  }
+}
+
+// where errors are logged; nil disables logging
+func WithLogger(logger Logger) Option {
+  return func(opts *options) { opts.logger = logger }
+}
+
+// makes up to max_attempts attempts per call, waiting a random time of up to
+// min_backoff * 2^attempt, capped at max_backoff, between attempts
+//
+// Calls are retried on connection errors and on 429, 502, 503 and 504
+// responses. Calls that are not idempotent (everything but catalog requests
+// and Read) are sent with a generated Idempotency-Key so the server does not
+// apply them twice.
+func WithRetry(
+  max_attempts int, min_backoff time.Duration, max_backoff time.Duration,
+) Option {
+  return func(opts *options) {
+    opts.retry = retry_policy { max_attempts, min_backoff, max_backoff }
+  }
+}
+
+func (client *Client) logf(format string, v ...interface{}) {
+  if client.logger != nil {
+    client.logger.Printf(format, v...)
+  }
+}
+
+func build_http_client(opts *options) *http.Client {
+  transport := opts.transport
+  if transport == nil {
+    transport = http.DefaultTransport.(*http.Transport).Clone()
+  }
+  if opts.tls_config != nil || len(opts.certificates) > 0 {
+    if t, ok := transport.(*http.Transport); ok {
+      t = t.Clone()
+      tls_config := opts.tls_config
+      if tls_config == nil {
+        tls_config = &tls.Config{}
+      } else {
+        tls_config = tls_config.Clone()
+      }
+      tls_config.Certificates = append(tls_config.Certificates,
+        opts.certificates...)
+      t.TLSClientConfig = tls_config
+      transport = t
+    } else if opts.logger != nil {
+      opts.logger.Printf("TLS options ignored for transport of type %T\n",
+        transport)
+    }
+  }
+  return &http.Client { Transport: transport, Timeout: opts.timeout }
+}
+
+func new_idempotency_key() string {
+  key := make([]byte, 16)
+  crypto_rand.Read(key)
+  return hex.EncodeToString(key)
+}
+
+// waits before the given retry attempt; returns false if ctx is done first
+func (policy *retry_policy) wait(ctx context.Context, attempt int) bool {
+  backoff := policy.max_backoff
+  if attempt < 32 && policy.min_backoff << uint(attempt) < backoff {
+    backoff = policy.min_backoff << uint(attempt)
+  }
+  if backoff <= 0 {
+    backoff = policy.max_backoff
+  }
+  var delay time.Duration
+  if backoff > 0 {
+    delay = time.Duration(rand.Int63n(int64(backoff) + 1))
+  }
+  timer := time.NewTimer(delay)
+  defer timer.Stop()
+  select {
+    case <-ctx.Done():
+      return false
+    case <-timer.C:
+      return true
+  }
+}
@@ -0,0 +1,165 @@
+package client
+
+import (
+  "bufio"
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "strings"
+  pgrest "pgrest/pgrestLib"
+  json "github.com/goccy/go-json"
+)
+
+// a server-sent event stream read in the background
+type stream struct {
+  cancel context.CancelFunc
+  done   chan struct{}
+  err    error
+}
+
+// ends the stream and waits for its channel to be closed
+func (s *stream) Close() {
+  s.cancel()
+  <-s.done
+}
+
+// why the stream ended; nil while it runs and after Close
+func (s *stream) Err() error {
+  select {
+    case <-s.done:
+      return s.err
+    default:
+      return nil
+  }
+}
+
+// notifications on the channels of a subscription; Notifications is closed
+// when the subscription ends, after which Err returns the reason
+type Subscription struct {
+  Notifications <-chan pgrest.Notification
+  stream
+}
+
+// subscribes to notifications on channels, streamed by the server as
+// server-sent events; the subscription ends with ctx, on Close or when the
+// stream ends, and is not retried. The client timeout does not apply
+func (client *Client) Subscribe(ctx context.Context, channels ...string) (
+  *Subscription, error,
+) {
+  if len(channels) == 0 {
+    return nil, errors.New("error no channels")
+  }
+  notifications := make(chan pgrest.Notification)
+  sub := &Subscription { Notifications: notifications }
+  query := url.Values { "channel": channels }
+  event := func(ctx context.Context, data []byte) error {
+    var notification pgrest.Notification
+    err := json.Unmarshal(data, &notification)
+    if err != nil {
+      return fmt.Errorf("error converting json to notification: %w", err)
+    }
+    select {
+      case notifications <- notification:
+        return nil
+      case <-ctx.Done():
+        return ctx.Err()
+    }
+  }
+  err := client.open_events(ctx, "/listen", query, &sub.stream, event,
+    func() { close(notifications) })
+  if err != nil {
+    return nil, err
+  }
+  return sub, nil
+}
+
+// sends a notification with pg_notify
+func (client *Client) Notify(
+  ctx context.Context, channel string, payload string,
+) (*pgrest.Result, error) {
+  notify := pgrest.Notify { Channel: channel, Payload: payload }
+  return client.post_result(ctx, "/notify", notify)
+}
+
+// opens an event stream and reads it in the background, calling event with
+// the data of each event and closed when the stream ends
+func (client *Client) open_events(
+  ctx context.Context, path string, query url.Values, s *stream,
+  event func(context.Context, []byte) error, closed func(),
+) error {
+  ctx, cancel := context.WithCancel(ctx)
+  req, err := http.NewRequestWithContext(ctx, "GET",
+    client.url + path + "?" + query.Encode(), nil)
+  if err != nil {
+    cancel()
+    client.logf("error creating request: %v\n", err)
+    return err
+  }
+  for name, values := range client.headers {
+    req.Header[name] = values
+  }
+  req.Header.Set("Accept", "text/event-stream")
+  stream_client := &http.Client { Transport: client.client.Transport }
+  resp, err := stream_client.Do(req)
+  if err != nil {
+    cancel()
+    client.logf("error sending request: %v\n", err)
+    return err
+  }
+  if resp.StatusCode != 200 {
+    body, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    cancel()
+    return fmt.Errorf("error http status code %d: %s", resp.StatusCode,
+      string(body))
+  }
+  s.cancel = cancel
+  s.done = make(chan struct{})
+  go func() {
+    defer close(s.done)
+    defer closed()
+    defer resp.Body.Close()
+    err := read_events(ctx, resp.Body, event)
+    if ctx.Err() == nil {
+      s.err = err
+    }
+  }()
+  return nil
+}
+
+// calls event with the data of each event in the stream; comments and other
+// fields are ignored
+func read_events(
+  ctx context.Context, body io.Reader,
+  event func(context.Context, []byte) error,
+) error {
+  scanner := bufio.NewScanner(body)
+  scanner.Buffer(nil, 64 << 20)
+  var data []string
+  for scanner.Scan() {
+    line := scanner.Text()
+    if line != "" {
+      if strings.HasPrefix(line, "data:") {
+        data = append(data, strings.TrimPrefix(
+          strings.TrimPrefix(line, "data:"), " "))
+      }
+      continue
+    }
+    if len(data) == 0 {
+      continue
+    }
+    err := event(ctx, []byte(strings.Join(data, "\n")))
+    data = nil
+    if err != nil {
+      return err
+    }
+  }
+  if err := scanner.Err(); err != nil {
+    return err
+  }
+  return errors.New("error event stream ended")
+}
@@ -1,5 +1,5 @@
 module pgrest/pgrestLib
 
-go 1.20
+go 1.21
 
 require github.com/jackc/pgx/v5 v5.4.3
@@ -1,17 +1,27 @@
 package pgrest
 
 import (
+  "encoding/json"
   "fmt"
   //"log"
   "net/url"
+  "time"
   "github.com/jackc/pgx/v5/pgtype"
 )
 
 // server -> client
 
+// the size, row estimate and activity fields are only set when /dt is asked
+// for stats; sizes are in bytes, Table_bytes without toast, and
+// Estimated_rows is unset until the table is first analyzed
 type Table struct {
   Schemaname, Tablename, Tableowner,  Tablespace  pgtype.Text
   Hasindexes, Hasrules,  Hastriggers, Rowsecurity bool
+  Total_bytes, Table_bytes, Index_bytes, Toast_bytes,
+  Estimated_rows *int64 `json:",omitempty"`
+  Seq_scan, Idx_scan, N_live_tup, N_dead_tup *int64 `json:",omitempty"`
+  Last_vacuum, Last_autovacuum, Last_analyze,
+  Last_autoanalyze *time.Time `json:",omitempty"`
 }
 
 type Schema struct {
@@ -23,14 +33,80 @@ type Function struct {
   Specific_schema, Specific_name, Type_udt_name pgtype.Text
 }
 
+// the information_schema.columns fields of a column, plus whether it is part
+// of the primary key, the columns it references by foreign keys and its
+// comment
 type Column struct {
-  Column_name, Data_type, Collation_name, Is_nullable, Column_default pgtype.Text
+  Table_schema, Table_name, Column_name                       pgtype.Text
+  Ordinal_position                                            pgtype.Int4
+  Data_type, Udt_name                                         pgtype.Text
+  Character_maximum_length, Numeric_precision, Numeric_scale  pgtype.Int4
+  Collation_name, Is_nullable, Column_default                 pgtype.Text
+  Is_identity, Identity_generation                            pgtype.Text
+  Is_generated, Generation_expression                         pgtype.Text
+  Is_primary_key                                              bool
+  Foreign_keys                                                []ForeignKeyTarget
+  Comment                                                     pgtype.Text
+}
+
+type ForeignKeyTarget struct {
+  Constraint string
+  Schema     string
+  Table      string
+  Column     string
+}
+
+// a table, view, materialized view, foreign table or partitioned table (Kind)
+// with its columns
+type TableDescription struct {
+  Schemaname, Tablename, Kind, Owner, Comment pgtype.Text
+  Primary_key                                 []string
+  Columns                                     []Column
 }
 
 type Index struct {
   Schemaname, Tablename, Indexname, Tablespace, Indexdef pgtype.Text
 }
 
+type View struct {
+  Schemaname, Viewname, Viewowner, Definition pgtype.Text
+}
+
+type MaterializedView struct {
+  Schemaname, Matviewname, Matviewowner, Tablespace, Definition pgtype.Text
+  Hasindexes, Ispopulated                                       bool
+}
+
+// Last_value is null until the sequence is used or without privileges on it
+type Sequence struct {
+  Schemaname, Sequencename, Sequenceowner, Data_type pgtype.Text
+  Start_value, Min_value, Max_value, Increment_by, Cache_size,
+  Last_value pgtype.Int8
+  Cycle bool
+}
+
+// Timing is BEFORE, AFTER or INSTEAD OF, Events are INSERT, UPDATE, DELETE and
+// TRUNCATE, Level is ROW or STATEMENT and Enabled is origin, disabled,
+// replica or always (see session_replication_role)
+type Trigger struct {
+  Schemaname, Tablename, Triggername, Timing pgtype.Text
+  Events                                     []string
+  Level, Function, Enabled, Definition       pgtype.Text
+}
+
+// Constrainttype is PRIMARY KEY, UNIQUE, CHECK, FOREIGN KEY, EXCLUDE,
+// TRIGGER or, from postgres 18, NOT NULL; the referenced table and columns and
+// the actions are set for foreign keys
+type Constraint struct {
+  Schemaname, Tablename, Constraintname, Constrainttype pgtype.Text
+  Columns                                               []string
+  Referenced_schema, Referenced_table                   pgtype.Text
+  Referenced_columns                                    []string
+  On_update, On_delete                                  pgtype.Text
+  Deferrable, Deferred, Validated                       bool
+  Definition                                            pgtype.Text
+}
+
 type DataType struct {
   Data_type pgtype.Text
 }
@@ -39,9 +115,35 @@ type User struct {
   Usename pgtype.Text
 }
 
+type ReplicationSlot struct {
+  Slot_name, Restart_lsn, Confirmed_flush_lsn pgtype.Text
+  Active                                      bool
+}
+
+// Tables are schema.table names
+type Publication struct {
+  Pubname      pgtype.Text
+  Puballtables bool
+  Tables       []string
+}
+
+type QueryParam struct {
+  Name string
+  Type string
+}
+
+// a saved, parameterized query; parameters are bound in order as $1, $2, ...
+type NamedQuery struct {
+  Name   string
+  Sql    string
+  Params []QueryParam
+}
+
 type Result struct {
   Success *string
   Error   *string
+  // the rows in Success were cut short by the server's row or byte cap
+  Truncated bool `json:",omitempty"`
 }
 
 func (res *Result) String() string {
@@ -60,10 +162,80 @@ func (res *Result) String() string {
   return fmt.Sprintf("{Success:%s Error:%s}", success, err)
 }
 
+type PoolStats struct {
+  TotalConns        int32
+  AcquiredConns     int32
+  IdleConns         int32
+  ConstructingConns int32
+  MaxConns          int32
+  // acquired connections as a fraction of MaxConns
+  Saturation        float64
+}
+
+// Status is "ok" for /healthz; for /readyz it is "ready", "draining",
+// "saturated" or "unavailable"
+type Health struct {
+  Status string
+  Error  *string    `json:",omitempty"`
+  Pool   *PoolStats `json:",omitempty"`
+}
+
+// the quota state of one identity (client certificate role or IP address) and
+// endpoint class; zero limits are unlimited
+type QuotaUsage struct {
+  Identity    string
+  Class       string
+  Tokens      float64
+  InFlight    int
+  Rate        float64
+  Burst       int
+  Concurrency int
+}
+
+// a notification received on a channel; Pid is the process id of the
+// notifying backend
+type Notification struct {
+  Channel string
+  Payload string
+  Pid     uint32
+}
+
+// a change from a logical replication stream; Op is insert, update, delete or
+// truncate. Before and After are rows like those of /read; Before is sent for
+// updates and deletes with the replica identity columns, or every column with
+// REPLICA IDENTITY FULL. Token resumes the stream after this change
+type Change struct {
+  Token  string
+  Lsn    string
+  Xid    uint32
+  Time   time.Time
+  Op     string
+  Schema string
+  Table  string
+  Before json.RawMessage `json:",omitempty"`
+  After  json.RawMessage `json:",omitempty"`
+}
+
+// a migration and whether it is applied; Drift is set when its up file no
+// longer matches the checksum recorded when it was applied, and Missing when
+// an applied migration has no files
+type MigrationStatus struct {
+  Version    int64
+  Name       string
+  Checksum   string
+  Applied    bool
+  Applied_at *time.Time `json:",omitempty"`
+  Drift      bool       `json:",omitempty"`
+  Missing    bool       `json:",omitempty"`
+}
+
 
 // client -> server
 
+// Schema is optional for /d, which otherwise finds the table on the search
+// path
 type ReqTable struct {
+  Schema    string `json:",omitempty"`
   TableName string
 }
 
@@ -72,15 +244,74 @@ type ReqColumn struct {
   ColumnName string
 }
 
+// the rows of TableName, all columns when ColumnNames is empty. Filters,
+// Order (col.asc,col2.desc as in the order parameter of the rows routes) and
+// Limit narrow the rows, and Embed nests related rows in each of them
 type ReadColumns struct {
   TableName   string
   ColumnNames []string
+  Filters     []Filter    `json:",omitempty"`
+  Order       string      `json:",omitempty"`
+  Limit       *uint64     `json:",omitempty"`
+  Embed       []ReadEmbed `json:",omitempty"`
 }
 
+// the rows of TableName related to the embedding row through a foreign key,
+// nested under As (TableName by default): the referenced row as an object, or
+// null, when the embedding table has the key, and an array of the referencing
+// rows when TableName has it. ForeignKey names the constraint when more than
+// one relates the tables; a self-referencing key embeds the referenced row.
+// Order and Limit only apply to arrays
+type ReadEmbed struct {
+  TableName   string
+  As          string      `json:",omitempty"`
+  ForeignKey  string      `json:",omitempty"`
+  ColumnNames []string    `json:",omitempty"`
+  Filters     []Filter    `json:",omitempty"`
+  Order       string      `json:",omitempty"`
+  Limit       *uint64     `json:",omitempty"`
+  Embed       []ReadEmbed `json:",omitempty"`
+}
+
+// an index on ColumnName and Columns, in that order, of the table in Schema
+// or on the search path. Method is btree (the default), hash, gist, spgist,
+// gin or brin, Include lists the columns of a covering index and Where makes
+// a partial index. Concurrently builds it without locking writes, outside a
+// transaction; a failed concurrent build leaves an invalid index to drop.
+// IndexName may be empty, letting postgres name the index, except with
+// IfNotExists
 type CreateIndex struct {
-  TableName  string
-  IndexName  string
-  ColumnName string
+  Schema       string        `json:",omitempty"`
+  TableName    string
+  IndexName    string
+  ColumnName   string        `json:",omitempty"`
+  Columns      []IndexColumn `json:",omitempty"`
+  Unique       bool          `json:",omitempty"`
+  Method       string        `json:",omitempty"`
+  Include      []string      `json:",omitempty"`
+  Where        string        `json:",omitempty"`
+  IfNotExists  bool          `json:",omitempty"`
+  Concurrently bool          `json:",omitempty"`
+}
+
+// an indexed column, or an expression; Order is ASC or DESC, Nulls is FIRST or
+// LAST and Opclass an operator class like text_pattern_ops
+type IndexColumn struct {
+  ColumnName string `json:",omitempty"`
+  Expression string `json:",omitempty"`
+  Opclass    string `json:",omitempty"`
+  Order      string `json:",omitempty"`
+  Nulls      string `json:",omitempty"`
+}
+
+// Concurrently drops the index without locking out reads and writes of its
+// table, outside a transaction; it can't be combined with Cascade
+type DropIndex struct {
+  Schema       string `json:",omitempty"`
+  IndexName    string
+  IfExists     bool   `json:",omitempty"`
+  Concurrently bool   `json:",omitempty"`
+  Cascade      bool   `json:",omitempty"`
 }
 
 type Insert struct {
@@ -110,3 +341,70 @@ type CreateUser struct {
 type Exec struct {
   Url url.URL
 }
+
+type ReqQuery struct {
+  Name string
+}
+
+type Notify struct {
+  Channel string
+  Payload string
+}
+
+// empty Tables publishes all tables
+type CreatePublication struct {
+  Name   string
+  Tables []string
+}
+
+type ReqPublication struct {
+  Name string
+}
+
+type ReqSlot struct {
+  Name string
+}
+
+type AckChanges struct {
+  Slot  string
+  Token string
+}
+
+// Action is up, down or status. Up applies the pending migrations up to
+// version Target, or all of them without one; down rolls back the applied
+// migrations after version Target, or only the latest without one
+type Migrate struct {
+  Action string
+  Target *int64 `json:",omitempty"`
+}
+
+// a condition on a column; Op is one of eq, neq, lt, lte, gt, gte, like,
+// ilike, is (Value null, true or false) or in (Values)
+type Filter struct {
+  ColumnName string
+  Op         string
+  Value      string
+  Values     []string
+}
+
+// an aggregate of ColumnName named As, by default the function and the column
+// joined by an underscore. Function is count, count_distinct, sum, avg, min,
+// max or array_agg; count without a ColumnName counts the rows
+type AggregateColumn struct {
+  Function   string
+  ColumnName string `json:",omitempty"`
+  As         string `json:",omitempty"`
+}
+
+// the Aggregates of the rows of TableName matching Filters, per group of the
+// GroupBy columns. Having filters the groups by aggregate names and GroupBy
+// columns, and Order (name.desc,name2.asc) sorts them by the same names
+type Aggregate struct {
+  TableName  string
+  GroupBy    []string          `json:",omitempty"`
+  Aggregates []AggregateColumn `json:",omitempty"`
+  Filters    []Filter          `json:",omitempty"`
+  Having     []Filter          `json:",omitempty"`
+  Order      string            `json:",omitempty"`
+  Limit      *uint64           `json:",omitempty"`
+}
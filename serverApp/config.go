@@ -0,0 +1,456 @@
+package main
+
+import (
+  "flag"
+  "fmt"
+  "io"
+  "net/url"
+  "os"
+  "path/filepath"
+  "reflect"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+import (
+  "github.com/BurntSushi/toml"
+  "gopkg.in/yaml.v3"
+)
+
+// settings come from the defaults, then the config file, then PGREST_*
+// environment variables, then flags, each overriding the ones before
+//
+// Every setting has a key in the config file (pool.max_conns), an environment
+// variable (PGREST_POOL_MAX_CONNS) and a flag (-pool-max-conns). Lists are
+// comma separated and maps are comma separated key=value pairs in environment
+// variables and flags.
+type config struct {
+  Listen     string `toml:"listen" yaml:"listen"`
+  Queries    string `toml:"queries" yaml:"queries"`
+  Migrations string `toml:"migrations" yaml:"migrations"`
+  Database struct {
+    Url string `toml:"url" yaml:"url" secret:"conn"`
+  } `toml:"database" yaml:"database"`
+  Pool struct {
+    MaxConns        int32         `toml:"max_conns" yaml:"max_conns"`
+    MinConns        int32         `toml:"min_conns" yaml:"min_conns"`
+    MaxConnLifetime time.Duration `toml:"max_conn_lifetime" yaml:"max_conn_lifetime"`
+    MaxConnIdleTime time.Duration `toml:"max_conn_idle_time" yaml:"max_conn_idle_time"`
+  } `toml:"pool" yaml:"pool"`
+  Timeouts struct {
+    Read       time.Duration `toml:"read" yaml:"read"`
+    ReadHeader time.Duration `toml:"read_header" yaml:"read_header"`
+    Write      time.Duration `toml:"write" yaml:"write"`
+    Idle       time.Duration `toml:"idle" yaml:"idle"`
+    Shutdown   time.Duration `toml:"shutdown" yaml:"shutdown"`
+  } `toml:"timeouts" yaml:"timeouts"`
+  Endpoints struct {
+    Enabled  []string `toml:"enabled" yaml:"enabled"`
+    Disabled []string `toml:"disabled" yaml:"disabled"`
+  } `toml:"endpoints" yaml:"endpoints"`
+  Limits struct {
+    StatementTimeout            time.Duration `toml:"statement_timeout" yaml:"statement_timeout"`
+    MaxStatementTimeout         time.Duration `toml:"max_statement_timeout" yaml:"max_statement_timeout"`
+    LockTimeout                 time.Duration `toml:"lock_timeout" yaml:"lock_timeout"`
+    MaxLockTimeout              time.Duration `toml:"max_lock_timeout" yaml:"max_lock_timeout"`
+    IdleInTransactionTimeout    time.Duration `toml:"idle_in_transaction_timeout" yaml:"idle_in_transaction_timeout"`
+    MaxIdleInTransactionTimeout time.Duration `toml:"max_idle_in_transaction_timeout" yaml:"max_idle_in_transaction_timeout"`
+    MaxRows                     int           `toml:"max_rows" yaml:"max_rows"`
+    MaxBytes                    int           `toml:"max_bytes" yaml:"max_bytes"`
+  } `toml:"limits" yaml:"limits"`
+  Quotas struct {
+    Catalog quota_config `toml:"catalog" yaml:"catalog"`
+    Read    quota_config `toml:"read" yaml:"read"`
+    Write   quota_config `toml:"write" yaml:"write"`
+    ExecSql quota_config `toml:"exec_sql" yaml:"exec_sql"`
+  } `toml:"quotas" yaml:"quotas"`
+  Notify struct {
+    WebsocketOrigins []string `toml:"websocket_origins" yaml:"websocket_origins"`
+  } `toml:"notify" yaml:"notify"`
+  Idempotency struct {
+    Retention time.Duration `toml:"retention" yaml:"retention"`
+  } `toml:"idempotency" yaml:"idempotency"`
+  Auth struct {
+    Token string `toml:"token" yaml:"token" secret:"true"`
+  } `toml:"auth" yaml:"auth"`
+  Tls struct {
+    Cert              string            `toml:"cert" yaml:"cert"`
+    Key               string            `toml:"key" yaml:"key"`
+    ClientCa          string            `toml:"client_ca" yaml:"client_ca"`
+    RequireClientCert bool              `toml:"require_client_cert" yaml:"require_client_cert"`
+    ClientRole        string            `toml:"client_role" yaml:"client_role"`
+    ClientRoleMap     map[string]string `toml:"client_role_map" yaml:"client_role_map"`
+  } `toml:"tls" yaml:"tls"`
+  Log struct {
+    File          string        `toml:"file" yaml:"file"`
+    Level         string        `toml:"level" yaml:"level"`
+    Format        string        `toml:"format" yaml:"format"`
+    Requests      bool          `toml:"requests" yaml:"requests"`
+    Headers       bool          `toml:"headers" yaml:"headers"`
+    RedactHeaders []string      `toml:"redact_headers" yaml:"redact_headers"`
+    SqlLiterals   bool          `toml:"sql_literals" yaml:"sql_literals"`
+    SlowQuery     time.Duration `toml:"slow_query" yaml:"slow_query"`
+  } `toml:"log" yaml:"log"`
+}
+
+// per caller limits of an endpoint class; zero is unlimited
+type quota_config struct {
+  Rate        float64 `toml:"rate" yaml:"rate"`
+  Burst       int     `toml:"burst" yaml:"burst"`
+  Concurrency int     `toml:"concurrency" yaml:"concurrency"`
+}
+
+var setting_usage = map[string]string {
+  "listen": "address to listen on",
+  "queries": "directory of named query files, loaded if it exists",
+  "migrations": "directory of <version>_<name>.up.sql and .down.sql " +
+    "migration files, loaded if it exists",
+  "database.url": "connection string; empty uses the PG* environment " +
+    "variables and the service file",
+  "pool.max_conns": "maximum pool connections",
+  "pool.min_conns": "minimum pool connections",
+  "pool.max_conn_lifetime": "maximum connection lifetime",
+  "pool.max_conn_idle_time": "maximum connection idle time",
+  "timeouts.read": "timeout for reading a request",
+  "timeouts.read_header": "timeout for reading request headers",
+  "timeouts.write": "timeout for writing a response",
+  "timeouts.idle": "keep-alive idle timeout",
+  "timeouts.shutdown": "how long in-flight requests may take to finish " +
+    "after SIGTERM or SIGINT",
+  "endpoints.enabled": "endpoints to enable, e.g. /dt,/tables; empty " +
+    "enables all but /admin",
+  "endpoints.disabled": "endpoints to disable, e.g. /execSql,/exec",
+  "limits.statement_timeout": "default statement_timeout; requests " +
+    "override it with X-Statement-Timeout",
+  "limits.max_statement_timeout": "maximum statement_timeout",
+  "limits.lock_timeout": "default lock_timeout; requests override it " +
+    "with X-Lock-Timeout",
+  "limits.max_lock_timeout": "maximum lock_timeout",
+  "limits.idle_in_transaction_timeout": "default " +
+    "idle_in_transaction_session_timeout; requests override it with " +
+    "X-Idle-In-Transaction-Timeout",
+  "limits.max_idle_in_transaction_timeout": "maximum " +
+    "idle_in_transaction_session_timeout",
+  "limits.max_rows": "rows returned per result before it is truncated; 0 " +
+    "is no cap",
+  "limits.max_bytes": "bytes of json lines per result before it is " +
+    "truncated; 0 is no cap",
+  "quotas.catalog.rate": "catalog requests per second per caller",
+  "quotas.catalog.burst": "catalog requests allowed at once after idling",
+  "quotas.catalog.concurrency": "catalog requests in flight per caller",
+  "quotas.read.rate": "read requests per second per caller",
+  "quotas.read.burst": "read requests allowed at once after idling",
+  "quotas.read.concurrency": "read requests in flight per caller",
+  "quotas.write.rate": "write requests per second per caller",
+  "quotas.write.burst": "write requests allowed at once after idling",
+  "quotas.write.concurrency": "write requests in flight per caller",
+  "quotas.exec_sql.rate": "raw sql requests (/execSql, /exec, " +
+    "/defineQuery, /dropQuery) per second per caller",
+  "quotas.exec_sql.burst": "raw sql requests allowed at once after idling",
+  "quotas.exec_sql.concurrency": "raw sql requests in flight per caller",
+  "notify.websocket_origins": "origins besides the server's own allowed " +
+    "to subscribe to notifications over websockets; * allows any",
+  "idempotency.retention": "how long idempotency keys are remembered",
+  "auth.token": "bearer token required in the Authorization header",
+  "tls.cert": "TLS certificate file; enables HTTPS",
+  "tls.key": "TLS private key file",
+  "tls.client_ca": "CA bundle for verifying client certificates",
+  "tls.require_client_cert": "reject connections without a verified " +
+    "client certificate",
+  "tls.client_role": "run queries as the postgres role named by the " +
+    "client certificate common name (cn) or subject alternative names (san)",
+  "tls.client_role_map": "client certificate identity=role pairs, " +
+    "required with tls.client_role",
+  "log.file": "file to append the log to; empty logs to stderr",
+  "log.level": "debug, info, warn or error; debug logs every query",
+  "log.format": "text or json",
+  "log.requests": "log every request",
+  "log.headers": "log request headers",
+  "log.redact_headers": "headers whose values are not logged",
+  "log.sql_literals": "log SQL with its literals instead of replacing " +
+    "them with ?",
+  "log.slow_query": "log queries taking at least this long at warn " +
+    "level; 0 disables",
+}
+
+func default_config() *config {
+  cfg := &config {
+    Listen: ":12345",
+    Queries: "queries",
+    Migrations: "migrations",
+  }
+  cfg.Timeouts.ReadHeader = 10 * time.Second
+  cfg.Timeouts.Idle = 2 * time.Minute
+  cfg.Timeouts.Shutdown = 30 * time.Second
+  cfg.Idempotency.Retention = 24 * time.Hour
+  cfg.Log.Level = "info"
+  cfg.Log.Format = "text"
+  cfg.Log.Requests = true
+  cfg.Log.RedactHeaders = []string {
+    "Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie",
+  }
+  cfg.Log.SlowQuery = time.Second
+  return cfg
+}
+
+type setting struct {
+  key    string
+  usage  string
+  secret string
+  value  reflect.Value
+}
+
+func (s *setting) env_name() string {
+  return "PGREST_" + strings.ToUpper(strings.ReplaceAll(s.key, ".", "_"))
+}
+
+func (s *setting) flag_name() string {
+  return strings.NewReplacer(".", "-", "_", "-").Replace(s.key)
+}
+
+// the settings of the fields of v, a pointer to a struct, in field order
+func settings(v interface{}) []*setting {
+  var result []*setting
+  var walk func(prefix string, value reflect.Value)
+  walk = func(prefix string, value reflect.Value) {
+    for i := 0; i < value.NumField(); i++ {
+      field := value.Type().Field(i)
+      key := prefix + field.Tag.Get("toml")
+      if field.Type.Kind() == reflect.Struct {
+        walk(key + ".", value.Field(i))
+        continue
+      }
+      result = append(result, &setting {
+        key: key,
+        usage: setting_usage[key],
+        secret: field.Tag.Get("secret"),
+        value: value.Field(i),
+      })
+    }
+  }
+  walk("", reflect.ValueOf(v).Elem())
+  return result
+}
+
+func (s *setting) set(str string) error {
+  switch v := s.value.Addr().Interface().(type) {
+    case *string:
+      *v = str
+    case *bool:
+      b, err := strconv.ParseBool(str)
+      if err != nil {
+        return err
+      }
+      *v = b
+    case *int32:
+      i, err := strconv.ParseInt(str, 10, 32)
+      if err != nil {
+        return err
+      }
+      *v = int32(i)
+    case *int:
+      i, err := strconv.Atoi(str)
+      if err != nil {
+        return err
+      }
+      *v = i
+    case *float64:
+      f, err := strconv.ParseFloat(str, 64)
+      if err != nil {
+        return err
+      }
+      *v = f
+    case *time.Duration:
+      d, err := time.ParseDuration(str)
+      if err != nil {
+        return err
+      }
+      *v = d
+    case *[]string:
+      *v = nil
+      for _, item := range strings.Split(str, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+          *v = append(*v, item)
+        }
+      }
+    case *map[string]string:
+      *v = make(map[string]string)
+      for _, pair := range strings.Split(str, ",") {
+        if strings.TrimSpace(pair) == "" {
+          continue
+        }
+        key, value, ok := strings.Cut(pair, "=")
+        if !ok {
+          return fmt.Errorf("'%s' is not a key=value pair", pair)
+        }
+        (*v)[strings.TrimSpace(key)] = strings.TrimSpace(value)
+      }
+    default:
+      panic(fmt.Sprintf("unsupported setting type %v", s.value.Type()))
+  }
+  return nil
+}
+
+// records flag values so they can be applied after the config file and the
+// environment
+type flag_value struct {
+  setting *setting
+  values  map[string]string
+}
+
+func (f *flag_value) String() string {
+  return ""
+}
+
+func (f *flag_value) Set(str string) error {
+  f.values[f.setting.key] = str
+  return nil
+}
+
+func (f *flag_value) IsBoolFlag() bool {
+  return f.setting.value.Kind() == reflect.Bool
+}
+
+// returns the effective configuration, whether it should only be printed and
+// the arguments after the flags, naming a command
+func load_config(args []string) (*config, bool, []string, error) {
+  cfg := default_config()
+  all := settings(cfg)
+  flags := flag.NewFlagSet("serverApp", flag.ExitOnError)
+  config_file := flags.String("config", os.Getenv("PGREST_CONFIG"),
+    "TOML or YAML config file (PGREST_CONFIG)")
+  print_only := flags.Bool("print-config", false,
+    "print the effective configuration with secrets redacted and exit")
+  flag_values := make(map[string]string)
+  for _, s := range all {
+    flags.Var(&flag_value { s, flag_values }, s.flag_name(),
+      fmt.Sprintf("%s (%s)", s.usage, s.env_name()))
+  }
+  flags.Parse(args)
+  if *config_file != "" {
+    err := load_config_file(*config_file, cfg)
+    if err != nil {
+      return nil, false, nil, err
+    }
+  }
+  for _, s := range all {
+    if str, ok := os.LookupEnv(s.env_name()); ok {
+      err := s.set(str)
+      if err != nil {
+        return nil, false, nil, fmt.Errorf("invalid %s: %v", s.env_name(),
+          err)
+      }
+    }
+  }
+  for _, s := range all {
+    if str, ok := flag_values[s.key]; ok {
+      err := s.set(str)
+      if err != nil {
+        return nil, false, nil, fmt.Errorf("invalid -%s: %v", s.flag_name(),
+          err)
+      }
+    }
+  }
+  return cfg, *print_only, flags.Args(), nil
+}
+
+// unknown keys are an error, so typos don't go unnoticed
+func load_config_file(path string, cfg *config) error {
+  switch filepath.Ext(path) {
+    case ".toml":
+      meta, err := toml.DecodeFile(path, cfg)
+      if err != nil {
+        return err
+      }
+      if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+        return fmt.Errorf("unknown setting '%s' in %s", undecoded[0], path)
+      }
+      return nil
+    case ".yaml", ".yml":
+      file, err := os.Open(path)
+      if err != nil {
+        return err
+      }
+      defer file.Close()
+      decoder := yaml.NewDecoder(file)
+      decoder.KnownFields(true)
+      err = decoder.Decode(cfg)
+      if err == io.EOF {
+        return nil
+      }
+      return err
+  }
+  return fmt.Errorf("config file %s is not .toml, .yaml or .yml", path)
+}
+
+var conn_password_re = regexp.MustCompile(
+  `(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// hides the password of a keyword/value or URL connection string
+func redact_conn_string(conn string) string {
+  if strings.HasPrefix(conn, "postgres://") ||
+    strings.HasPrefix(conn, "postgresql://") {
+    u, err := url.Parse(conn)
+    if err != nil {
+      return "********"
+    }
+    query := u.Query()
+    if query.Has("password") {
+      query.Set("password", "xxxxx")
+      u.RawQuery = query.Encode()
+    }
+    return u.Redacted()
+  }
+  return conn_password_re.ReplaceAllString(conn, "${1}********")
+}
+
+// the configuration in TOML, usable as a config file
+func print_config(w io.Writer, cfg *config) {
+  section := ""
+  for _, s := range settings(cfg) {
+    name := s.key
+    if i := strings.LastIndex(s.key, "."); i >= 0 {
+      if s.key[:i] != section {
+        section = s.key[:i]
+        fmt.Fprintf(w, "\n[%s]\n", section)
+      }
+      name = s.key[i + 1:]
+    }
+    fmt.Fprintf(w, "%s = %s\n", name, toml_value(s))
+  }
+}
+
+func toml_value(s *setting) string {
+  switch v := s.value.Interface().(type) {
+    case string:
+      if v != "" && s.secret == "conn" {
+        v = redact_conn_string(v)
+      } else if v != "" && s.secret != "" {
+        v = "********"
+      }
+      return strconv.Quote(v)
+    case time.Duration:
+      return strconv.Quote(v.String())
+    case []string:
+      items := make([]string, len(v))
+      for i, item := range v {
+        items[i] = strconv.Quote(item)
+      }
+      return "[" + strings.Join(items, ", ") + "]"
+    case map[string]string:
+      keys := make([]string, 0, len(v))
+      for key := range v {
+        keys = append(keys, key)
+      }
+      sort.Strings(keys)
+      pairs := make([]string, len(keys))
+      for i, key := range keys {
+        pairs[i] = strconv.Quote(key) + " = " + strconv.Quote(v[key])
+      }
+      return "{ " + strings.Join(pairs, ", ") + " }"
+  }
+  return fmt.Sprint(s.value.Interface())
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+  "context"
+  "crypto/tls"
+  "fmt"
   "log"
+  "log/slog"
   "net/http"
+  "os"
+  "os/signal"
+  "syscall"
 )
 
 import (
@@ -10,16 +17,179 @@ import (
 )
 
 func main() {
-  log.Println("main...")
-  server, err := server.MakeServer("user=nixcloud")
+  cfg, print_only, args, err := load_config(os.Args[1:])
   if err != nil {
-    log.Fatalln("error creating pg server:", err)
+    log.Fatalln("error loading configuration:", err)
+  }
+  if len(args) > 0 && args[0] != "migrate" {
+    log.Fatalln("error unknown command:", args[0])
+  }
+  if print_only {
+    print_config(os.Stdout, cfg)
+    return
+  }
+  logger, close_log, err := make_logger(cfg)
+  if err != nil {
+    log.Fatalln("error setting up logging:", err)
+  }
+  defer close_log()
+  // the standard logger writes through the slog handler from here on
+  slog.SetDefault(logger)
+  var tls_config *tls.Config
+  if cfg.Tls.Cert != "" {
+    var err error
+    tls_config, err = server.MakeTLSConfig(server.TLSOptions {
+      CertFile: cfg.Tls.Cert,
+      KeyFile: cfg.Tls.Key,
+      ClientCAFile: cfg.Tls.ClientCa,
+      RequireClientCert: cfg.Tls.RequireClientCert,
+    })
+    if err != nil {
+      fatal("error loading TLS certificates", err)
+    }
+  }
+  server, err := server.MakeServerWithOptions(cfg.Database.Url,
+    server.Options {
+      MaxConns: cfg.Pool.MaxConns,
+      MinConns: cfg.Pool.MinConns,
+      MaxConnLifetime: cfg.Pool.MaxConnLifetime,
+      MaxConnIdleTime: cfg.Pool.MaxConnIdleTime,
+      IdempotencyRetention: cfg.Idempotency.Retention,
+      Endpoints: cfg.Endpoints.Enabled,
+      DisabledEndpoints: cfg.Endpoints.Disabled,
+      AuthToken: cfg.Auth.Token,
+      Logger: logger,
+      LogRequests: cfg.Log.Requests,
+      LogHeaders: cfg.Log.Headers,
+      RedactHeaders: cfg.Log.RedactHeaders,
+      LogSQLLiterals: cfg.Log.SqlLiterals,
+      SlowQuery: cfg.Log.SlowQuery,
+      StatementTimeout: cfg.Limits.StatementTimeout,
+      MaxStatementTimeout: cfg.Limits.MaxStatementTimeout,
+      LockTimeout: cfg.Limits.LockTimeout,
+      MaxLockTimeout: cfg.Limits.MaxLockTimeout,
+      IdleInTransactionTimeout: cfg.Limits.IdleInTransactionTimeout,
+      MaxIdleInTransactionTimeout: cfg.Limits.MaxIdleInTransactionTimeout,
+      MaxRows: cfg.Limits.MaxRows,
+      MaxBytes: cfg.Limits.MaxBytes,
+      Quotas: map[string]server.Quota {
+        server.CatalogClass: server.Quota(cfg.Quotas.Catalog),
+        server.ReadClass: server.Quota(cfg.Quotas.Read),
+        server.WriteClass: server.Quota(cfg.Quotas.Write),
+        server.ExecSqlClass: server.Quota(cfg.Quotas.ExecSql),
+      },
+      WebSocketOrigins: cfg.Notify.WebsocketOrigins,
+    })
+  if err != nil {
+    fatal("error creating pg server", err)
+  }
+  if _, err := os.Stat(cfg.Migrations); cfg.Migrations != "" && err == nil {
+    err = server.LoadMigrations(cfg.Migrations)
+    if err != nil {
+      fatal("error loading migrations", err)
+    }
+  }
+  if len(args) > 0 {
+    err = migrate(&server, args[1:])
+    server.Close()
+    if err != nil {
+      fatal("error migrating", err)
+    }
+    return
+  }
+  if _, err := os.Stat(cfg.Queries); cfg.Queries != "" && err == nil {
+    err = server.LoadQueries(context.Background(), cfg.Queries)
+    if err != nil {
+      fatal("error loading queries", err)
+    }
+  }
+  if cfg.Tls.ClientRole != "" {
+    err = server.SetClientCertRoles(cfg.Tls.ClientRole, cfg.Tls.ClientRoleMap)
+    if err != nil {
+      fatal("error setting client certificate roles", err)
+    }
   }
   s := &http.Server {
-    Addr: ":12345",
+    Addr: cfg.Listen,
     Handler: &server,
+    ReadTimeout: cfg.Timeouts.Read,
+    ReadHeaderTimeout: cfg.Timeouts.ReadHeader,
+    WriteTimeout: cfg.Timeouts.Write,
+    IdleTimeout: cfg.Timeouts.Idle,
+  }
+  if tls_config != nil {
+    s.TLSConfig = tls_config
   }
-  log.Println("starting server...")
-  log.Fatal(s.ListenAndServe())
-  log.Println("...main")
+  ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT,
+    syscall.SIGTERM)
+  defer stop()
+  serve_err := make(chan error, 1)
+  go func() {
+    if tls_config != nil {
+      slog.Info("starting server with TLS", "addr", cfg.Listen)
+      serve_err <- s.ListenAndServeTLS("", "")
+    } else {
+      slog.Info("starting server", "addr", cfg.Listen)
+      serve_err <- s.ListenAndServe()
+    }
+  }()
+  select {
+    case err := <-serve_err:
+      server.Close()
+      fatal("error serving", err)
+    case <-ctx.Done():
+  }
+  stop()
+  slog.Info("shutting down")
+  server.Drain()
+  shutdown_ctx, cancel := context.WithTimeout(context.Background(),
+    cfg.Timeouts.Shutdown)
+  defer cancel()
+  err = s.Shutdown(shutdown_ctx)
+  if err != nil {
+    // closing the connections cancels the requests, rolling back their
+    // transactions
+    slog.Error("error draining requests", "err", err)
+    s.Close()
+  }
+  server.Close()
+  slog.Info("stopped")
+}
+
+// returns a logger as configured and a function closing the log file
+func make_logger(cfg *config) (*slog.Logger, func(), error) {
+  var level slog.Level
+  err := level.UnmarshalText([]byte(cfg.Log.Level))
+  if err != nil {
+    return nil, nil, err
+  }
+  out := os.Stderr
+  if cfg.Log.File != "" {
+    out, err = os.OpenFile(cfg.Log.File,
+      os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+    if err != nil {
+      return nil, nil, err
+    }
+  }
+  opts := &slog.HandlerOptions { Level: level }
+  var handler slog.Handler
+  switch cfg.Log.Format {
+    case "text":
+      handler = slog.NewTextHandler(out, opts)
+    case "json":
+      handler = slog.NewJSONHandler(out, opts)
+    default:
+      return nil, nil, fmt.Errorf("invalid log format '%s'", cfg.Log.Format)
+  }
+  close_log := func() {
+    if out != os.Stderr {
+      out.Close()
+    }
+  }
+  return slog.New(handler), close_log, nil
+}
+
+func fatal(msg string, err error) {
+  slog.Error(msg, "err", err)
+  os.Exit(1)
 }
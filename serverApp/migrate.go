@@ -0,0 +1,70 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "flag"
+  "fmt"
+  "os"
+  "os/signal"
+  "syscall"
+  "text/tabwriter"
+  "time"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+  "pgrest/serverLib"
+)
+
+// runs the migrate command, "migrate [-to version] up|down|status", and
+// prints the status of every migration afterwards
+func migrate(pg_server *server.PgServer, args []string) error {
+  flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+  flags.Usage = func() {
+    fmt.Fprintln(flags.Output(),
+      "usage: serverApp [flags] migrate [-to version] up|down|status")
+    flags.PrintDefaults()
+  }
+  to := flags.Int64("to", 0, "up applies the migrations up to this " +
+    "version and down rolls back the ones after it; by default up applies " +
+    "all of them and down rolls back the latest")
+  flags.Parse(args)
+  if flags.NArg() != 1 {
+    flags.Usage()
+    return errors.New("expected one of up, down or status")
+  }
+  req := pgrest.Migrate { Action: flags.Arg(0) }
+  flags.Visit(func(f *flag.Flag) {
+    if f.Name == "to" {
+      req.Target = to
+    }
+  })
+  ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT,
+    syscall.SIGTERM)
+  defer stop()
+  statuses, err := pg_server.Migrate(ctx, req)
+  if err != nil {
+    return err
+  }
+  w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+  fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+  for _, status := range statuses {
+    state := "pending"
+    switch {
+      case status.Drift:
+        state = "drift"
+      case status.Missing:
+        state = "missing"
+      case status.Applied:
+        state = "applied"
+    }
+    applied_at := ""
+    if status.Applied_at != nil {
+      applied_at = status.Applied_at.Format(time.RFC3339)
+    }
+    fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", status.Version, status.Name, state,
+      applied_at)
+  }
+  return w.Flush()
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "net/http"
+  "strings"
+)
+
+import (
+  "github.com/jackc/pgx/v5"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+type aggregate_function struct {
+  // the aggregate of the column %s
+  sql string
+  // the type values of having filters are cast to, the column type when
+  // empty
+  result_type string
+}
+
+// the aggregate functions an aggregate can use
+var aggregate_functions = map[string]aggregate_function {
+  "count": { "count(%s)", "bigint" },
+  "count_distinct": { "count(DISTINCT %s)", "bigint" },
+  "sum": { "sum(%s)", "numeric" },
+  "avg": { "avg(%s)", "numeric" },
+  "min": { "min(%s)", "" },
+  "max": { "max(%s)", "" },
+  "array_agg": { "array_agg(%s)", "" },
+}
+
+// a name of the select list of an aggregate: its expression and the type of
+// its values
+type aggregate_output struct {
+  expr      string
+  data_type string
+}
+
+// the query of an aggregate and its arguments
+func (server *PgServer) aggregate_query(
+  ctx context.Context, agg pgrest.Aggregate,
+) (string, []interface{}, error) {
+  table, err := server.read_table(ctx, agg.TableName)
+  if err != nil {
+    return "", nil, err
+  }
+  return aggregate_sql(table, agg)
+}
+
+// the query of an aggregate of table and its arguments; column names are
+// checked against the table and function names against aggregate_functions
+func aggregate_sql(
+  table *resource_table, agg pgrest.Aggregate,
+) (string, []interface{}, error) {
+  bad_request := func(format string, a ...interface{}) error {
+    return &read_error { http.StatusBadRequest, fmt.Sprintf(format, a...) }
+  }
+  if len(agg.GroupBy) == 0 && len(agg.Aggregates) == 0 {
+    return "", nil, bad_request("error aggregate without GroupBy or " +
+      "Aggregates")
+  }
+  var err error
+  outputs := make(map[string]aggregate_output)
+  sel_cols := make([]string, 0, len(agg.GroupBy) + len(agg.Aggregates))
+  group_by := make([]string, len(agg.GroupBy))
+  for i, column := range agg.GroupBy {
+    col, err := table.column_ident(column)
+    if err != nil {
+      return "", nil, bad_request("%s", err.Error())
+    }
+    if _, ok := outputs[column]; ok {
+      return "", nil, bad_request("error column '%s' is grouped by twice",
+        column)
+    }
+    outputs[column] = aggregate_output { col, table.columns[column] }
+    group_by[i] = col
+    sel_cols = append(sel_cols, col)
+  }
+  for _, aggregate := range agg.Aggregates {
+    function_name := strings.ToLower(aggregate.Function)
+    function, ok := aggregate_functions[function_name]
+    if !ok {
+      return "", nil, bad_request("error unknown aggregate function '%s'",
+        aggregate.Function)
+    }
+    name := function_name
+    col := "*"
+    data_type := function.result_type
+    if aggregate.ColumnName != "" {
+      col, err = table.column_ident(aggregate.ColumnName)
+      if err != nil {
+        return "", nil, bad_request("%s", err.Error())
+      }
+      if data_type == "" {
+        data_type = table.columns[aggregate.ColumnName]
+      }
+      name += "_" + aggregate.ColumnName
+    } else if function_name != "count" {
+      return "", nil, bad_request("error aggregate function '%s' without a " +
+        "ColumnName", aggregate.Function)
+    }
+    if function_name == "array_agg" && !strings.HasSuffix(data_type, "[]") {
+      data_type += "[]"
+    }
+    if aggregate.As != "" {
+      name = aggregate.As
+    }
+    if _, ok := outputs[name]; ok {
+      return "", nil, bad_request("error aggregate name '%s' is used twice, " +
+        "set As", name)
+    }
+    expr := fmt.Sprintf(function.sql, col)
+    outputs[name] = aggregate_output { expr, data_type }
+    sel_cols = append(sel_cols,
+      expr + " AS " + pgx.Identifier{name}.Sanitize())
+  }
+  var args []interface{}
+  where, err := table.where_clause(agg.Filters, &args)
+  if err != nil {
+    return "", nil, bad_request("%s", err.Error())
+  }
+  query := fmt.Sprintf("SELECT %s FROM %s%s", strings.Join(sel_cols, ", "),
+    table.ident, where)
+  if len(group_by) > 0 {
+    query += " GROUP BY " + strings.Join(group_by, ", ")
+  }
+  if len(agg.Having) > 0 {
+    conds := make([]string, len(agg.Having))
+    for i, filter := range agg.Having {
+      output, ok := outputs[filter.ColumnName]
+      if !ok {
+        return "", nil, bad_request("error having filter on '%s', which is " +
+          "neither an aggregate nor a GroupBy column", filter.ColumnName)
+      }
+      conds[i], err = filter_cond(output.expr, output.data_type, filter, &args)
+      if err != nil {
+        return "", nil, bad_request("%s", err.Error())
+      }
+    }
+    query += " HAVING " + strings.Join(conds, " AND ")
+  }
+  if agg.Order != "" {
+    terms := strings.Split(agg.Order, ",")
+    for i, term := range terms {
+      name, dir, _ := strings.Cut(strings.TrimSpace(term), ".")
+      if _, ok := outputs[name]; !ok {
+        return "", nil, bad_request("error order by '%s', which is neither " +
+          "an aggregate nor a GroupBy column", name)
+      }
+      switch strings.ToLower(dir) {
+        case "", "asc": terms[i] = pgx.Identifier{name}.Sanitize() + " ASC"
+        case "desc": terms[i] = pgx.Identifier{name}.Sanitize() + " DESC"
+        default:
+          return "", nil, bad_request("error invalid order direction '%s'",
+            dir)
+      }
+    }
+    query += " ORDER BY " + strings.Join(terms, ", ")
+  }
+  if agg.Limit != nil {
+    query += fmt.Sprintf(" LIMIT %d", *agg.Limit)
+  }
+  return query, args, nil
+}
+
+// aggregates the rows of a table and returns one row per group as json lines
+func (server *PgServer) aggregate(w http.ResponseWriter, r *http.Request) {
+  var agg pgrest.Aggregate
+  if !unmarshal_body(w, r, &agg) {
+    return
+  }
+  query, args, err := server.aggregate_query(r.Context(), agg)
+  var read_err *read_error
+  if errors.As(err, &read_err) {
+    http.Error(w, err.Error(), read_err.status)
+    return
+  }
+  if check_err(r.Context(), w, err, "building query") {
+    return
+  }
+  rows, err := server.db(r.Context()).Query(r.Context(), query, args...)
+  if err != nil {
+    send_pg_err(w, err)
+    return
+  }
+  defer rows.Close()
+  rows_jsonl, err := rows_to_jsonl(r.Context(), w, rows)
+  if err != nil {
+    return
+  }
+  if err := rows.Err(); err != nil {
+    send_pg_err(w, err)
+    return
+  }
+  result := pgrest.Result {
+    Success: rows_jsonl,
+    Truncated: truncated(r.Context()),
+  }
+  send_json(r.Context(), w, result, "result")
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+  "net/http"
+  "reflect"
+  "testing"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+var orders_table = &resource_table {
+  oid: 3, name: "orders", ident: `"public"."orders"`,
+  columns: map[string]string {
+    "id": "integer", "customer": "text", "amount": "numeric",
+    "tags": "text[]",
+  },
+  primary_key: []string { "id" },
+}
+
+func TestAggregateSql(t *testing.T) {
+  five := uint64(5)
+  tests := []struct {
+    name  string
+    agg   pgrest.Aggregate
+    query string
+    args  []interface{}
+  } {
+    {
+      name: "group by",
+      agg: pgrest.Aggregate {
+        GroupBy: []string { "customer" },
+        Aggregates: []pgrest.AggregateColumn {
+          { Function: "count" },
+          { Function: "sum", ColumnName: "amount" },
+          { Function: "count_distinct", ColumnName: "id", As: "n" },
+        },
+        Filters: []pgrest.Filter {
+          { ColumnName: "amount", Op: "gt", Value: "10" },
+        },
+        Having: []pgrest.Filter {
+          { ColumnName: "n", Op: "gte", Value: "2" },
+          { ColumnName: "customer", Op: "neq", Value: "bob" },
+        },
+        Order: "sum_amount.desc, customer",
+        Limit: &five,
+      },
+      query: `SELECT "customer", count(*) AS "count", ` +
+        `sum("amount") AS "sum_amount", count(DISTINCT "id") AS "n" ` +
+        `FROM "public"."orders" WHERE "amount" > $1::numeric ` +
+        `GROUP BY "customer" HAVING count(DISTINCT "id") >= $2::bigint ` +
+        `AND "customer" <> $3::text ` +
+        `ORDER BY "sum_amount" DESC, "customer" ASC LIMIT 5`,
+      args: []interface{} { "10", "2", "bob" },
+    },
+    {
+      name: "having casts to the aggregate types",
+      agg: pgrest.Aggregate {
+        Aggregates: []pgrest.AggregateColumn {
+          { Function: "array_agg", ColumnName: "customer" },
+          { Function: "array_agg", ColumnName: "tags" },
+          { Function: "MIN", ColumnName: "amount" },
+          { Function: "Count", ColumnName: "id" },
+        },
+        Having: []pgrest.Filter {
+          { ColumnName: "array_agg_customer", Op: "eq", Value: "{a}" },
+          { ColumnName: "array_agg_tags", Op: "eq", Value: "{b}" },
+          { ColumnName: "min_amount", Op: "lt", Value: "1" },
+          { ColumnName: "count_id", Op: "in", Values: []string { "1", "2" } },
+        },
+      },
+      query: `SELECT array_agg("customer") AS "array_agg_customer", ` +
+        `array_agg("tags") AS "array_agg_tags", ` +
+        `min("amount") AS "min_amount", count("id") AS "count_id" ` +
+        `FROM "public"."orders" ` +
+        `HAVING array_agg("customer") = $1::text[] ` +
+        `AND array_agg("tags") = $2::text[] ` +
+        `AND min("amount") < $3::numeric ` +
+        `AND count("id") IN ($4::bigint, $5::bigint)`,
+      args: []interface{} { "{a}", "{b}", "1", "1", "2" },
+    },
+    {
+      name: "group by only",
+      agg: pgrest.Aggregate { GroupBy: []string { "customer", "tags" } },
+      query: `SELECT "customer", "tags" FROM "public"."orders" ` +
+        `GROUP BY "customer", "tags"`,
+    },
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      query, args, err := aggregate_sql(orders_table, test.agg)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if query != test.query {
+        t.Errorf("query\n%s\nexpected\n%s", query, test.query)
+      }
+      if !reflect.DeepEqual(args, test.args) {
+        t.Errorf("args %v, expected %v", args, test.args)
+      }
+    })
+  }
+}
+
+func TestAggregateSqlErrors(t *testing.T) {
+  count := []pgrest.AggregateColumn { { Function: "count" } }
+  tests := []struct {
+    name string
+    agg  pgrest.Aggregate
+  } {
+    { name: "nothing to aggregate", agg: pgrest.Aggregate {} },
+    {
+      name: "unknown group by column",
+      agg: pgrest.Aggregate { GroupBy: []string { "nope" } },
+    },
+    {
+      name: "grouped by twice",
+      agg: pgrest.Aggregate { GroupBy: []string { "id", "id" } },
+    },
+    {
+      name: "unknown function",
+      agg: pgrest.Aggregate {
+        Aggregates: []pgrest.AggregateColumn {
+          { Function: "median", ColumnName: "amount" },
+        },
+      },
+    },
+    {
+      name: "function without a column",
+      agg: pgrest.Aggregate {
+        Aggregates: []pgrest.AggregateColumn { { Function: "sum" } },
+      },
+    },
+    {
+      name: "unknown aggregate column",
+      agg: pgrest.Aggregate {
+        Aggregates: []pgrest.AggregateColumn {
+          { Function: "sum", ColumnName: "nope" },
+        },
+      },
+    },
+    {
+      name: "name used twice",
+      agg: pgrest.Aggregate {
+        Aggregates: []pgrest.AggregateColumn {
+          { Function: "count" }, { Function: "count" },
+        },
+      },
+    },
+    {
+      name: "aggregate named like a group by column",
+      agg: pgrest.Aggregate {
+        GroupBy: []string { "customer" },
+        Aggregates: []pgrest.AggregateColumn {
+          { Function: "max", ColumnName: "amount", As: "customer" },
+        },
+      },
+    },
+    {
+      name: "filter on an unknown column",
+      agg: pgrest.Aggregate {
+        Aggregates: count,
+        Filters: []pgrest.Filter { { ColumnName: "nope", Op: "eq" } },
+      },
+    },
+    {
+      name: "having on a column that isn't grouped",
+      agg: pgrest.Aggregate {
+        Aggregates: count,
+        Having: []pgrest.Filter { { ColumnName: "amount", Op: "eq" } },
+      },
+    },
+    {
+      name: "having operator",
+      agg: pgrest.Aggregate {
+        Aggregates: count,
+        Having: []pgrest.Filter { { ColumnName: "count", Op: "near" } },
+      },
+    },
+    {
+      name: "order by a column that isn't grouped",
+      agg: pgrest.Aggregate { Aggregates: count, Order: "amount" },
+    },
+    {
+      name: "order direction",
+      agg: pgrest.Aggregate { Aggregates: count, Order: "count.up" },
+    },
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      query, _, err := aggregate_sql(orders_table, test.agg)
+      read_err, ok := err.(*read_error)
+      if !ok || read_err.status != http.StatusBadRequest {
+        t.Errorf("query %q and error %v, expected a bad request", query, err)
+      }
+    })
+  }
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+  "net/http"
+)
+
+import (
+  "github.com/georgysavva/scany/v2/pgxscan"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+// catalog listings of one schema, given by the schema query parameter and
+// public by default; triggers and constraints can be limited to the table
+// query parameter
+
+func catalog_schema(r *http.Request) string {
+  if schema := r.URL.Query().Get("schema"); schema != "" {
+    return schema
+  }
+  return "public"
+}
+
+// an sql condition on the table name column, "" for all tables, and its
+// argument
+func catalog_table(r *http.Request, column string) (string, []interface{}) {
+  table := r.URL.Query().Get("table")
+  if table == "" {
+    return "", nil
+  }
+  return " AND " + column + " = $2", []interface{} { table }
+}
+
+// the table sizes, row estimates and pg_stat_user_tables activity of /dt with
+// the stats query parameter
+const table_stats_sql = ", pg_total_relation_size(c.oid) AS total_bytes, " +
+  "pg_table_size(c.oid) - coalesce(pg_total_relation_size(" +
+  "nullif(c.reltoastrelid, 0)), 0) AS table_bytes, " +
+  "pg_indexes_size(c.oid) AS index_bytes, " +
+  "coalesce(pg_total_relation_size(nullif(c.reltoastrelid, 0)), 0) " +
+  "AS toast_bytes, " +
+  "CASE WHEN c.reltuples < 0 THEN NULL ELSE c.reltuples::bigint END " +
+  "AS estimated_rows, " +
+  "s.seq_scan, s.idx_scan, s.n_live_tup, s.n_dead_tup, s.last_vacuum, " +
+  "s.last_autovacuum, s.last_analyze, s.last_autoanalyze"
+
+// lists tables; stats=true adds sizes and activity and sort=size orders by
+// total size, largest first, instead of by name
+func (server *PgServer) dt(w http.ResponseWriter, r *http.Request) {
+  query := r.URL.Query()
+  order := "t.tablename"
+  switch query.Get("sort") {
+    case "", "name":
+    case "size":
+      order = "pg_total_relation_size(c.oid) DESC, t.tablename"
+    default:
+      http.Error(w, "error sort must be name or size", http.StatusBadRequest)
+      return
+  }
+  stats := ""
+  if query.Get("stats") == "true" {
+    stats = table_stats_sql
+  }
+  tables := make([]*pgrest.Table, 0)
+  err := pgxscan.Select(r.Context(), server.db(r.Context()), &tables,
+    "SELECT t.schemaname, t.tablename, t.tableowner, t.tablespace, " +
+    "t.hasindexes, t.hasrules, t.hastriggers, t.rowsecurity" + stats +
+    " FROM pg_catalog.pg_tables t " +
+    "JOIN pg_namespace n ON n.nspname = t.schemaname " +
+    "JOIN pg_class c ON c.relnamespace = n.oid AND c.relname = t.tablename " +
+    "LEFT JOIN pg_stat_user_tables s ON s.relid = c.oid " +
+    "WHERE t.schemaname = $1 ORDER BY " + order, catalog_schema(r))
+  if check_err(r.Context(), w, err, "getting tables") {
+    return
+  }
+  send_json(r.Context(), w, tables, "tables")
+}
+
+func (server *PgServer) dv(w http.ResponseWriter, r *http.Request) {
+  views := make([]*pgrest.View, 0)
+  err := pgxscan.Select(r.Context(), server.db(r.Context()), &views,
+    "SELECT schemaname, viewname, viewowner, definition FROM pg_views " +
+    "WHERE schemaname = $1 ORDER BY viewname", catalog_schema(r))
+  if check_err(r.Context(), w, err, "getting views") {
+    return
+  }
+  send_json(r.Context(), w, views, "views")
+}
+
+func (server *PgServer) dm(w http.ResponseWriter, r *http.Request) {
+  matviews := make([]*pgrest.MaterializedView, 0)
+  err := pgxscan.Select(r.Context(), server.db(r.Context()), &matviews,
+    "SELECT schemaname, matviewname, matviewowner, tablespace, hasindexes, " +
+    "ispopulated, definition FROM pg_matviews WHERE schemaname = $1 " +
+    "ORDER BY matviewname", catalog_schema(r))
+  if check_err(r.Context(), w, err, "getting materialized views") {
+    return
+  }
+  send_json(r.Context(), w, matviews, "materialized views")
+}
+
+func (server *PgServer) ds(w http.ResponseWriter, r *http.Request) {
+  sequences := make([]*pgrest.Sequence, 0)
+  err := pgxscan.Select(r.Context(), server.db(r.Context()), &sequences,
+    "SELECT schemaname, sequencename, sequenceowner, data_type::text, " +
+    "start_value, min_value, max_value, increment_by, cycle, cache_size, " +
+    "last_value FROM pg_sequences WHERE schemaname = $1 " +
+    "ORDER BY sequencename", catalog_schema(r))
+  if check_err(r.Context(), w, err, "getting sequences") {
+    return
+  }
+  send_json(r.Context(), w, sequences, "sequences")
+}
+
+func (server *PgServer) triggers(w http.ResponseWriter, r *http.Request) {
+  table_cond, table_args := catalog_table(r, "c.relname")
+  triggers := make([]*pgrest.Trigger, 0)
+  err := pgxscan.Select(r.Context(), server.db(r.Context()), &triggers,
+    "SELECT n.nspname AS schemaname, c.relname AS tablename, " +
+    "t.tgname AS triggername, " +
+    "CASE WHEN t.tgtype::int & 2 <> 0 THEN 'BEFORE' " +
+    "WHEN t.tgtype::int & 64 <> 0 THEN 'INSTEAD OF' ELSE 'AFTER' END " +
+    "AS timing, " +
+    "array_remove(ARRAY[" +
+    "CASE WHEN t.tgtype::int & 4 <> 0 THEN 'INSERT' END, " +
+    "CASE WHEN t.tgtype::int & 16 <> 0 THEN 'UPDATE' END, " +
+    "CASE WHEN t.tgtype::int & 8 <> 0 THEN 'DELETE' END, " +
+    "CASE WHEN t.tgtype::int & 32 <> 0 THEN 'TRUNCATE' END], NULL) " +
+    "AS events, " +
+    "CASE WHEN t.tgtype::int & 1 <> 0 THEN 'ROW' ELSE 'STATEMENT' END " +
+    "AS level, " +
+    "t.tgfoid::regproc::text AS function, " +
+    "CASE t.tgenabled WHEN 'O' THEN 'origin' WHEN 'D' THEN 'disabled' " +
+    "WHEN 'R' THEN 'replica' WHEN 'A' THEN 'always' END AS enabled, " +
+    "pg_get_triggerdef(t.oid) AS definition " +
+    "FROM pg_trigger t JOIN pg_class c ON c.oid = t.tgrelid " +
+    "JOIN pg_namespace n ON n.oid = c.relnamespace " +
+    "WHERE NOT t.tgisinternal AND n.nspname = $1" + table_cond +
+    " ORDER BY c.relname, t.tgname",
+    append([]interface{} { catalog_schema(r) }, table_args...)...)
+  if check_err(r.Context(), w, err, "getting triggers") {
+    return
+  }
+  send_json(r.Context(), w, triggers, "triggers")
+}
+
+// the names of the columns numbered by attnums of relation oid, in order
+func constraint_columns_sql(attnums string, oid string) string {
+  return "coalesce((SELECT array_agg(a.attname::text ORDER BY k.ord) " +
+    "FROM unnest(" + attnums + ") WITH ORDINALITY k(attnum, ord) " +
+    "JOIN pg_attribute a ON a.attrelid = " + oid +
+    " AND a.attnum = k.attnum), '{}')"
+}
+
+func fk_action_sql(column string) string {
+  return "CASE " + column + " WHEN 'a' THEN 'NO ACTION' " +
+    "WHEN 'r' THEN 'RESTRICT' WHEN 'c' THEN 'CASCADE' " +
+    "WHEN 'n' THEN 'SET NULL' WHEN 'd' THEN 'SET DEFAULT' END"
+}
+
+func (server *PgServer) constraints(w http.ResponseWriter, r *http.Request) {
+  table_cond, table_args := catalog_table(r, "c.relname")
+  constraints := make([]*pgrest.Constraint, 0)
+  err := pgxscan.Select(r.Context(), server.db(r.Context()), &constraints,
+    "SELECT n.nspname AS schemaname, c.relname AS tablename, " +
+    "con.conname AS constraintname, " +
+    "CASE con.contype WHEN 'p' THEN 'PRIMARY KEY' WHEN 'u' THEN 'UNIQUE' " +
+    "WHEN 'c' THEN 'CHECK' WHEN 'f' THEN 'FOREIGN KEY' " +
+    "WHEN 'x' THEN 'EXCLUDE' WHEN 't' THEN 'TRIGGER' " +
+    "WHEN 'n' THEN 'NOT NULL' ELSE con.contype::text END " +
+    "AS constrainttype, " +
+    constraint_columns_sql("con.conkey", "con.conrelid") + " AS columns, " +
+    "rn.nspname AS referenced_schema, rc.relname AS referenced_table, " +
+    constraint_columns_sql("con.confkey", "con.confrelid") +
+    " AS referenced_columns, " +
+    fk_action_sql("con.confupdtype") + " AS on_update, " +
+    fk_action_sql("con.confdeltype") + " AS on_delete, " +
+    "con.condeferrable AS deferrable, con.condeferred AS deferred, " +
+    "con.convalidated AS validated, " +
+    "pg_get_constraintdef(con.oid) AS definition " +
+    "FROM pg_constraint con JOIN pg_class c ON c.oid = con.conrelid " +
+    "JOIN pg_namespace n ON n.oid = c.relnamespace " +
+    "LEFT JOIN pg_class rc ON rc.oid = con.confrelid " +
+    "LEFT JOIN pg_namespace rn ON rn.oid = rc.relnamespace " +
+    "WHERE n.nspname = $1" + table_cond +
+    " ORDER BY c.relname, con.conname",
+    append([]interface{} { catalog_schema(r) }, table_args...)...)
+  if check_err(r.Context(), w, err, "getting constraints") {
+    return
+  }
+  send_json(r.Context(), w, constraints, "constraints")
+}
@@ -0,0 +1,605 @@
+package server
+
+import (
+  "context"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+import (
+  "github.com/jackc/pgx/v5"
+  "github.com/jackc/pgx/v5/pgconn"
+  "github.com/jackc/pgx/v5/pgproto3"
+  "github.com/jackc/pgx/v5/pgtype"
+  json "github.com/goccy/go-json"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+// how often a change stream reports its acknowledged position to postgres
+const standby_status_interval = 10 * time.Second
+
+// microseconds between the unix epoch and the postgres epoch, 2000-01-01
+const pg_epoch_micros = 946684800000000
+
+// the latest acknowledged lsn of each slot, which its change stream reports to
+// postgres as flushed so the slot can release wal
+type change_acks struct {
+  mutex sync.Mutex
+  lsns  map[string]uint64
+}
+
+func (acks *change_acks) ack(slot string, lsn uint64) {
+  acks.mutex.Lock()
+  defer acks.mutex.Unlock()
+  if lsn > acks.lsns[slot] {
+    acks.lsns[slot] = lsn
+  }
+}
+
+func (acks *change_acks) get(slot string) uint64 {
+  acks.mutex.Lock()
+  defer acks.mutex.Unlock()
+  return acks.lsns[slot]
+}
+
+// names a change by the lsn of its transaction's commit record and its index
+// in the transaction; streaming from the lsn replays the transaction, so
+// resuming skips the changes up to the index
+type change_token struct {
+  lsn   uint64
+  index int
+}
+
+func (token change_token) String() string {
+  return format_lsn(token.lsn) + ":" + strconv.Itoa(token.index)
+}
+
+func parse_change_token(s string) (change_token, error) {
+  lsn, index, ok := strings.Cut(s, ":")
+  if !ok {
+    return change_token{}, fmt.Errorf("invalid resume token '%s'", s)
+  }
+  var token change_token
+  var err error
+  token.lsn, err = parse_lsn(lsn)
+  if err != nil {
+    return change_token{}, fmt.Errorf("invalid resume token '%s'", s)
+  }
+  token.index, err = strconv.Atoi(index)
+  if err != nil || token.index < 0 {
+    return change_token{}, fmt.Errorf("invalid resume token '%s'", s)
+  }
+  return token, nil
+}
+
+func format_lsn(lsn uint64) string {
+  return fmt.Sprintf("%X/%X", uint32(lsn >> 32), uint32(lsn))
+}
+
+func parse_lsn(s string) (uint64, error) {
+  hi, lo, ok := strings.Cut(s, "/")
+  if !ok {
+    return 0, fmt.Errorf("invalid lsn '%s'", s)
+  }
+  hi_n, err := strconv.ParseUint(hi, 16, 32)
+  if err != nil {
+    return 0, fmt.Errorf("invalid lsn '%s'", s)
+  }
+  lo_n, err := strconv.ParseUint(lo, 16, 32)
+  if err != nil {
+    return 0, fmt.Errorf("invalid lsn '%s'", s)
+  }
+  return hi_n << 32 | lo_n, nil
+}
+
+// streams the changes of a logical replication slot as server-sent events
+// whose data is a json pgrest.Change and whose id is its resume token; the
+// slot and publication query parameters are required, table parameters
+// (schema.table, or table in public) limit the stream to those tables and
+// resume, or a Last-Event-ID header, restarts after the change with that
+// token. A stream acknowledges its resume token; later changes are
+// acknowledged with /ackChanges
+func (server *PgServer) changes(
+  w http.ResponseWriter, r *http.Request, role string,
+) {
+  if !allow_methods(w, r, "GET") {
+    return
+  }
+  query := r.URL.Query()
+  slot := query.Get("slot")
+  publication := query.Get("publication")
+  if slot == "" || publication == "" {
+    http.Error(w, "error slot and publication query parameters are required",
+      http.StatusBadRequest)
+    return
+  }
+  tables := make(map[string]bool)
+  for _, table := range query["table"] {
+    if !strings.Contains(table, ".") {
+      table = "public." + table
+    }
+    tables[table] = true
+  }
+  resume := query.Get("resume")
+  if resume == "" {
+    resume = r.Header.Get("Last-Event-ID")
+  }
+  var token change_token
+  if resume != "" {
+    var err error
+    token, err = parse_change_token(resume)
+    if err != nil {
+      http.Error(w, "error " + err.Error(), http.StatusBadRequest)
+      return
+    }
+  }
+  if role != "" {
+    err := server.check_change_privileges(r.Context(), role, publication,
+      tables)
+    if err != nil {
+      var pg_err *pgconn.PgError
+      if !errors.As(err, &pg_err) {
+        http.Error(w, "error " + err.Error(), http.StatusForbidden)
+        return
+      }
+      check_err(r.Context(), w, err, "checking table privileges")
+      return
+    }
+  }
+  // the stream ends with the request or when the server drains
+  ctx, cancel := context.WithCancel(r.Context())
+  defer cancel()
+  defer context.AfterFunc(server.streams, cancel)()
+  config := server.pool.Config().ConnConfig.Config.Copy()
+  config.RuntimeParams["replication"] = "database"
+  conn, err := pgconn.ConnectConfig(ctx, config)
+  if check_err(ctx, w, err, "opening replication connection") {
+    return
+  }
+  defer conn.Close(context.Background())
+  if token.lsn > 0 {
+    server.change_acks.ack(slot, token.lsn)
+  }
+  err = start_replication(ctx, conn, slot, publication, token.lsn)
+  var pg_err *pgconn.PgError
+  if errors.As(err, &pg_err) && pg_err.Code == "55006" {
+    http.Error(w, "error " + pg_err.Message, http.StatusConflict)
+    return
+  }
+  if check_err(ctx, w, err, "starting replication") {
+    return
+  }
+  controller := http.NewResponseController(w)
+  // the stream outlives the read and write timeouts of the http.Server
+  controller.SetReadDeadline(time.Time{})
+  controller.SetWriteDeadline(time.Time{})
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-store")
+  w.WriteHeader(http.StatusOK)
+  decoder := &change_decoder {
+    relations: make(map[uint32]*relation),
+    types: pgtype.NewMap(),
+    resume: token,
+  }
+  logger := request_logger(ctx)
+  var received uint64
+  status_at := time.Now()
+  for {
+    if !time.Now().Before(status_at) {
+      err := send_standby_status(conn, received, server.change_acks.get(slot))
+      if err != nil {
+        logger.Error("error sending standby status", "err", err)
+        return
+      }
+      status_at = time.Now().Add(standby_status_interval)
+      fmt.Fprint(w, ": keepalive\n\n")
+      if controller.Flush() != nil {
+        return
+      }
+    }
+    recv_ctx, recv_cancel := context.WithDeadline(ctx, status_at)
+    msg, err := conn.ReceiveMessage(recv_ctx)
+    recv_cancel()
+    if ctx.Err() != nil {
+      return
+    }
+    if pgconn.Timeout(err) {
+      continue
+    }
+    if err != nil {
+      logger.Error("error receiving changes", "err", err)
+      return
+    }
+    switch msg := msg.(type) {
+      case *pgproto3.ErrorResponse:
+        logger.Error("error receiving changes",
+          "err", pgconn.ErrorResponseToPgError(msg))
+        return
+      case *pgproto3.CopyDone:
+        return
+      case *pgproto3.CopyData:
+        if len(msg.Data) == 0 {
+          continue
+        }
+        switch msg.Data[0] {
+          // keepalive: wal end, send time and whether to reply
+          case 'k':
+            if len(msg.Data) >= 18 && msg.Data[17] == 1 {
+              status_at = time.Now()
+            }
+          // xlog data: wal start, wal end, send time and a pgoutput message
+          case 'w':
+            if len(msg.Data) < 25 {
+              logger.Error("error truncated replication message")
+              return
+            }
+            start := binary.BigEndian.Uint64(msg.Data[1:])
+            if start > received {
+              received = start
+            }
+            changes, err := decoder.decode(msg.Data[25:])
+            if err != nil {
+              logger.Error("error decoding changes", "err", err)
+              return
+            }
+            written := false
+            for _, change := range changes {
+              table := change.Schema + "." + change.Table
+              if len(tables) > 0 && !tables[table] {
+                continue
+              }
+              data, err := json.Marshal(change)
+              if err != nil {
+                logger.Error("error converting change to json", "err", err)
+                return
+              }
+              fmt.Fprintf(w, "id: %s\ndata: %s\n\n", change.Token, data)
+              written = true
+            }
+            if written && controller.Flush() != nil {
+              return
+            }
+        }
+    }
+  }
+}
+
+// a role streaming changes needs SELECT on the streamed tables, or on all
+// tables of the publication
+func (server *PgServer) check_change_privileges(
+  ctx context.Context, role string, publication string, tables map[string]bool,
+) error {
+  names := make([]string, 0, len(tables))
+  for table := range tables {
+    names = append(names, table)
+  }
+  if len(names) == 0 {
+    rows, err := server.pool.Query(ctx, "SELECT schemaname || '.' || " +
+      "tablename FROM pg_publication_tables WHERE pubname = $1", publication)
+    if err != nil {
+      return err
+    }
+    names, err = pgx.CollectRows(rows, pgx.RowTo[string])
+    if err != nil {
+      return err
+    }
+  }
+  for _, name := range names {
+    schema, table, _ := strings.Cut(name, ".")
+    var allowed bool
+    err := server.pool.QueryRow(ctx, "SELECT has_table_privilege($1, $2, " +
+      "'SELECT')", role, pgx.Identifier{schema, table}.Sanitize()).
+      Scan(&allowed)
+    if err != nil {
+      return err
+    }
+    if !allowed {
+      return fmt.Errorf("role %s may not read %s", role, name)
+    }
+  }
+  return nil
+}
+
+// sends START_REPLICATION and waits for the server to start copying
+func start_replication(
+  ctx context.Context, conn *pgconn.PgConn, slot string, publication string,
+  lsn uint64,
+) error {
+  sql := fmt.Sprintf("START_REPLICATION SLOT %s LOGICAL %s " +
+    "(proto_version '1', publication_names %s)",
+    pgx.Identifier{slot}.Sanitize(), format_lsn(lsn),
+    quote_literal(pgx.Identifier{publication}.Sanitize()))
+  conn.Frontend().Send(&pgproto3.Query { String: sql })
+  err := conn.Frontend().Flush()
+  if err != nil {
+    return err
+  }
+  for {
+    msg, err := conn.ReceiveMessage(ctx)
+    if err != nil {
+      return err
+    }
+    switch msg := msg.(type) {
+      case *pgproto3.CopyBothResponse:
+        return nil
+      case *pgproto3.ErrorResponse:
+        return pgconn.ErrorResponseToPgError(msg)
+    }
+  }
+}
+
+func quote_literal(s string) string {
+  return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// reports the received and acknowledged positions
+func send_standby_status(
+  conn *pgconn.PgConn, received uint64, acked uint64,
+) error {
+  data := make([]byte, 34)
+  data[0] = 'r'
+  binary.BigEndian.PutUint64(data[1:], received)
+  binary.BigEndian.PutUint64(data[9:], acked)
+  binary.BigEndian.PutUint64(data[17:], acked)
+  binary.BigEndian.PutUint64(data[25:],
+    uint64(time.Now().UnixMicro() - pg_epoch_micros))
+  conn.Frontend().Send(&pgproto3.CopyData { Data: data })
+  return conn.Frontend().Flush()
+}
+
+// acknowledges the changes up to a resume token, so the slot of a running
+// stream can release their wal; a later stream resumes from its own token
+func (server *PgServer) ackChanges(w http.ResponseWriter, r *http.Request) {
+  var ack pgrest.AckChanges
+  if !unmarshal_body(w, r, &ack) {
+    return
+  }
+  token, err := parse_change_token(ack.Token)
+  if err != nil {
+    http.Error(w, "error " + err.Error(), http.StatusBadRequest)
+    return
+  }
+  server.change_acks.ack(ack.Slot, token.lsn)
+  res_string := fmt.Sprintf("ACK %s %s", ack.Slot, token)
+  send_json(r.Context(), w, pgrest.Result { Success: &res_string }, "result")
+}
+
+type relation struct {
+  schema  string
+  name    string
+  columns []relation_column
+}
+
+type relation_column struct {
+  // json encoded
+  name string
+  oid  uint32
+}
+
+// decodes pgoutput messages into changes
+type change_decoder struct {
+  relations map[uint32]*relation
+  types     *pgtype.Map
+  // skips the changes up to the resume token
+  resume change_token
+  // the current transaction
+  lsn   uint64
+  xid   uint32
+  time  time.Time
+  index int
+}
+
+func (d *change_decoder) decode(data []byte) ([]*pgrest.Change, error) {
+  m := &message_reader { data: data }
+  var changes []*pgrest.Change
+  // the changes of a resumed transaction up to the token were sent before
+  emit := func(change *pgrest.Change, token change_token) {
+    if token.lsn != d.resume.lsn || token.index > d.resume.index {
+      changes = append(changes, change)
+    }
+  }
+  switch m.byte() {
+    case 'B':
+      d.lsn = m.uint64()
+      d.time = time.UnixMicro(int64(m.uint64()) + pg_epoch_micros).UTC()
+      d.xid = m.uint32()
+      d.index = 0
+    case 'R':
+      id := m.uint32()
+      rel := &relation { schema: m.string(), name: m.string() }
+      m.byte() // replica identity
+      n := int(m.uint16())
+      for i := 0; i < n && m.err == nil; i++ {
+        m.byte() // flags
+        name, _ := json.Marshal(m.string())
+        rel.columns = append(rel.columns, relation_column {
+          name: string(name), oid: m.uint32(),
+        })
+        m.uint32() // type modifier
+      }
+      d.relations[id] = rel
+    case 'I':
+      change, rel, token := d.change("insert", m)
+      if m.byte() == 'N' {
+        change.After = d.tuple(m, rel)
+      }
+      emit(change, token)
+    case 'U':
+      change, rel, token := d.change("update", m)
+      kind := m.byte()
+      if kind == 'K' || kind == 'O' {
+        change.Before = d.tuple(m, rel)
+        kind = m.byte()
+      }
+      if kind == 'N' {
+        change.After = d.tuple(m, rel)
+      }
+      emit(change, token)
+    case 'D':
+      change, rel, token := d.change("delete", m)
+      kind := m.byte()
+      if kind == 'K' || kind == 'O' {
+        change.Before = d.tuple(m, rel)
+      }
+      emit(change, token)
+    case 'T':
+      n := int(m.uint32())
+      m.byte() // options
+      for i := 0; i < n && m.err == nil; i++ {
+        change, _, token := d.change("truncate", m)
+        emit(change, token)
+      }
+  }
+  if m.err != nil {
+    return nil, m.err
+  }
+  return changes, nil
+}
+
+// the next change of the current transaction, on the relation whose id m
+// reads next
+func (d *change_decoder) change(op string, m *message_reader) (
+  *pgrest.Change, *relation, change_token,
+) {
+  token := change_token { d.lsn, d.index }
+  d.index++
+  id := m.uint32()
+  rel, ok := d.relations[id]
+  if !ok && m.err == nil {
+    m.err = fmt.Errorf("change of unknown relation %d", id)
+  }
+  change := &pgrest.Change {
+    Token: token.String(),
+    Lsn: format_lsn(d.lsn),
+    Xid: d.xid,
+    Time: d.time,
+    Op: op,
+  }
+  if rel != nil {
+    change.Schema = rel.schema
+    change.Table = rel.name
+  }
+  return change, rel, token
+}
+
+// a tuple as a json object like a row of /read; unchanged toasted values,
+// which pgoutput does not send, are left out
+func (d *change_decoder) tuple(
+  m *message_reader, rel *relation,
+) json.RawMessage {
+  n := int(m.uint16())
+  if m.err == nil && (rel == nil || n > len(rel.columns)) {
+    m.err = errors.New("tuple does not match its relation")
+  }
+  names := make([]string, 0, n)
+  values := make([]interface{}, 0, n)
+  for i := 0; i < n && m.err == nil; i++ {
+    var value interface{}
+    switch kind := m.byte(); kind {
+      case 'n':
+      case 'u':
+        continue
+      case 't':
+        value = d.value(rel.columns[i].oid, m.bytes(int(m.uint32())))
+      default:
+        m.err = fmt.Errorf("unsupported tuple value kind '%c'", kind)
+    }
+    names = append(names, rel.columns[i].name)
+    values = append(values, value)
+  }
+  if m.err != nil {
+    return nil
+  }
+  row, err := row_json(names, values)
+  if err != nil {
+    m.err = err
+    return nil
+  }
+  return json.RawMessage(row)
+}
+
+// decodes a text value as rows.Values does; types pgx doesn't know stay text
+func (d *change_decoder) value(oid uint32, text []byte) interface{} {
+  if typ, ok := d.types.TypeForOID(oid); ok {
+    value, err := typ.Codec.DecodeValue(d.types, oid, pgtype.TextFormatCode,
+      text)
+    if err == nil {
+      return value
+    }
+  }
+  return string(text)
+}
+
+// reads big endian fields of a replication message; after a short read every
+// read returns zero and err is set
+type message_reader struct {
+  data []byte
+  err  error
+}
+
+func (m *message_reader) bytes(n int) []byte {
+  if m.err != nil || n < 0 || n > len(m.data) {
+    if m.err == nil {
+      m.err = errors.New("truncated replication message")
+    }
+    return nil
+  }
+  b := m.data[:n]
+  m.data = m.data[n:]
+  return b
+}
+
+func (m *message_reader) byte() byte {
+  if b := m.bytes(1); b != nil {
+    return b[0]
+  }
+  return 0
+}
+
+func (m *message_reader) uint16() uint16 {
+  if b := m.bytes(2); b != nil {
+    return binary.BigEndian.Uint16(b)
+  }
+  return 0
+}
+
+func (m *message_reader) uint32() uint32 {
+  if b := m.bytes(4); b != nil {
+    return binary.BigEndian.Uint32(b)
+  }
+  return 0
+}
+
+func (m *message_reader) uint64() uint64 {
+  if b := m.bytes(8); b != nil {
+    return binary.BigEndian.Uint64(b)
+  }
+  return 0
+}
+
+// a nul terminated string
+func (m *message_reader) string() string {
+  if m.err != nil {
+    return ""
+  }
+  i := 0
+  for i < len(m.data) && m.data[i] != 0 {
+    i++
+  }
+  if i == len(m.data) {
+    m.err = errors.New("truncated replication message")
+    return ""
+  }
+  s := string(m.data[:i])
+  m.data = m.data[i + 1:]
+  return s
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+  "encoding/binary"
+  "testing"
+  "time"
+)
+
+import (
+  "github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestParseChangeToken(t *testing.T) {
+  tests := []struct {
+    s     string
+    token change_token
+    err   bool
+  } {
+    { s: "0/16B3748:2", token: change_token { 0x16B3748, 2 } },
+    { s: "1/0:0", token: change_token { 1 << 32, 0 } },
+    { s: "FFFFFFFF/FFFFFFFF:10", token: change_token { 1 << 64 - 1, 10 } },
+    { s: "0/16B3748", err: true },
+    { s: "0/1:-1", err: true },
+    { s: "0/1:a", err: true },
+    { s: "x/1:0", err: true },
+    { s: "01:0", err: true },
+    { s: "0/100000000:0", err: true },
+  }
+  for _, test := range tests {
+    token, err := parse_change_token(test.s)
+    if test.err {
+      if err == nil {
+        t.Errorf("parse_change_token(%q) = %+v, expected an error", test.s,
+          token)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("parse_change_token(%q): %v", test.s, err)
+      continue
+    }
+    if token != test.token {
+      t.Errorf("parse_change_token(%q) = %+v, expected %+v", test.s, token,
+        test.token)
+    }
+    if token.String() != test.s {
+      t.Errorf("%+v formats as %q, expected %q", token, token.String(), test.s)
+    }
+  }
+}
+
+// builds a pgoutput message
+type test_message []byte
+
+func (m test_message) byte(b byte) test_message {
+  return append(m, b)
+}
+
+func (m test_message) uint16(n uint16) test_message {
+  return binary.BigEndian.AppendUint16(m, n)
+}
+
+func (m test_message) uint32(n uint32) test_message {
+  return binary.BigEndian.AppendUint32(m, n)
+}
+
+func (m test_message) uint64(n uint64) test_message {
+  return binary.BigEndian.AppendUint64(m, n)
+}
+
+func (m test_message) string(s string) test_message {
+  return append(append(m, s...), 0)
+}
+
+func (m test_message) append(s string) test_message {
+  return append(m, s...)
+}
+
+func (m test_message) text(s string) test_message {
+  return append(m.byte('t').uint32(uint32(len(s))), s...)
+}
+
+func begin_message(lsn uint64, xid uint32) test_message {
+  return test_message("B").uint64(lsn).uint64(0).uint32(xid)
+}
+
+// the relation users of public with the columns id int4, name text and
+// note of a type pgx doesn't know
+func users_relation(id uint32) test_message {
+  m := test_message("R").uint32(id).string("public").string("users").
+    byte('d').uint16(3)
+  m = m.byte(1).string("id").uint32(pgtype.Int4OID).uint32(0xFFFFFFFF)
+  m = m.byte(0).string("name").uint32(pgtype.TextOID).uint32(0xFFFFFFFF)
+  return m.byte(0).string("note").uint32(999999).uint32(0xFFFFFFFF)
+}
+
+func new_test_decoder(resume change_token) *change_decoder {
+  return &change_decoder {
+    relations: make(map[uint32]*relation),
+    types: pgtype.NewMap(),
+    resume: resume,
+  }
+}
+
+type test_change struct {
+  token  string
+  op     string
+  table  string
+  before string
+  after  string
+}
+
+func decode_all(
+  t *testing.T, d *change_decoder, messages []test_message,
+) []test_change {
+  var changes []test_change
+  for _, message := range messages {
+    decoded, err := d.decode(message)
+    if err != nil {
+      t.Fatal(err)
+    }
+    for _, change := range decoded {
+      if change.Lsn != "0/100" || change.Xid != 7 ||
+        !change.Time.Equal(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)) {
+        t.Errorf("change %+v of another transaction", change)
+      }
+      changes = append(changes, test_change {
+        change.Token, change.Op, change.Schema + "." + change.Table,
+        string(change.Before), string(change.After),
+      })
+    }
+  }
+  return changes
+}
+
+func TestChangeDecoder(t *testing.T) {
+  messages := []test_message {
+    begin_message(0x100, 7),
+    users_relation(1),
+    test_message("I").uint32(1).byte('N').uint16(3).
+      text("1").text("bob").text("x"),
+    test_message("U").uint32(1).byte('K').uint16(3).
+      text("1").byte('n').byte('n').
+      byte('N').uint16(3).text("2").text("ann").byte('u'),
+    test_message("U").uint32(1).byte('N').uint16(2).text("2").byte('n'),
+    test_message("D").uint32(1).byte('O').uint16(3).
+      text("2").text("ann").text("y"),
+    test_message("T").uint32(1).byte(0).uint32(1),
+  }
+  expected := []test_change {
+    {
+      "0/100:0", "insert", "public.users", "",
+      `{"id":1,"name":"bob","note":"x"}`,
+    },
+    {
+      "0/100:1", "update", "public.users",
+      `{"id":1,"name":null,"note":null}`, `{"id":2,"name":"ann"}`,
+    },
+    { "0/100:2", "update", "public.users", "", `{"id":2,"name":null}` },
+    {
+      "0/100:3", "delete", "public.users",
+      `{"id":2,"name":"ann","note":"y"}`, "",
+    },
+    { "0/100:4", "truncate", "public.users", "", "" },
+  }
+  tests := []struct {
+    name   string
+    resume change_token
+    skip   int
+  } {
+    { name: "from the start" },
+    { name: "resumed", resume: change_token { 0x100, 1 }, skip: 2 },
+    { name: "other lsn", resume: change_token { 0x200, 1 } },
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      changes := decode_all(t, new_test_decoder(test.resume), messages)
+      if len(changes) != len(expected) - test.skip {
+        t.Fatalf("changes %+v, expected %+v", changes,
+          expected[test.skip:])
+      }
+      for i, change := range changes {
+        if change != expected[test.skip + i] {
+          t.Errorf("change %+v, expected %+v", change,
+            expected[test.skip + i])
+        }
+      }
+    })
+  }
+}
+
+func TestChangeDecoderErrors(t *testing.T) {
+  tests := []struct {
+    name    string
+    message test_message
+    err     string
+  } {
+    {
+      name: "truncated",
+      message: test_message("B").uint64(0x100),
+      err: "truncated replication message",
+    },
+    {
+      name: "unterminated string",
+      message: test_message("R").uint32(2).append("public"),
+      err: "truncated replication message",
+    },
+    {
+      name: "unknown relation",
+      message: test_message("I").uint32(2).byte('N').uint16(0),
+      err: "change of unknown relation 2",
+    },
+    {
+      name: "more values than columns",
+      message: test_message("I").uint32(1).byte('N').uint16(4),
+      err: "tuple does not match its relation",
+    },
+    {
+      name: "value kind",
+      message: test_message("I").uint32(1).byte('N').uint16(1).byte('b'),
+      err: "unsupported tuple value kind 'b'",
+    },
+    {
+      name: "truncated value",
+      message: test_message("I").uint32(1).byte('N').uint16(1).
+        byte('t').uint32(4).append("1"),
+      err: "truncated replication message",
+    },
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      d := new_test_decoder(change_token{})
+      _, err := d.decode(users_relation(1))
+      if err != nil {
+        t.Fatal(err)
+      }
+      changes, err := d.decode(test.message)
+      if err == nil || err.Error() != test.err {
+        t.Errorf("changes %+v and error %v, expected %q", changes, err,
+          test.err)
+      }
+    })
+  }
+}
@@ -0,0 +1,839 @@
+package server
+
+import (
+  "context"
+  "fmt"
+  "net/http"
+  "strings"
+)
+
+import (
+  "github.com/georgysavva/scany/v2/pgxscan"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+// the schema as a sql script, like pg_dump --schema-only: objects come out in
+// dependency order, each followed by its owner and grants, and names are
+// qualified since the queries run with an empty search path
+
+// the exported schemas: $1, or every user schema when it is empty
+const ddl_schema_cond = "(n.nspname = $1::text OR $1::text = '' AND " +
+  "n.nspname NOT IN ('pg_catalog', 'information_schema') AND " +
+  "n.nspname !~ '^pg_(toast|temp_)')"
+
+// leaves out the members of extensions, which CREATE EXTENSION creates
+func not_extension_member(catalog string, oid string) string {
+  return "NOT EXISTS (SELECT 1 FROM pg_depend e WHERE e.classid = '" +
+    catalog + "'::regclass AND e.objid = " + oid + " AND e.deptype = 'e')"
+}
+
+// the GRANT statements of an object from its acl, leaving out the owner's
+// own privileges, which it has by default
+func grants_sql(acl string, owner string, kind string, ident string) string {
+  return "coalesce((SELECT array_agg(format('GRANT %s ON " + kind +
+    " %s TO %s%s;', a.privilege_type, " + ident + ", " +
+    "CASE WHEN a.grantee = 0 THEN 'PUBLIC' " +
+    "ELSE quote_ident(pg_get_userbyid(a.grantee)) END, " +
+    "CASE WHEN a.is_grantable THEN ' WITH GRANT OPTION' ELSE '' END) " +
+    "ORDER BY a.grantee, a.privilege_type) FROM aclexplode(" + acl +
+    ") a WHERE a.grantee <> " + owner + "), '{}') AS grants"
+}
+
+func owner_sql(owner string) string {
+  return "quote_ident(pg_get_userbyid(" + owner + ")) AS owner"
+}
+
+// the qualified name of a collation
+func collation_sql(oid string) string {
+  return "(SELECT format('%I.%I', cn.nspname, co.collname) " +
+    "FROM pg_collation co JOIN pg_namespace cn ON cn.oid = co.collnamespace " +
+    "WHERE co.oid = " + oid + ")"
+}
+
+// the oid a type is ordered by among the exported objects: the relation of a
+// row type, the element of an array type, or else the type itself
+func type_dep_sql(oid string) string {
+  return "(SELECT coalesce(nullif(dt.typrelid, 0::oid), " +
+    "nullif(de.typrelid, 0::oid), " +
+    "de.oid, dt.oid)::bigint FROM pg_type dt LEFT JOIN pg_type de " +
+    "ON de.oid = dt.typelem AND dt.typcategory = 'A' WHERE dt.oid = " + oid +
+    ")"
+}
+
+var ddl_schemas_sql = "SELECT quote_ident(n.nspname) AS ident, " +
+  owner_sql("n.nspowner") + ", " +
+  grants_sql("n.nspacl", "n.nspowner", "SCHEMA", "quote_ident(n.nspname)") +
+  " FROM pg_namespace n WHERE " + ddl_schema_cond +
+  " ORDER BY n.nspname"
+
+const ddl_extensions_sql = "SELECT quote_ident(e.extname) AS ident, " +
+  "quote_ident(n.nspname) AS schema FROM pg_extension e " +
+  "JOIN pg_namespace n ON n.oid = e.extnamespace " +
+  "WHERE e.extname <> 'plpgsql' AND ($1::text = '' OR n.nspname = $1::text) " +
+  "ORDER BY e.extname"
+
+const ddl_type_ident = "format('%I.%I', n.nspname, t.typname)"
+
+var ddl_enums_sql = "SELECT t.oid::bigint AS oid, " + ddl_type_ident +
+  " AS ident, " +
+  owner_sql("t.typowner") + ", " +
+  "array(SELECT quote_literal(l.enumlabel) FROM pg_enum l " +
+  "WHERE l.enumtypid = t.oid ORDER BY l.enumsortorder) AS labels, " +
+  grants_sql("t.typacl", "t.typowner", "TYPE", ddl_type_ident) +
+  " FROM pg_type t JOIN pg_namespace n ON n.oid = t.typnamespace " +
+  "WHERE t.typtype = 'e' AND " + ddl_schema_cond + " AND " +
+  not_extension_member("pg_type", "t.oid") + " ORDER BY t.oid"
+
+var ddl_domains_sql = "SELECT t.oid::bigint AS oid, " + ddl_type_ident +
+  " AS ident, " + owner_sql("t.typowner") + ", " +
+  "ARRAY[" + type_dep_sql("t.typbasetype") + "] AS depends_on, " +
+  "format_type(t.typbasetype, t.typtypmod) AS base_type, " +
+  "CASE WHEN t.typcollation <> b.typcollation THEN " +
+  collation_sql("t.typcollation") + " END AS collation, " +
+  "t.typdefault AS default_expr, t.typnotnull AS not_null, " +
+  "array(SELECT format('CONSTRAINT %I %s', con.conname, " +
+  "pg_get_constraintdef(con.oid)) FROM pg_constraint con " +
+  "WHERE con.contypid = t.oid AND con.contype = 'c' " +
+  "ORDER BY con.conname) AS constraints, " +
+  grants_sql("t.typacl", "t.typowner", "DOMAIN", ddl_type_ident) +
+  " FROM pg_type t JOIN pg_type b ON b.oid = t.typbasetype " +
+  "JOIN pg_namespace n ON n.oid = t.typnamespace " +
+  "WHERE t.typtype = 'd' AND " + ddl_schema_cond + " AND " +
+  not_extension_member("pg_type", "t.oid") + " ORDER BY t.oid"
+
+// standalone composite types, ordered by their relation like row types
+var ddl_composites_sql = "SELECT t.typrelid::bigint AS oid, " +
+  ddl_type_ident + " AS ident, " + owner_sql("t.typowner") + ", " +
+  "array(SELECT format('%I %s', a.attname, " +
+  "format_type(a.atttypid, a.atttypmod)) || " +
+  "CASE WHEN a.attcollation <> att.typcollation THEN " +
+  "coalesce(' COLLATE ' || " + collation_sql("a.attcollation") +
+  ", '') ELSE '' END " +
+  "FROM pg_attribute a JOIN pg_type att ON att.oid = a.atttypid " +
+  "WHERE a.attrelid = t.typrelid AND a.attnum > 0 AND NOT a.attisdropped " +
+  "ORDER BY a.attnum) AS attributes, " +
+  "array(SELECT DISTINCT " + type_dep_sql("a.atttypid") +
+  " FROM pg_attribute a WHERE a.attrelid = t.typrelid AND a.attnum > 0 " +
+  "AND NOT a.attisdropped) AS depends_on, " +
+  grants_sql("t.typacl", "t.typowner", "TYPE", ddl_type_ident) +
+  " FROM pg_type t JOIN pg_class c ON c.oid = t.typrelid " +
+  "JOIN pg_namespace n ON n.oid = t.typnamespace " +
+  "WHERE t.typtype = 'c' AND c.relkind = 'c' AND " + ddl_schema_cond +
+  " AND " + not_extension_member("pg_type", "t.oid") + " ORDER BY t.oid"
+
+// range types; canonical functions, which need a shell type to exist first,
+// are not exported
+var ddl_ranges_sql = "SELECT t.oid::bigint AS oid, " + ddl_type_ident +
+  " AS ident, " + owner_sql("t.typowner") + ", " +
+  "format_type(r.rngsubtype, NULL) AS subtype, " +
+  "CASE WHEN NOT opc.opcdefault THEN format('%I.%I', opn.nspname, " +
+  "opc.opcname) END AS opclass, " +
+  "CASE WHEN r.rngcollation <> st.typcollation THEN " +
+  collation_sql("r.rngcollation") + " END AS collation, " +
+  "CASE WHEN r.rngsubdiff::oid <> 0 THEN r.rngsubdiff::regproc::text END " +
+  "AS subtype_diff, " +
+  "array_remove(ARRAY[" + type_dep_sql("r.rngsubtype") + ", " +
+  "nullif(r.rngsubdiff::oid, 0)::bigint], NULL) AS depends_on, " +
+  grants_sql("t.typacl", "t.typowner", "TYPE", ddl_type_ident) +
+  " FROM pg_type t JOIN pg_range r ON r.rngtypid = t.oid " +
+  "JOIN pg_type st ON st.oid = r.rngsubtype " +
+  "JOIN pg_opclass opc ON opc.oid = r.rngsubopc " +
+  "JOIN pg_namespace opn ON opn.oid = opc.opcnamespace " +
+  "JOIN pg_namespace n ON n.oid = t.typnamespace " +
+  "WHERE t.typtype = 'r' AND " + ddl_schema_cond + " AND " +
+  not_extension_member("pg_type", "t.oid") + " ORDER BY t.oid"
+
+const ddl_function_ident = "format('%I.%I(%s)', n.nspname, p.proname, " +
+  "pg_get_function_identity_arguments(p.oid))"
+
+// Depends_on are the types the function takes or returns, with row types as
+// their tables and views, which must exist before it
+var ddl_functions_sql = "SELECT p.oid::bigint AS oid, " +
+  ddl_function_ident + " AS ident, " +
+  "pg_get_functiondef(p.oid) AS definition, " + owner_sql("p.proowner") +
+  ", p.proacl IS NOT NULL AS has_acl, " +
+  "array(SELECT DISTINCT " + type_dep_sql("x.oid") + " FROM unnest(" +
+  "p.proargtypes::oid[] || p.prorettype || " +
+  "coalesce(p.proallargtypes, '{}')) AS x(oid)) AS depends_on, " +
+  grants_sql("p.proacl", "p.proowner", "ROUTINE", ddl_function_ident) +
+  " FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace " +
+  "WHERE p.prokind IN ('f', 'p') AND " + ddl_schema_cond + " AND " +
+  not_extension_member("pg_proc", "p.oid") +
+  " ORDER BY p.proname, p.oid"
+
+const ddl_rel_ident = "format('%I.%I', n.nspname, c.relname)"
+
+// sequences of identity columns are created with their columns; with a table
+// ($2), only the sequences it owns
+var ddl_sequences_sql = "SELECT " + ddl_rel_ident + " AS ident, " +
+  owner_sql("c.relowner") + ", " +
+  "format_type(s.seqtypid, NULL) AS data_type, s.seqstart, s.seqincrement, " +
+  "s.seqmin, s.seqmax, s.seqcache, s.seqcycle, " +
+  "(SELECT format('%I.%I.%I', tn.nspname, tc.relname, a.attname) " +
+  "FROM pg_depend d JOIN pg_class tc ON tc.oid = d.refobjid " +
+  "JOIN pg_namespace tn ON tn.oid = tc.relnamespace " +
+  "JOIN pg_attribute a ON a.attrelid = d.refobjid " +
+  "AND a.attnum = d.refobjsubid " +
+  "WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid " +
+  "AND d.refclassid = 'pg_class'::regclass AND d.deptype = 'a') " +
+  "AS owned_by, " +
+  grants_sql("c.relacl", "c.relowner", "SEQUENCE", ddl_rel_ident) +
+  " FROM pg_sequence s JOIN pg_class c ON c.oid = s.seqrelid " +
+  "JOIN pg_namespace n ON n.oid = c.relnamespace " +
+  "WHERE " + ddl_schema_cond + " AND " +
+  not_extension_member("pg_class", "c.oid") + " AND NOT EXISTS (" +
+  "SELECT 1 FROM pg_depend d WHERE d.classid = 'pg_class'::regclass " +
+  "AND d.objid = c.oid AND d.deptype = 'i') " +
+  "AND ($2::oid = 0 OR EXISTS (SELECT 1 FROM pg_depend d " +
+  "WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid " +
+  "AND d.deptype = 'a' AND d.refobjid = $2::oid)) " +
+  "ORDER BY c.relname"
+
+// column definitions, leaving out inherited columns and the columns of
+// partitions
+var ddl_columns_sql = "array(SELECT format('%I %s', a.attname, " +
+  "format_type(a.atttypid, a.atttypmod)) || " +
+  "CASE WHEN a.attcollation <> t.typcollation THEN coalesce(' COLLATE ' || " +
+  collation_sql("a.attcollation") + ", '') ELSE '' END || " +
+  "CASE a.attgenerated " +
+  "WHEN 's' THEN ' GENERATED ALWAYS AS (' || " +
+  "pg_get_expr(d.adbin, d.adrelid) || ') STORED' " +
+  "WHEN 'v' THEN ' GENERATED ALWAYS AS (' || " +
+  "pg_get_expr(d.adbin, d.adrelid) || ') VIRTUAL' " +
+  "ELSE coalesce(' DEFAULT ' || pg_get_expr(d.adbin, d.adrelid), '') END || " +
+  "CASE a.attidentity WHEN 'a' THEN ' GENERATED ALWAYS AS IDENTITY' " +
+  "WHEN 'd' THEN ' GENERATED BY DEFAULT AS IDENTITY' ELSE '' END || " +
+  "CASE WHEN a.attnotnull THEN ' NOT NULL' ELSE '' END " +
+  "FROM pg_attribute a JOIN pg_type t ON t.oid = a.atttypid " +
+  "LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum " +
+  "WHERE a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped " +
+  "AND a.attislocal AND NOT c.relispartition ORDER BY a.attnum) AS columns"
+
+// primary key, unique, check and exclusion constraints declared on the table
+// itself; unvalidated ones are added after the tables
+const ddl_table_constraints_sql = "array(SELECT format('CONSTRAINT %I %s', " +
+  "con.conname, pg_get_constraintdef(con.oid)) FROM pg_constraint con " +
+  "WHERE con.conrelid = c.oid AND con.contype IN ('p', 'u', 'c', 'x') " +
+  "AND con.conislocal AND con.conparentid = 0 AND con.convalidated " +
+  "ORDER BY position(con.contype::text in 'pucx'), con.conname) " +
+  "AS constraints"
+
+// the types of the columns and the functions of the defaults and constraints
+var ddl_table_deps_sql = "array(SELECT DISTINCT CASE " +
+  "WHEN d.refclassid = 'pg_type'::regclass THEN " +
+  type_dep_sql("d.refobjid") + " ELSE d.refobjid::bigint END " +
+  "FROM pg_depend d WHERE d.refclassid IN ('pg_type'::regclass, " +
+  "'pg_proc'::regclass) AND (d.classid = 'pg_class'::regclass " +
+  "AND d.objid = c.oid OR d.classid = 'pg_attrdef'::regclass " +
+  "AND d.objid IN (SELECT ad.oid FROM pg_attrdef ad " +
+  "WHERE ad.adrelid = c.oid) OR d.classid = 'pg_constraint'::regclass " +
+  "AND d.objid IN (SELECT con.oid FROM pg_constraint con " +
+  "WHERE con.conrelid = c.oid))) AS depends_on"
+
+var ddl_tables_sql = "SELECT c.oid::bigint AS oid, " + ddl_rel_ident +
+  " AS ident, " + owner_sql("c.relowner") + ", " + ddl_table_deps_sql + ", " +
+  "c.relpersistence = 'u' AS unlogged, " +
+  ddl_columns_sql + ", " + ddl_table_constraints_sql + ", " +
+  "array(SELECT format('%I.%I', pn.nspname, pc.relname) " +
+  "FROM pg_inherits i JOIN pg_class pc ON pc.oid = i.inhparent " +
+  "JOIN pg_namespace pn ON pn.oid = pc.relnamespace " +
+  "WHERE i.inhrelid = c.oid ORDER BY i.inhseqno) AS parents, " +
+  "array(SELECT i.inhparent::bigint FROM pg_inherits i " +
+  "WHERE i.inhrelid = c.oid ORDER BY i.inhseqno) AS parent_oids, " +
+  "CASE WHEN c.relispartition THEN pg_get_expr(c.relpartbound, c.oid) END " +
+  "AS partition_bound, " +
+  "CASE WHEN c.relkind = 'p' THEN pg_get_partkeydef(c.oid) END " +
+  "AS partition_key, " +
+  "coalesce(c.reloptions, '{}') AS reloptions, " +
+  grants_sql("c.relacl", "c.relowner", "TABLE", ddl_rel_ident) +
+  " FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace " +
+  "WHERE c.relkind IN ('r', 'p') AND " + ddl_schema_cond + " AND " +
+  not_extension_member("pg_class", "c.oid") +
+  " AND ($2::oid = 0 OR c.oid = $2::oid) ORDER BY c.relname"
+
+// Depends_on are the relations and functions the view's query uses
+var ddl_views_sql = "SELECT c.oid::bigint AS oid, " + ddl_rel_ident +
+  " AS ident, " + owner_sql("c.relowner") + ", " +
+  "c.relkind = 'm' AS materialized, pg_get_viewdef(c.oid) AS definition, " +
+  "coalesce(c.reloptions, '{}') AS reloptions, " +
+  "array(SELECT DISTINCT d.refobjid::bigint FROM pg_rewrite rw " +
+  "JOIN pg_depend d ON d.classid = 'pg_rewrite'::regclass " +
+  "AND d.objid = rw.oid WHERE rw.ev_class = c.oid " +
+  "AND d.refclassid IN ('pg_class'::regclass, 'pg_proc'::regclass) " +
+  "AND d.refobjid <> c.oid) AS depends_on, " +
+  grants_sql("c.relacl", "c.relowner", "TABLE", ddl_rel_ident) +
+  " FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace " +
+  "WHERE c.relkind IN ('v', 'm') AND " + ddl_schema_cond + " AND " +
+  not_extension_member("pg_class", "c.oid") + " ORDER BY c.relname"
+
+// the indexes not created by constraints, nor by the indexes of partitioned
+// tables for their partitions
+var ddl_indexes_sql = "SELECT i.schemaname, i.tablename, i.indexname, " +
+  "i.tablespace, i.indexdef FROM pg_indexes i " +
+  "JOIN pg_namespace n ON n.nspname = i.schemaname " +
+  "JOIN pg_class ic ON ic.relnamespace = n.oid AND ic.relname = i.indexname " +
+  "JOIN pg_index x ON x.indexrelid = ic.oid " +
+  "WHERE " + ddl_schema_cond + " AND NOT ic.relispartition AND " +
+  not_extension_member("pg_class", "x.indrelid") + " AND NOT EXISTS (" +
+  "SELECT 1 FROM pg_constraint con WHERE con.conindid = ic.oid " +
+  "AND con.conrelid = x.indrelid AND con.contype IN ('p', 'u', 'x')) " +
+  "AND ($2::oid = 0 OR x.indrelid = $2::oid) " +
+  "ORDER BY i.tablename, i.indexname"
+
+// foreign keys, which may reference tables created after theirs, and
+// unvalidated constraints, which CREATE TABLE can't declare
+var ddl_late_constraints_sql = "SELECT format('ALTER TABLE %I.%I " +
+  "ADD CONSTRAINT %I %s;', n.nspname, c.relname, con.conname, " +
+  "pg_get_constraintdef(con.oid)) FROM pg_constraint con " +
+  "JOIN pg_class c ON c.oid = con.conrelid " +
+  "JOIN pg_namespace n ON n.oid = c.relnamespace " +
+  "WHERE (con.contype = 'f' OR con.contype IN ('p', 'u', 'c', 'x') " +
+  "AND NOT con.convalidated) AND con.conislocal AND con.conparentid = 0 " +
+  "AND " + ddl_schema_cond + " AND " +
+  not_extension_member("pg_class", "c.oid") +
+  " AND ($2::oid = 0 OR c.oid = $2::oid) ORDER BY c.relname, con.conname"
+
+var ddl_triggers_sql = "SELECT pg_get_triggerdef(t.oid) || ';' " +
+  "FROM pg_trigger t JOIN pg_class c ON c.oid = t.tgrelid " +
+  "JOIN pg_namespace n ON n.oid = c.relnamespace " +
+  "WHERE NOT t.tgisinternal AND t.tgparentid = 0 AND " + ddl_schema_cond +
+  " AND " + not_extension_member("pg_class", "c.oid") +
+  " AND ($2::oid = 0 OR c.oid = $2::oid) ORDER BY c.relname, t.tgname"
+
+type ddl_schema struct {
+  Ident, Owner string
+  Grants       []string
+}
+
+type ddl_extension struct {
+  Ident, Schema string
+}
+
+type ddl_enum struct {
+  Oid            int64
+  Ident, Owner   string
+  Labels, Grants []string
+}
+
+type ddl_domain struct {
+  Oid                     int64
+  Ident, Owner, Base_type string
+  Depends_on              []int64
+  Collation, Default_expr *string
+  Not_null                bool
+  Constraints, Grants     []string
+}
+
+type ddl_composite struct {
+  Oid                int64
+  Ident, Owner       string
+  Attributes, Grants []string
+  Depends_on         []int64
+}
+
+type ddl_range struct {
+  Oid                              int64
+  Ident, Owner, Subtype            string
+  Opclass, Collation, Subtype_diff *string
+  Depends_on                       []int64
+  Grants                           []string
+}
+
+type ddl_function struct {
+  Oid                      int64
+  Ident, Definition, Owner string
+  Has_acl                  bool
+  Depends_on               []int64
+  Grants                   []string
+}
+
+type ddl_sequence struct {
+  Ident, Owner, Data_type                           string
+  Seqstart, Seqincrement, Seqmin, Seqmax, Seqcache int64
+  Seqcycle                                          bool
+  Owned_by                                          *string
+  Grants                                            []string
+}
+
+type ddl_table struct {
+  Oid                              int64
+  Ident, Owner                     string
+  Unlogged                         bool
+  Columns, Constraints, Parents    []string
+  Parent_oids, Depends_on          []int64
+  Partition_bound, Partition_key   *string
+  Reloptions, Grants               []string
+}
+
+type ddl_view struct {
+  Oid                      int64
+  Ident, Owner, Definition string
+  Materialized             bool
+  Reloptions               []string
+  Depends_on               []int64
+  Grants                   []string
+}
+
+// an object to create after the objects with the oids in deps
+type ddl_object struct {
+  oid  int64
+  deps []int64
+  sql  string
+}
+
+// the statements creating an object followed by its owner and grants
+func ddl_block(
+  create string, kind string, ident string, owner string, grants []string,
+) string {
+  var block strings.Builder
+  block.WriteString(create + "\n")
+  block.WriteString("ALTER " + kind + " " + ident + " OWNER TO " + owner +
+    ";\n")
+  for _, grant := range grants {
+    block.WriteString(grant + "\n")
+  }
+  return block.String()
+}
+
+// a parenthesized, indented list, or "()"
+func ddl_list(items []string) string {
+  if len(items) == 0 {
+    return "()"
+  }
+  return "(\n    " + strings.Join(items, ",\n    ") + "\n)"
+}
+
+func (schema *ddl_schema) sql() string {
+  return ddl_block("CREATE SCHEMA IF NOT EXISTS " + schema.Ident + ";",
+    "SCHEMA", schema.Ident, schema.Owner, schema.Grants)
+}
+
+func (enum *ddl_enum) sql() string {
+  return ddl_block("CREATE TYPE " + enum.Ident + " AS ENUM " +
+    ddl_list(enum.Labels) + ";", "TYPE", enum.Ident, enum.Owner, enum.Grants)
+}
+
+func (domain *ddl_domain) sql() string {
+  create := "CREATE DOMAIN " + domain.Ident + " AS " + domain.Base_type
+  if domain.Collation != nil {
+    create += " COLLATE " + *domain.Collation
+  }
+  if domain.Default_expr != nil {
+    create += " DEFAULT " + *domain.Default_expr
+  }
+  if domain.Not_null {
+    create += " NOT NULL"
+  }
+  for _, constraint := range domain.Constraints {
+    create += "\n    " + constraint
+  }
+  return ddl_block(create + ";", "DOMAIN", domain.Ident, domain.Owner,
+    domain.Grants)
+}
+
+func (composite *ddl_composite) sql() string {
+  return ddl_block("CREATE TYPE " + composite.Ident + " AS " +
+    ddl_list(composite.Attributes) + ";", "TYPE", composite.Ident,
+    composite.Owner, composite.Grants)
+}
+
+func (rng *ddl_range) sql() string {
+  options := []string { "SUBTYPE = " + rng.Subtype }
+  if rng.Opclass != nil {
+    options = append(options, "SUBTYPE_OPCLASS = " + *rng.Opclass)
+  }
+  if rng.Collation != nil {
+    options = append(options, "COLLATION = " + *rng.Collation)
+  }
+  if rng.Subtype_diff != nil {
+    options = append(options, "SUBTYPE_DIFF = " + *rng.Subtype_diff)
+  }
+  return ddl_block("CREATE TYPE " + rng.Ident + " AS RANGE " +
+    ddl_list(options) + ";", "TYPE", rng.Ident, rng.Owner, rng.Grants)
+}
+
+// functions can be executed by everyone unless their acl says otherwise
+func (function *ddl_function) sql() string {
+  grants := function.Grants
+  if function.Has_acl {
+    grants = append([]string { "REVOKE ALL ON ROUTINE " + function.Ident +
+      " FROM PUBLIC;" }, grants...)
+  }
+  return ddl_block(strings.TrimRight(function.Definition, "\n") + ";",
+    "ROUTINE", function.Ident, function.Owner, grants)
+}
+
+func (sequence *ddl_sequence) sql() string {
+  create := fmt.Sprintf("CREATE SEQUENCE %s AS %s INCREMENT BY %d " +
+    "MINVALUE %d MAXVALUE %d START WITH %d CACHE %d", sequence.Ident,
+    sequence.Data_type, sequence.Seqincrement, sequence.Seqmin,
+    sequence.Seqmax, sequence.Seqstart, sequence.Seqcache)
+  if sequence.Seqcycle {
+    create += " CYCLE"
+  } else {
+    create += " NO CYCLE"
+  }
+  return ddl_block(create + ";", "SEQUENCE", sequence.Ident, sequence.Owner,
+    sequence.Grants)
+}
+
+func (table *ddl_table) sql() string {
+  create := "CREATE TABLE "
+  if table.Unlogged {
+    create = "CREATE UNLOGGED TABLE "
+  }
+  create += table.Ident
+  if table.Partition_bound != nil {
+    create += " PARTITION OF " + table.Parents[0]
+    if len(table.Constraints) > 0 {
+      create += " " + ddl_list(table.Constraints)
+    }
+    create += " " + *table.Partition_bound
+  } else {
+    create += " " + ddl_list(append(table.Columns, table.Constraints...))
+    if len(table.Parents) > 0 {
+      create += " INHERITS (" + strings.Join(table.Parents, ", ") + ")"
+    }
+  }
+  if table.Partition_key != nil {
+    create += " PARTITION BY " + *table.Partition_key
+  }
+  if len(table.Reloptions) > 0 {
+    create += " WITH (" + strings.Join(table.Reloptions, ", ") + ")"
+  }
+  return ddl_block(create + ";", "TABLE", table.Ident, table.Owner,
+    table.Grants)
+}
+
+// materialized views are created empty, to be refreshed once there is data
+func (view *ddl_view) sql() string {
+  kind := "VIEW"
+  if view.Materialized {
+    kind = "MATERIALIZED VIEW"
+  }
+  create := "CREATE " + kind + " " + view.Ident
+  if len(view.Reloptions) > 0 {
+    create += " WITH (" + strings.Join(view.Reloptions, ", ") + ")"
+  }
+  definition := strings.TrimSuffix(strings.TrimRight(view.Definition, " \n"),
+    ";")
+  create += " AS\n" + definition
+  if view.Materialized {
+    create += "\n  WITH NO DATA"
+  }
+  return ddl_block(create + ";", kind, view.Ident, view.Owner, view.Grants)
+}
+
+// splits off the functions and types that have to wait for the tables and
+// views in late: functions using any of the exported types, tables or views
+// (the others are created before the types), and types using late objects
+func split_late_objects(
+  functions []ddl_object, types []ddl_object, late []ddl_object,
+) ([]ddl_object, []ddl_object, []ddl_object, []ddl_object) {
+  is_late := make(map[int64]bool)
+  for _, object := range late {
+    is_late[object.oid] = true
+  }
+  is_type := make(map[int64]bool)
+  for _, object := range types {
+    is_type[object.oid] = true
+  }
+  var early_functions, late_functions []ddl_object
+  for _, function := range functions {
+    late := false
+    for _, dep := range function.deps {
+      late = late || is_type[dep] || is_late[dep]
+    }
+    if late {
+      is_late[function.oid] = true
+      late_functions = append(late_functions, function)
+    } else {
+      early_functions = append(early_functions, function)
+    }
+  }
+  // a type using a late type is late too
+  for changed := true; changed; {
+    changed = false
+    for _, object := range types {
+      if is_late[object.oid] {
+        continue
+      }
+      for _, dep := range object.deps {
+        if is_late[dep] {
+          is_late[object.oid] = true
+          changed = true
+          break
+        }
+      }
+    }
+  }
+  var early_types, late_types []ddl_object
+  for _, object := range types {
+    if is_late[object.oid] {
+      late_types = append(late_types, object)
+    } else {
+      early_types = append(early_types, object)
+    }
+  }
+  return early_functions, early_types, late_functions, late_types
+}
+
+// the objects ordered so each comes after the ones it depends on; postgres
+// allows no cycles between them, and otherwise the order is kept
+func dependency_order(objects []ddl_object) []ddl_object {
+  index := make(map[int64]int, len(objects))
+  for i, object := range objects {
+    index[object.oid] = i
+  }
+  visited := make([]bool, len(objects))
+  ordered := make([]ddl_object, 0, len(objects))
+  var visit func(i int)
+  visit = func(i int) {
+    if visited[i] {
+      return
+    }
+    visited[i] = true
+    for _, dep := range objects[i].deps {
+      if j, ok := index[dep]; ok {
+        visit(j)
+      }
+    }
+    ordered = append(ordered, objects[i])
+  }
+  for i := range objects {
+    visit(i)
+  }
+  return ordered
+}
+
+// a script of sections of statements
+type ddl_script struct {
+  strings.Builder
+}
+
+func (script *ddl_script) section(name string, blocks []string) {
+  if len(blocks) == 0 {
+    return
+  }
+  script.WriteString("\n-- " + name + "\n")
+  for _, block := range blocks {
+    script.WriteString("\n" + block)
+  }
+}
+
+func (script *ddl_script) objects(name string, objects []ddl_object) {
+  blocks := make([]string, 0, len(objects))
+  for _, object := range dependency_order(objects) {
+    blocks = append(blocks, object.sql)
+  }
+  script.section(name, blocks)
+}
+
+// the script creating the objects of schema, or of every user schema when it
+// is empty, or only the table with oid table and what belongs to it (its
+// sequences, indexes, constraints and triggers) when it is not 0
+func (server *PgServer) export_ddl(
+  ctx context.Context, schema string, table uint32,
+) (string, error) {
+  tx, err := server.db(ctx).Begin(ctx)
+  if err != nil {
+    return "", err
+  }
+  defer tx.Rollback(ctx)
+  // one snapshot for every query, and an empty search path so postgres
+  // qualifies the names in the definitions it prints
+  _, err = tx.Exec(ctx,
+    "SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY")
+  if err != nil {
+    return "", err
+  }
+  _, err = tx.Exec(ctx, "SET LOCAL search_path = ''")
+  if err != nil {
+    return "", err
+  }
+  var script ddl_script
+  script.WriteString("-- exported by pgrest\n\n" +
+    "SET check_function_bodies = false;\n" +
+    "SELECT pg_catalog.set_config('search_path', '', false);\n")
+  sequences := make([]*ddl_sequence, 0)
+  tables := make([]*ddl_table, 0)
+  indexes := make([]*pgrest.Index, 0)
+  var constraints, triggers []string
+  for _, q := range []struct {
+    dst  interface{}
+    sql  string
+    name string
+  } {
+    { &sequences, ddl_sequences_sql, "sequences" },
+    { &tables, ddl_tables_sql, "tables" },
+    { &indexes, ddl_indexes_sql, "indexes" },
+    { &constraints, ddl_late_constraints_sql, "constraints" },
+    { &triggers, ddl_triggers_sql, "triggers" },
+  } {
+    err = pgxscan.Select(ctx, tx, q.dst, q.sql, schema, table)
+    if err != nil {
+      return "", fmt.Errorf("getting %s: %w", q.name, err)
+    }
+  }
+  // tables, then views and the functions and types that need tables, in
+  // dependency order
+  ordered := make([]ddl_object, len(tables))
+  for i, t := range tables {
+    ordered[i] = ddl_object {
+      t.Oid, append(t.Parent_oids, t.Depends_on...), t.sql(),
+    }
+  }
+  if table == 0 {
+    schemas := make([]*ddl_schema, 0)
+    extensions := make([]*ddl_extension, 0)
+    enums := make([]*ddl_enum, 0)
+    domains := make([]*ddl_domain, 0)
+    composites := make([]*ddl_composite, 0)
+    ranges := make([]*ddl_range, 0)
+    functions := make([]*ddl_function, 0)
+    views := make([]*ddl_view, 0)
+    for _, q := range []struct {
+      dst  interface{}
+      sql  string
+      name string
+    } {
+      { &schemas, ddl_schemas_sql, "schemas" },
+      { &extensions, ddl_extensions_sql, "extensions" },
+      { &enums, ddl_enums_sql, "enums" },
+      { &domains, ddl_domains_sql, "domains" },
+      { &composites, ddl_composites_sql, "composite types" },
+      { &ranges, ddl_ranges_sql, "range types" },
+      { &functions, ddl_functions_sql, "functions" },
+      { &views, ddl_views_sql, "views" },
+    } {
+      err = pgxscan.Select(ctx, tx, q.dst, q.sql, schema)
+      if err != nil {
+        return "", fmt.Errorf("getting %s: %w", q.name, err)
+      }
+    }
+    blocks := make([]string, len(schemas))
+    for i, s := range schemas {
+      blocks[i] = s.sql()
+    }
+    script.section("schemas", blocks)
+    blocks = make([]string, len(extensions))
+    for i, extension := range extensions {
+      blocks[i] = "CREATE EXTENSION IF NOT EXISTS " + extension.Ident +
+        " WITH SCHEMA " + extension.Schema + ";\n"
+    }
+    script.section("extensions", blocks)
+    types := make([]ddl_object, 0,
+      len(enums) + len(domains) + len(composites) + len(ranges))
+    for _, enum := range enums {
+      types = append(types, ddl_object { enum.Oid, nil, enum.sql() })
+    }
+    for _, domain := range domains {
+      types = append(types, ddl_object {
+        domain.Oid, domain.Depends_on, domain.sql(),
+      })
+    }
+    for _, composite := range composites {
+      types = append(types, ddl_object {
+        composite.Oid, composite.Depends_on, composite.sql(),
+      })
+    }
+    for _, rng := range ranges {
+      types = append(types, ddl_object { rng.Oid, rng.Depends_on, rng.sql() })
+    }
+    function_objects := make([]ddl_object, len(functions))
+    for i, function := range functions {
+      function_objects[i] = ddl_object {
+        function.Oid, function.Depends_on, function.sql(),
+      }
+    }
+    for _, view := range views {
+      ordered = append(ordered, ddl_object {
+        view.Oid, view.Depends_on, view.sql(),
+      })
+    }
+    var late_functions, late_types []ddl_object
+    function_objects, types, late_functions, late_types =
+      split_late_objects(function_objects, types, ordered)
+    blocks = make([]string, len(function_objects))
+    for i, function := range function_objects {
+      blocks[i] = function.sql
+    }
+    script.section("functions", blocks)
+    script.objects("types", types)
+    ordered = append(append(ordered, late_types...), late_functions...)
+  }
+  blocks := make([]string, len(sequences))
+  var owned_by []string
+  for i, sequence := range sequences {
+    blocks[i] = sequence.sql()
+    if sequence.Owned_by != nil {
+      owned_by = append(owned_by, "ALTER SEQUENCE " + sequence.Ident +
+        " OWNED BY " + *sequence.Owned_by + ";\n")
+    }
+  }
+  script.section("sequences", blocks)
+  script.objects("tables, views, and the functions and types using them",
+    ordered)
+  script.section("sequence ownership", owned_by)
+  blocks = make([]string, len(indexes))
+  for i, index := range indexes {
+    blocks[i] = index.Indexdef.String + ";\n"
+  }
+  script.section("indexes", blocks)
+  script.section("foreign keys and unvalidated constraints",
+    lines(constraints))
+  script.section("triggers", lines(triggers))
+  return script.String(), nil
+}
+
+func lines(statements []string) []string {
+  result := make([]string, len(statements))
+  for i, statement := range statements {
+    result[i] = statement + "\n"
+  }
+  return result
+}
+
+// exports the schema as a sql script: every user schema, the schema query
+// parameter, or the table query parameter with its sequences, indexes,
+// constraints and triggers
+func (server *PgServer) ddl(w http.ResponseWriter, r *http.Request) {
+  ctx := r.Context()
+  query := r.URL.Query()
+  schema := query.Get("schema")
+  var oid uint32
+  if table := query.Get("table"); table != "" {
+    var err error
+    oid, err = server.table_oid(ctx, schema, table)
+    if err == errTableNotFound {
+      http.Error(w, fmt.Sprintf("error no such table '%s'", table),
+        http.StatusNotFound)
+      return
+    }
+    if check_err(ctx, w, err, "getting table") {
+      return
+    }
+    schema = ""
+  } else if schema != "" {
+    var exists bool
+    err := server.db(ctx).QueryRow(ctx, "SELECT EXISTS (SELECT 1 " +
+      "FROM pg_namespace WHERE nspname = $1)", schema).Scan(&exists)
+    if check_err(ctx, w, err, "getting schema") {
+      return
+    }
+    if !exists {
+      http.Error(w, fmt.Sprintf("error no such schema '%s'", schema),
+        http.StatusNotFound)
+      return
+    }
+  }
+  script, err := server.export_ddl(ctx, schema, oid)
+  if check_err(ctx, w, err, "exporting ddl") {
+    return
+  }
+  w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+  fmt.Fprint(w, script)
+}
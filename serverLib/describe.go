@@ -0,0 +1,113 @@
+package server
+
+import (
+  "context"
+  "fmt"
+  "net/http"
+)
+
+import (
+  "github.com/georgysavva/scany/v2/pgxscan"
+  "github.com/jackc/pgx/v5"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+// the metadata of the columns of the relation with oid, in column order
+const column_metadata_sql = "SELECT c.table_schema, c.table_name, " +
+  "c.column_name, c.ordinal_position, c.data_type, c.udt_name, " +
+  "c.character_maximum_length, c.numeric_precision, c.numeric_scale, " +
+  "c.collation_name, c.is_nullable, c.column_default, c.is_identity, " +
+  "c.identity_generation, c.is_generated, c.generation_expression, " +
+  "EXISTS (SELECT 1 FROM pg_index i WHERE i.indrelid = a.attrelid " +
+  "AND i.indisprimary AND a.attnum = ANY(i.indkey)) AS is_primary_key, " +
+  "coalesce((SELECT json_agg(json_build_object('Constraint', con.conname, " +
+  "'Schema', rn.nspname, 'Table', rc.relname, 'Column', ra.attname) " +
+  "ORDER BY con.conname) FROM pg_constraint con " +
+  "JOIN unnest(con.conkey, con.confkey) AS k(attnum, refnum) " +
+  "ON k.attnum = a.attnum " +
+  "JOIN pg_class rc ON rc.oid = con.confrelid " +
+  "JOIN pg_namespace rn ON rn.oid = rc.relnamespace " +
+  "JOIN pg_attribute ra ON ra.attrelid = con.confrelid " +
+  "AND ra.attnum = k.refnum " +
+  "WHERE con.conrelid = a.attrelid AND con.contype = 'f'), '[]') " +
+  "AS foreign_keys, " +
+  "col_description(a.attrelid, a.attnum) AS comment " +
+  "FROM pg_attribute a JOIN pg_class cl ON cl.oid = a.attrelid " +
+  "JOIN pg_namespace n ON n.oid = cl.relnamespace " +
+  "JOIN information_schema.columns c ON c.table_schema = n.nspname " +
+  "AND c.table_name = cl.relname AND c.column_name = a.attname " +
+  "WHERE a.attrelid = $1 AND a.attnum > 0 AND NOT a.attisdropped " +
+  "ORDER BY a.attnum"
+
+// the oid of the table in schema, or on the search path when schema is empty
+func (server *PgServer) table_oid(
+  ctx context.Context, schema string, table_name string,
+) (uint32, error) {
+  ident := pgx.Identifier{table_name}
+  if schema != "" {
+    ident = pgx.Identifier{schema, table_name}
+  }
+  var oid *uint32
+  err := server.db(ctx).QueryRow(ctx, "SELECT to_regclass($1)::oid",
+    ident.Sanitize()).Scan(&oid)
+  if err != nil {
+    return 0, err
+  }
+  if oid == nil {
+    return 0, errTableNotFound
+  }
+  return *oid, nil
+}
+
+func (server *PgServer) column_metadata(ctx context.Context, oid uint32) (
+  []pgrest.Column, error,
+) {
+  columns := make([]pgrest.Column, 0)
+  err := pgxscan.Select(ctx, server.db(ctx), &columns, column_metadata_sql,
+    oid)
+  return columns, err
+}
+
+// describes a table and its columns
+func (server *PgServer) d(w http.ResponseWriter, r *http.Request) {
+  var req_table pgrest.ReqTable
+  if !unmarshal_body(w, r, &req_table) {
+    return
+  }
+  oid, err := server.table_oid(r.Context(), req_table.Schema,
+    req_table.TableName)
+  if err == errTableNotFound {
+    http.Error(w, fmt.Sprintf("error no such table '%s'",
+      req_table.TableName), http.StatusNotFound)
+    return
+  }
+  if check_err(r.Context(), w, err, "getting table") {
+    return
+  }
+  var table pgrest.TableDescription
+  err = pgxscan.Get(r.Context(), server.db(r.Context()), &table,
+    "SELECT n.nspname AS schemaname, c.relname AS tablename, " +
+    "CASE c.relkind WHEN 'r' THEN 'table' WHEN 'p' THEN 'partitioned table' " +
+    "WHEN 'v' THEN 'view' WHEN 'm' THEN 'materialized view' " +
+    "WHEN 'f' THEN 'foreign table' ELSE c.relkind::text END AS kind, " +
+    "pg_get_userbyid(c.relowner) AS owner, " +
+    "obj_description(c.oid, 'pg_class') AS comment, " +
+    "coalesce((SELECT array_agg(a.attname::text " +
+    "ORDER BY array_position(i.indkey::int2[], a.attnum)) " +
+    "FROM pg_index i JOIN pg_attribute a ON a.attrelid = i.indrelid " +
+    "AND a.attnum = ANY(i.indkey) " +
+    "WHERE i.indrelid = c.oid AND i.indisprimary), '{}') AS primary_key " +
+    "FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace " +
+    "WHERE c.oid = $1", oid)
+  if check_err(r.Context(), w, err, "getting table") {
+    return
+  }
+  table.Columns, err = server.column_metadata(r.Context(), oid)
+  if check_err(r.Context(), w, err, "getting columns") {
+    return
+  }
+  send_json(r.Context(), w, table, "table")
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+  "context"
+  "fmt"
+  "net/http"
+  "strings"
+)
+
+import (
+  "github.com/georgysavva/scany/v2/pgxscan"
+  "github.com/jackc/pgx/v5"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+// a foreign key relating an embedding table to an embedded one; Columns are
+// on the table with the key, Ref_columns on the table it references
+type foreign_key struct {
+  Name        string
+  Many_to_one bool
+  Columns     []string
+  Ref_columns []string
+}
+
+// a read the request got wrong, like an unknown column or an ambiguous embed
+type read_error struct {
+  status int
+  msg    string
+}
+
+func (err *read_error) Error() string {
+  return err.msg
+}
+
+// builds the query of a read; values of the filters at every level go to args.
+// table and key look up the tables of the read and the foreign keys of its
+// embeds, the read_table and embed_key of a server
+type read_builder struct {
+  table func(ctx context.Context, name string) (*resource_table, error)
+  key   func(ctx context.Context, parent *resource_table,
+    table *resource_table, name string) (*foreign_key, error)
+  args  []interface{}
+}
+
+// the query of a read and its arguments, with each embed as a correlated
+// subquery returning json
+func (server *PgServer) read_query(
+  ctx context.Context, read pgrest.ReadColumns,
+) (string, []interface{}, error) {
+  builder := read_builder { table: server.read_table, key: server.embed_key }
+  return builder.read_query(ctx, read)
+}
+
+func (builder *read_builder) read_query(
+  ctx context.Context, read pgrest.ReadColumns,
+) (string, []interface{}, error) {
+  table, err := builder.table(ctx, read.TableName)
+  if err != nil {
+    return "", nil, err
+  }
+  query, err := builder.select_stmt(ctx, table, 0, read.ColumnNames,
+    read.Embed, nil, read.Filters, read.Order, read.Limit)
+  if err != nil {
+    return "", nil, err
+  }
+  return query, builder.args, nil
+}
+
+func (server *PgServer) read_table(
+  ctx context.Context, table_name string,
+) (*resource_table, error) {
+  table, err := server.get_resource_table(ctx, table_name)
+  if err == errTableNotFound {
+    return nil, &read_error { http.StatusNotFound,
+      fmt.Sprintf("error no such table '%s'", table_name) }
+  }
+  return table, err
+}
+
+// SELECT of the columns and embeds of table, aliased t<level>, restricted by
+// the join conditions conds and the filters
+func (builder *read_builder) select_stmt(
+  ctx context.Context, table *resource_table, level int, columns []string,
+  embeds []pgrest.ReadEmbed, conds []string, filters []pgrest.Filter,
+  order string, limit *uint64,
+) (string, error) {
+  alias := fmt.Sprintf("t%d", level)
+  sel_cols := pgx.Identifier{alias}.Sanitize() + ".*"
+  if len(columns) > 0 {
+    idents := make([]string, len(columns))
+    for i, column := range columns {
+      var err error
+      idents[i], err = table.column_ident(column)
+      if err != nil {
+        return "", &read_error { http.StatusBadRequest, err.Error() }
+      }
+    }
+    sel_cols = strings.Join(idents, ", ")
+  }
+  for _, embed := range embeds {
+    name := embed.As
+    if name == "" {
+      name = embed.TableName
+    }
+    if _, ok := table.columns[name]; ok {
+      return "", &read_error { http.StatusBadRequest, fmt.Sprintf("error " +
+        "embed '%s' has the name of a column of table '%s', set As", name,
+        table.name) }
+    }
+    subquery, err := builder.embed_subquery(ctx, table, level, embed)
+    if err != nil {
+      return "", err
+    }
+    sel_cols += ", " + subquery + " AS " + pgx.Identifier{name}.Sanitize()
+  }
+  where, err := table.where_clause(filters, &builder.args)
+  if err != nil {
+    return "", &read_error { http.StatusBadRequest, err.Error() }
+  }
+  if len(conds) > 0 {
+    if where == "" {
+      where = " WHERE " + strings.Join(conds, " AND ")
+    } else {
+      where += " AND " + strings.Join(conds, " AND ")
+    }
+  }
+  order_by, err := table.order_clause(order)
+  if err != nil {
+    return "", &read_error { http.StatusBadRequest, err.Error() }
+  }
+  query := fmt.Sprintf("SELECT %s FROM %s AS %s%s%s", sel_cols, table.ident,
+    pgx.Identifier{alias}.Sanitize(), where, order_by)
+  if limit != nil {
+    query += fmt.Sprintf(" LIMIT %d", *limit)
+  }
+  return query, nil
+}
+
+// the subquery of an embed in the rows of parent, aliased t<level>: the
+// referenced row as a json object or the referencing rows as a json array
+func (builder *read_builder) embed_subquery(
+  ctx context.Context, parent *resource_table, level int,
+  embed pgrest.ReadEmbed,
+) (string, error) {
+  if embed.TableName == "" {
+    return "", &read_error { http.StatusBadRequest,
+      "error embed without a TableName" }
+  }
+  table, err := builder.table(ctx, embed.TableName)
+  if err != nil {
+    return "", err
+  }
+  key, err := builder.key(ctx, parent, table, embed.ForeignKey)
+  if err != nil {
+    return "", err
+  }
+  outer := fmt.Sprintf("t%d", level)
+  inner := fmt.Sprintf("t%d", level + 1)
+  conds := make([]string, len(key.Columns))
+  for i := range key.Columns {
+    if key.Many_to_one {
+      conds[i] = pgx.Identifier{inner, key.Ref_columns[i]}.Sanitize() +
+        " = " + pgx.Identifier{outer, key.Columns[i]}.Sanitize()
+    } else {
+      conds[i] = pgx.Identifier{inner, key.Columns[i]}.Sanitize() +
+        " = " + pgx.Identifier{outer, key.Ref_columns[i]}.Sanitize()
+    }
+  }
+  rows := fmt.Sprintf("e%d", level + 1)
+  if key.Many_to_one {
+    if embed.Order != "" || embed.Limit != nil {
+      return "", &read_error { http.StatusBadRequest, fmt.Sprintf("error " +
+        "embed '%s' is a single row, Order and Limit only apply to arrays",
+        embed.TableName) }
+    }
+    query, err := builder.select_stmt(ctx, table, level + 1,
+      embed.ColumnNames, embed.Embed, conds, embed.Filters, "", nil)
+    if err != nil {
+      return "", err
+    }
+    return fmt.Sprintf("(SELECT row_to_json(%s) FROM (%s) AS %s)", rows,
+      query, rows), nil
+  }
+  query, err := builder.select_stmt(ctx, table, level + 1, embed.ColumnNames,
+    embed.Embed, conds, embed.Filters, embed.Order, embed.Limit)
+  if err != nil {
+    return "", err
+  }
+  // json_agg keeps the order of the rows of the ordered subquery
+  return fmt.Sprintf("(SELECT coalesce(json_agg(%s), '[]') FROM (%s) AS %s)",
+    rows, query, rows), nil
+}
+
+// the foreign key relating parent and table, either way, named name if it is
+// not empty; a self-referencing key is many-to-one
+func (server *PgServer) embed_key(
+  ctx context.Context, parent *resource_table, table *resource_table,
+  name string,
+) (*foreign_key, error) {
+  keys := make([]*foreign_key, 0)
+  err := pgxscan.Select(ctx, server.db(ctx), &keys,
+    "SELECT c.conname AS name, c.conrelid = $1 AS many_to_one, " +
+    "array(SELECT a.attname FROM unnest(c.conkey) WITH ORDINALITY " +
+    "AS k(attnum, n) JOIN pg_attribute a ON a.attrelid = c.conrelid " +
+    "AND a.attnum = k.attnum ORDER BY k.n)::text[] AS columns, " +
+    "array(SELECT a.attname FROM unnest(c.confkey) WITH ORDINALITY " +
+    "AS k(attnum, n) JOIN pg_attribute a ON a.attrelid = c.confrelid " +
+    "AND a.attnum = k.attnum ORDER BY k.n)::text[] AS ref_columns " +
+    "FROM pg_constraint c WHERE c.contype = 'f' " +
+    "AND (c.conrelid = $1 AND c.confrelid = $2 " +
+    "OR c.conrelid = $2 AND c.confrelid = $1) " +
+    "AND ($3 = '' OR c.conname = $3) ORDER BY c.conname",
+    parent.oid, table.oid, name)
+  if err != nil {
+    return nil, err
+  }
+  switch {
+    case len(keys) == 0 && name != "":
+      return nil, &read_error { http.StatusBadRequest, fmt.Sprintf("error " +
+        "no foreign key '%s' relates tables '%s' and '%s'", name, parent.name,
+        table.name) }
+    case len(keys) == 0:
+      return nil, &read_error { http.StatusBadRequest, fmt.Sprintf("error " +
+        "no foreign key relates tables '%s' and '%s'", parent.name,
+        table.name) }
+    case len(keys) > 1:
+      names := make([]string, len(keys))
+      for i, key := range keys {
+        names[i] = key.Name
+      }
+      return nil, &read_error { http.StatusBadRequest, fmt.Sprintf("error " +
+        "foreign keys %s relate tables '%s' and '%s', set ForeignKey",
+        strings.Join(names, ", "), parent.name, table.name) }
+  }
+  return keys[0], nil
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "net/http"
+  "reflect"
+  "testing"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+var test_tables = map[string]*resource_table {
+  "users": {
+    oid: 1, name: "users", ident: `"public"."users"`,
+    columns: map[string]string {
+      "id": "integer", "name": "text", "manager_id": "integer",
+    },
+    primary_key: []string { "id" },
+  },
+  "posts": {
+    oid: 2, name: "posts", ident: `"public"."posts"`,
+    columns: map[string]string {
+      "id": "integer", "user_id": "integer", "title": "text",
+    },
+    primary_key: []string { "id" },
+  },
+}
+
+// posts.user_id references users.id and users.manager_id users.id
+func test_read_builder() *read_builder {
+  table := func(ctx context.Context, name string) (*resource_table, error) {
+    table, ok := test_tables[name]
+    if !ok {
+      return nil, &read_error { http.StatusNotFound,
+        fmt.Sprintf("error no such table '%s'", name) }
+    }
+    return table, nil
+  }
+  key := func(
+    ctx context.Context, parent *resource_table, table *resource_table,
+    name string,
+  ) (*foreign_key, error) {
+    switch parent.name + "/" + table.name {
+      case "posts/users":
+        return &foreign_key { "posts_user_id_fkey", true,
+          []string { "user_id" }, []string { "id" } }, nil
+      case "users/posts":
+        return &foreign_key { "posts_user_id_fkey", false,
+          []string { "user_id" }, []string { "id" } }, nil
+      case "users/users":
+        return &foreign_key { "users_manager_id_fkey", true,
+          []string { "manager_id" }, []string { "id" } }, nil
+    }
+    return nil, &read_error { http.StatusBadRequest, "error no foreign key" }
+  }
+  return &read_builder { table: table, key: key }
+}
+
+func TestReadQuery(t *testing.T) {
+  two := uint64(2)
+  ten := uint64(10)
+  tests := []struct {
+    name  string
+    read  pgrest.ReadColumns
+    query string
+    args  []interface{}
+  } {
+    {
+      name: "columns",
+      read: pgrest.ReadColumns {
+        TableName: "users", ColumnNames: []string { "id", "name" },
+        Filters: []pgrest.Filter {
+          { ColumnName: "id", Op: "in", Values: []string { "1", "2" } },
+        },
+        Order: "name.desc", Limit: &ten,
+      },
+      query: `SELECT "id", "name" FROM "public"."users" AS "t0" ` +
+        `WHERE "id" IN ($1::integer, $2::integer) ORDER BY "name" DESC ` +
+        `LIMIT 10`,
+      args: []interface{} { "1", "2" },
+    },
+    {
+      name: "one-to-many embed",
+      read: pgrest.ReadColumns {
+        TableName: "users", ColumnNames: []string { "id", "name" },
+        Filters: []pgrest.Filter {
+          { ColumnName: "name", Op: "eq", Value: "bob" },
+        },
+        Embed: []pgrest.ReadEmbed {
+          {
+            TableName: "posts", ColumnNames: []string { "title" },
+            Filters: []pgrest.Filter {
+              { ColumnName: "title", Op: "like", Value: "%a%" },
+            },
+            Order: "title.desc", Limit: &two,
+          },
+        },
+      },
+      query: `SELECT "id", "name", (SELECT coalesce(json_agg(e1), '[]') ` +
+        `FROM (SELECT "title" FROM "public"."posts" AS "t1" ` +
+        `WHERE "title"::text LIKE $1 AND "t1"."user_id" = "t0"."id" ` +
+        `ORDER BY "title" DESC LIMIT 2) AS e1) AS "posts" ` +
+        `FROM "public"."users" AS "t0" WHERE "name" = $2::text`,
+      args: []interface{} { "%a%", "bob" },
+    },
+    {
+      name: "nested many-to-one embeds",
+      read: pgrest.ReadColumns {
+        TableName: "posts", Order: "id", Limit: &ten,
+        Embed: []pgrest.ReadEmbed {
+          {
+            TableName: "users", As: "author",
+            ColumnNames: []string { "name" },
+            Embed: []pgrest.ReadEmbed {
+              {
+                TableName: "users", As: "manager",
+                ColumnNames: []string { "name" },
+              },
+            },
+          },
+        },
+      },
+      query: `SELECT "t0".*, (SELECT row_to_json(e1) FROM (SELECT "name", ` +
+        `(SELECT row_to_json(e2) FROM (SELECT "name" ` +
+        `FROM "public"."users" AS "t2" ` +
+        `WHERE "t2"."id" = "t1"."manager_id") AS e2) AS "manager" ` +
+        `FROM "public"."users" AS "t1" WHERE "t1"."id" = "t0"."user_id") ` +
+        `AS e1) AS "author" FROM "public"."posts" AS "t0" ` +
+        `ORDER BY "id" ASC LIMIT 10`,
+    },
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      query, args, err := test_read_builder().read_query(context.Background(),
+        test.read)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if query != test.query {
+        t.Errorf("query\n%s\nexpected\n%s", query, test.query)
+      }
+      if !reflect.DeepEqual(args, test.args) {
+        t.Errorf("args %v, expected %v", args, test.args)
+      }
+    })
+  }
+}
+
+func TestReadQueryErrors(t *testing.T) {
+  one := uint64(1)
+  tests := []struct {
+    name   string
+    read   pgrest.ReadColumns
+    status int
+  } {
+    {
+      name: "unknown table",
+      read: pgrest.ReadColumns { TableName: "nope" },
+      status: http.StatusNotFound,
+    },
+    {
+      name: "unknown column",
+      read: pgrest.ReadColumns {
+        TableName: "users", ColumnNames: []string { "nope" },
+      },
+      status: http.StatusBadRequest,
+    },
+    {
+      name: "unknown filter operator",
+      read: pgrest.ReadColumns {
+        TableName: "users",
+        Filters: []pgrest.Filter { { ColumnName: "id", Op: "near" } },
+      },
+      status: http.StatusBadRequest,
+    },
+    {
+      name: "bad order",
+      read: pgrest.ReadColumns { TableName: "users", Order: "id.up" },
+      status: http.StatusBadRequest,
+    },
+    {
+      name: "embed without a table",
+      read: pgrest.ReadColumns {
+        TableName: "users", Embed: []pgrest.ReadEmbed { {} },
+      },
+      status: http.StatusBadRequest,
+    },
+    {
+      name: "embed named like a column",
+      read: pgrest.ReadColumns {
+        TableName: "users",
+        Embed: []pgrest.ReadEmbed { { TableName: "posts", As: "name" } },
+      },
+      status: http.StatusBadRequest,
+    },
+    {
+      name: "limit of a single row",
+      read: pgrest.ReadColumns {
+        TableName: "posts",
+        Embed: []pgrest.ReadEmbed { { TableName: "users", Limit: &one } },
+      },
+      status: http.StatusBadRequest,
+    },
+    {
+      name: "unknown column of an embed",
+      read: pgrest.ReadColumns {
+        TableName: "users",
+        Embed: []pgrest.ReadEmbed {
+          { TableName: "posts", Order: "nope" },
+        },
+      },
+      status: http.StatusBadRequest,
+    },
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      query, _, err := test_read_builder().read_query(context.Background(),
+        test.read)
+      var read_err *read_error
+      if !errors.As(err, &read_err) {
+        t.Fatalf("query %q and error %v, expected a read error", query, err)
+      }
+      if read_err.status != test.status {
+        t.Errorf("status %d, expected %d", read_err.status, test.status)
+      }
+    })
+  }
+}
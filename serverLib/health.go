@@ -0,0 +1,81 @@
+package server
+
+import (
+  "context"
+  "net/http"
+  "time"
+)
+
+import (
+  json "github.com/goccy/go-json"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+const readiness_ping_timeout = 2 * time.Second
+
+// stops /readyz from reporting ready, so load balancers stop sending requests
+// while the http server drains, and ends notification subscriptions and
+// change streams, which would otherwise keep the drain waiting
+func (server *PgServer) Drain() {
+  server.draining.Store(true)
+  server.notifier.close()
+  server.stop_streams()
+}
+
+// the process is up; no database access, no auth
+func (server *PgServer) healthz(w http.ResponseWriter, r *http.Request) {
+  send_health(w, http.StatusOK, &pgrest.Health { Status: "ok" })
+}
+
+// ready unless draining, the pool is saturated or Postgres does not answer a
+// ping
+func (server *PgServer) readyz(w http.ResponseWriter, r *http.Request) {
+  stat := server.pool.Stat()
+  health := &pgrest.Health {
+    Status: "ready",
+    Pool: &pgrest.PoolStats {
+      TotalConns: stat.TotalConns(),
+      AcquiredConns: stat.AcquiredConns(),
+      IdleConns: stat.IdleConns(),
+      ConstructingConns: stat.ConstructingConns(),
+      MaxConns: stat.MaxConns(),
+    },
+  }
+  if stat.MaxConns() > 0 {
+    health.Pool.Saturation =
+      float64(stat.AcquiredConns()) / float64(stat.MaxConns())
+  }
+  if server.draining.Load() {
+    health.Status = "draining"
+    send_health(w, http.StatusServiceUnavailable, health)
+    return
+  }
+  if stat.AcquiredConns() >= stat.MaxConns() {
+    // a ping would wait for a connection
+    health.Status = "saturated"
+    send_health(w, http.StatusServiceUnavailable, health)
+    return
+  }
+  ctx, cancel := context.WithTimeout(r.Context(), readiness_ping_timeout)
+  defer cancel()
+  err := server.pool.Ping(ctx)
+  if err != nil {
+    err_string := err.Error()
+    health.Status = "unavailable"
+    health.Error = &err_string
+    send_health(w, http.StatusServiceUnavailable, health)
+    return
+  }
+  send_health(w, http.StatusOK, health)
+}
+
+func send_health(w http.ResponseWriter, status int, health *pgrest.Health) {
+  s, _ := json.Marshal(health)
+  w.Header().Set("Content-Type", "application/json")
+  w.Header().Set("Cache-Control", "no-store")
+  w.WriteHeader(status)
+  w.Write(s)
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+  "bytes"
+  "context"
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "strings"
+  "sync"
+  "time"
+)
+
+import (
+  "github.com/jackc/pgx/v5"
+)
+
+const idempotency_header = "Idempotency-Key"
+
+const default_idempotency_retention = 24 * time.Hour
+
+const idempotency_table_ddl = `
+CREATE SCHEMA IF NOT EXISTS pgrest;
+CREATE TABLE IF NOT EXISTS pgrest.idempotency_keys (
+  key          text PRIMARY KEY,
+  request_hash text NOT NULL,
+  status       int NOT NULL,
+  content_type text NOT NULL,
+  response     bytea NOT NULL,
+  created_at   timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at
+  ON pgrest.idempotency_keys (created_at)`
+
+// how often expired keys are deleted
+const idempotency_prune_interval = time.Minute
+
+// stored responses are replayed for repeated keys within the retention
+// window; the table is created on first use
+type idempotency_store struct {
+  retention time.Duration
+  mutex     sync.Mutex
+  created   bool
+  pruned    time.Time
+}
+
+func (store *idempotency_store) create_table(
+  ctx context.Context, server *PgServer,
+) error {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if store.created {
+    return nil
+  }
+  _, err := server.pool.Exec(ctx, idempotency_table_ddl)
+  if err != nil {
+    return err
+  }
+  store.created = true
+  return nil
+}
+
+// deletes the expired keys at most once per idempotency_prune_interval, in a
+// statement of its own: in the transaction of a request its row locks would
+// be held for the whole mutation, serializing requests behind the slowest
+func (store *idempotency_store) prune(
+  ctx context.Context, server *PgServer,
+) error {
+  store.mutex.Lock()
+  if time.Since(store.pruned) < idempotency_prune_interval {
+    store.mutex.Unlock()
+    return nil
+  }
+  store.pruned = time.Now()
+  store.mutex.Unlock()
+  retention := fmt.Sprintf("%d milliseconds", store.retention.Milliseconds())
+  _, err := server.pool.Exec(ctx, "DELETE FROM pgrest.idempotency_keys " +
+    "WHERE created_at < now() - $1::interval", retention)
+  return err
+}
+
+// buffers a response so it is only sent once the transaction has committed
+type response_recorder struct {
+  header http.Header
+  status int
+  body   bytes.Buffer
+}
+
+func (rec *response_recorder) Header() http.Header {
+  return rec.header
+}
+
+func (rec *response_recorder) WriteHeader(status int) {
+  if rec.status == 0 {
+    rec.status = status
+  }
+}
+
+func (rec *response_recorder) Write(b []byte) (int, error) {
+  if rec.status == 0 {
+    rec.status = http.StatusOK
+  }
+  return rec.body.Write(b)
+}
+
+func (rec *response_recorder) send(w http.ResponseWriter) {
+  for key, values := range rec.header {
+    w.Header()[key] = values
+  }
+  if rec.status == 0 {
+    rec.status = http.StatusOK
+  }
+  w.WriteHeader(rec.status)
+  w.Write(rec.body.Bytes())
+}
+
+// true for requests that change the database and accept an idempotency key.
+// /createSlot is left out: a slot isn't rolled back with the transaction of
+// the key
+func is_mutating(r *http.Request) bool {
+  switch r.URL.Path {
+    case "/create", "/createIndex", "/dropIndex", "/insert", "/upsert",
+      "/delete", "/own", "/add", "/execSql", "/exec", "/notify", "/dropSlot",
+      "/createPublication", "/dropPublication", "/ackChanges", "/migrate":
+      return r.Method == "POST"
+  }
+  if strings.HasPrefix(r.URL.Path, "/query/") ||
+    strings.HasPrefix(r.URL.Path, "/rpc/") {
+    return r.Method == "POST"
+  }
+  if strings.HasPrefix(r.URL.Path, "/tables/") {
+    return r.Method != "GET" && r.Method != "HEAD"
+  }
+  return false
+}
+
+// runs handler in a transaction that also records the idempotency key and the
+// response, or replays the recorded response if the key was seen before. Keys
+// are scoped to the caller, its client certificate role or IP address, so
+// another caller sending the same key runs the request as itself
+func (server *PgServer) with_idempotency_key(
+  w http.ResponseWriter, r *http.Request, role string, key string,
+  handler func(http.ResponseWriter, *http.Request),
+) {
+  if len(key) > 255 {
+    http.Error(w, "error idempotency key longer than 255 characters",
+      http.StatusBadRequest)
+    return
+  }
+  key = quota_identity(r, role) + " " + key
+  body, err := ioutil.ReadAll(r.Body)
+  if check_err(r.Context(), w, err, "reading request body") {
+    return
+  }
+  r.Body.Close()
+  r.Body = ioutil.NopCloser(bytes.NewReader(body))
+  hash := sha256.New()
+  fmt.Fprintf(hash, "%s %s\n", r.Method, r.URL.RequestURI())
+  hash.Write(body)
+  request_hash := hex.EncodeToString(hash.Sum(nil))
+  ctx := r.Context()
+  store := server.idempotency
+  err = store.create_table(ctx, server)
+  if check_err(r.Context(), w, err, "creating idempotency key table") {
+    return
+  }
+  err = store.prune(ctx, server)
+  if check_err(r.Context(), w, err, "deleting expired idempotency keys") {
+    return
+  }
+  tx, err := server.db(ctx).Begin(ctx)
+  if check_err(r.Context(), w, err, "beginning transaction") {
+    return
+  }
+  defer tx.Rollback(ctx)
+  // serializes concurrent requests with the same key
+  _, err = tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", key)
+  if check_err(r.Context(), w, err, "locking idempotency key") {
+    return
+  }
+  // keys pruning hasn't reached yet are expired too
+  retention := fmt.Sprintf("%d milliseconds", store.retention.Milliseconds())
+  var stored_hash, content_type string
+  var status int
+  var response []byte
+  err = tx.QueryRow(ctx, "SELECT request_hash, status, content_type, " +
+    "response FROM pgrest.idempotency_keys WHERE key = $1 " +
+    "AND created_at >= now() - $2::interval", key, retention).Scan(
+    &stored_hash, &status, &content_type, &response)
+  if err == nil {
+    if stored_hash != request_hash {
+      http.Error(w, "error idempotency key was used for a different request",
+        http.StatusUnprocessableEntity)
+      return
+    }
+    request_logger(ctx).Info("replaying response for idempotency key",
+      "key", key)
+    if content_type != "" {
+      w.Header().Set("Content-Type", content_type)
+    }
+    w.Header().Set("Idempotent-Replayed", "true")
+    w.WriteHeader(status)
+    w.Write(response)
+    return
+  }
+  if err != pgx.ErrNoRows && check_err(r.Context(), w, err, "getting idempotency key") {
+    return
+  }
+  rec := &response_recorder { header: make(http.Header) }
+  handler(rec, r.WithContext(context.WithValue(ctx, tx_key{}, tx)))
+  if rec.status == 0 {
+    rec.status = http.StatusOK
+  }
+  if rec.status < 200 || rec.status >= 300 {
+    // failed mutations are not recorded, so the request can be retried
+    rec.send(w)
+    return
+  }
+  // replaces an expired key that hasn't been pruned yet
+  _, err = tx.Exec(ctx, "INSERT INTO pgrest.idempotency_keys " +
+    "(key, request_hash, status, content_type, response) " +
+    "VALUES ($1, $2, $3, $4, $5) ON CONFLICT (key) DO UPDATE SET " +
+    "request_hash = excluded.request_hash, status = excluded.status, " +
+    "content_type = excluded.content_type, response = excluded.response, " +
+    "created_at = now()", key, request_hash, rec.status,
+    rec.header.Get("Content-Type"), rec.body.Bytes())
+  if check_err(r.Context(), w, err, "storing idempotency key") {
+    return
+  }
+  err = tx.Commit(ctx)
+  if check_err(r.Context(), w, err, "committing transaction") {
+    return
+  }
+  rec.send(w)
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+  "errors"
+  "net/http"
+  "strings"
+)
+
+import (
+  "github.com/jackc/pgx/v5"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+var index_methods = map[string]bool {
+  "btree": true, "hash": true, "gist": true, "spgist": true, "gin": true,
+  "brin": true,
+}
+
+// a possibly schema qualified name
+func qualified_ident(schema string, name string) string {
+  if schema == "" {
+    return pgx.Identifier{name}.Sanitize()
+  }
+  return pgx.Identifier{schema, name}.Sanitize()
+}
+
+// an index column or expression with its operator class and order
+func index_column_sql(column pgrest.IndexColumn) (string, error) {
+  var item string
+  switch {
+    case column.ColumnName != "" && column.Expression != "":
+      return "", errors.New("index column with both a ColumnName and an " +
+        "Expression")
+    case column.ColumnName != "":
+      item = pgx.Identifier{column.ColumnName}.Sanitize()
+    case column.Expression != "":
+      item = "(" + column.Expression + ")"
+    default:
+      return "", errors.New("index column without a ColumnName or an " +
+        "Expression")
+  }
+  if column.Opclass != "" {
+    item += " " + pgx.Identifier(strings.Split(column.Opclass, ".")).Sanitize()
+  }
+  switch order := strings.ToUpper(column.Order); order {
+    case "":
+    case "ASC", "DESC":
+      item += " " + order
+    default:
+      return "", errors.New("index column Order must be ASC or DESC")
+  }
+  switch nulls := strings.ToUpper(column.Nulls); nulls {
+    case "":
+    case "FIRST", "LAST":
+      item += " NULLS " + nulls
+    default:
+      return "", errors.New("index column Nulls must be FIRST or LAST")
+  }
+  return item, nil
+}
+
+// the CREATE INDEX statement of an index spec; expressions and the WHERE
+// clause are sql, like the sql of /execSql
+func create_index_stmt(spec pgrest.CreateIndex) (string, error) {
+  if spec.TableName == "" {
+    return "", errors.New("index without a TableName")
+  }
+  columns := spec.Columns
+  if spec.ColumnName != "" {
+    columns = append([]pgrest.IndexColumn {
+      { ColumnName: spec.ColumnName },
+    }, columns...)
+  }
+  if len(columns) == 0 {
+    return "", errors.New("index without columns")
+  }
+  items := make([]string, len(columns))
+  for i, column := range columns {
+    var err error
+    items[i], err = index_column_sql(column)
+    if err != nil {
+      return "", err
+    }
+  }
+  stmt := "CREATE "
+  if spec.Unique {
+    stmt += "UNIQUE "
+  }
+  stmt += "INDEX "
+  if spec.Concurrently {
+    stmt += "CONCURRENTLY "
+  }
+  if spec.IfNotExists {
+    if spec.IndexName == "" {
+      return "", errors.New("IfNotExists without an IndexName")
+    }
+    stmt += "IF NOT EXISTS "
+  }
+  if spec.IndexName != "" {
+    stmt += pgx.Identifier{spec.IndexName}.Sanitize() + " "
+  }
+  stmt += "ON " + qualified_ident(spec.Schema, spec.TableName)
+  if spec.Method != "" {
+    method := strings.ToLower(spec.Method)
+    if !index_methods[method] {
+      return "", errors.New("index Method must be btree, hash, gist, " +
+        "spgist, gin or brin")
+    }
+    stmt += " USING " + method
+  }
+  stmt += " (" + strings.Join(items, ", ") + ")"
+  if len(spec.Include) > 0 {
+    include := make([]string, len(spec.Include))
+    for i, column := range spec.Include {
+      include[i] = pgx.Identifier{column}.Sanitize()
+    }
+    stmt += " INCLUDE (" + strings.Join(include, ", ") + ")"
+  }
+  if spec.Where != "" {
+    stmt += " WHERE " + spec.Where
+  }
+  return stmt, nil
+}
+
+func (server *PgServer) createIndex(w http.ResponseWriter, r *http.Request) {
+  var cre_idx pgrest.CreateIndex
+  if !unmarshal_body(w, r, &cre_idx) {
+    return
+  }
+  stmt, err := create_index_stmt(cre_idx)
+  if err != nil {
+    http.Error(w, "error " + err.Error(), http.StatusBadRequest)
+    return
+  }
+  if cre_idx.Concurrently {
+    server.exec_stmt_no_tx(r.Context(), w, stmt)
+    return
+  }
+  server.exec_stmt(r.Context(), w, stmt)
+}
+
+func (server *PgServer) dropIndex(w http.ResponseWriter, r *http.Request) {
+  var drop_idx pgrest.DropIndex
+  if !unmarshal_body(w, r, &drop_idx) {
+    return
+  }
+  if drop_idx.IndexName == "" {
+    http.Error(w, "error index without an IndexName", http.StatusBadRequest)
+    return
+  }
+  stmt := "DROP INDEX "
+  if drop_idx.Concurrently {
+    stmt += "CONCURRENTLY "
+  }
+  if drop_idx.IfExists {
+    stmt += "IF EXISTS "
+  }
+  stmt += qualified_ident(drop_idx.Schema, drop_idx.IndexName)
+  if drop_idx.Cascade {
+    stmt += " CASCADE"
+  }
+  if drop_idx.Concurrently {
+    server.exec_stmt_no_tx(r.Context(), w, stmt)
+    return
+  }
+  server.exec_stmt(r.Context(), w, stmt)
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+  "context"
+  "net/http"
+  "net/http/httptest"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+import (
+  "github.com/jackc/pgx/v5"
+  "github.com/jackc/pgx/v5/pgconn"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+func TestIndexColumnSql(t *testing.T) {
+  tests := []struct {
+    column pgrest.IndexColumn
+    sql    string
+    err    bool
+  } {
+    { column: pgrest.IndexColumn { ColumnName: "name" }, sql: `"name"` },
+    {
+      column: pgrest.IndexColumn { ColumnName: `we"ird` },
+      sql: `"we""ird"`,
+    },
+    {
+      column: pgrest.IndexColumn { Expression: "lower(email)" },
+      sql: "(lower(email))",
+    },
+    {
+      column: pgrest.IndexColumn {
+        ColumnName: "name", Opclass: "text_pattern_ops", Order: "desc",
+        Nulls: "last",
+      },
+      sql: `"name" "text_pattern_ops" DESC NULLS LAST`,
+    },
+    {
+      column: pgrest.IndexColumn {
+        ColumnName: "tags", Opclass: "public.my_ops", Order: "ASC",
+      },
+      sql: `"tags" "public"."my_ops" ASC`,
+    },
+    {
+      column: pgrest.IndexColumn { ColumnName: "a", Nulls: "First" },
+      sql: `"a" NULLS FIRST`,
+    },
+    { column: pgrest.IndexColumn {}, err: true },
+    {
+      column: pgrest.IndexColumn { ColumnName: "a", Expression: "b" },
+      err: true,
+    },
+    { column: pgrest.IndexColumn { ColumnName: "a", Order: "up" }, err: true },
+    {
+      column: pgrest.IndexColumn { ColumnName: "a", Nulls: "middle" },
+      err: true,
+    },
+  }
+  for _, test := range tests {
+    sql, err := index_column_sql(test.column)
+    if test.err {
+      if err == nil {
+        t.Errorf("index_column_sql(%+v) = %q, expected an error",
+          test.column, sql)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("index_column_sql(%+v): %v", test.column, err)
+    } else if sql != test.sql {
+      t.Errorf("index_column_sql(%+v) = %q, expected %q", test.column, sql,
+        test.sql)
+    }
+  }
+}
+
+func TestCreateIndexStmt(t *testing.T) {
+  tests := []struct {
+    name string
+    spec pgrest.CreateIndex
+    stmt string
+    err  bool
+  } {
+    {
+      name: "column",
+      spec: pgrest.CreateIndex {
+        TableName: "users", IndexName: "users_name", ColumnName: "name",
+      },
+      stmt: `CREATE INDEX "users_name" ON "users" ("name")`,
+    },
+    {
+      name: "unnamed",
+      spec: pgrest.CreateIndex { TableName: "users", ColumnName: "name" },
+      stmt: `CREATE INDEX ON "users" ("name")`,
+    },
+    {
+      name: "column before columns",
+      spec: pgrest.CreateIndex {
+        TableName: "users", ColumnName: "a",
+        Columns: []pgrest.IndexColumn {
+          { Expression: "lower(b)", Order: "desc" },
+        },
+      },
+      stmt: `CREATE INDEX ON "users" ("a", (lower(b)) DESC)`,
+    },
+    {
+      name: "every option",
+      spec: pgrest.CreateIndex {
+        Schema: "app", TableName: "users", IndexName: "users_email",
+        Columns: []pgrest.IndexColumn { { ColumnName: "email" } },
+        Unique: true, Method: "BTREE", Include: []string { "id", "name" },
+        Where: "deleted_at IS NULL", IfNotExists: true, Concurrently: true,
+      },
+      stmt: `CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS ` +
+        `"users_email" ON "app"."users" USING btree ("email") ` +
+        `INCLUDE ("id", "name") WHERE deleted_at IS NULL`,
+    },
+    {
+      name: "gin",
+      spec: pgrest.CreateIndex {
+        TableName: "docs", ColumnName: "body", Method: "gin",
+      },
+      stmt: `CREATE INDEX ON "docs" USING gin ("body")`,
+    },
+    {
+      name: "no table",
+      spec: pgrest.CreateIndex { ColumnName: "a" },
+      err: true,
+    },
+    {
+      name: "no columns",
+      spec: pgrest.CreateIndex { TableName: "users" },
+      err: true,
+    },
+    {
+      name: "bad column",
+      spec: pgrest.CreateIndex {
+        TableName: "users", Columns: []pgrest.IndexColumn { {} },
+      },
+      err: true,
+    },
+    {
+      name: "if not exists without a name",
+      spec: pgrest.CreateIndex {
+        TableName: "users", ColumnName: "a", IfNotExists: true,
+      },
+      err: true,
+    },
+    {
+      name: "bad method",
+      spec: pgrest.CreateIndex {
+        TableName: "users", ColumnName: "a", Method: "btree; DROP TABLE x",
+      },
+      err: true,
+    },
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      stmt, err := create_index_stmt(test.spec)
+      if test.err {
+        if err == nil {
+          t.Fatalf("expected an error, got %q", stmt)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatal(err)
+      }
+      if stmt != test.stmt {
+        t.Errorf("stmt %q, expected %q", stmt, test.stmt)
+      }
+    })
+  }
+}
+
+// a transaction recording the statements run in it
+type recording_tx struct {
+  pgx.Tx
+  sql  []string
+  args [][]interface{}
+}
+
+func (tx *recording_tx) Begin(ctx context.Context) (pgx.Tx, error) {
+  return tx, nil
+}
+
+func (tx *recording_tx) Commit(ctx context.Context) error {
+  return nil
+}
+
+func (tx *recording_tx) Rollback(ctx context.Context) error {
+  return nil
+}
+
+func (tx *recording_tx) Exec(
+  ctx context.Context, sql string, args ...interface{},
+) (pgconn.CommandTag, error) {
+  tx.sql = append(tx.sql, sql)
+  tx.args = append(tx.args, args)
+  return pgconn.NewCommandTag("CREATE INDEX"), nil
+}
+
+func (tx *recording_tx) Query(
+  ctx context.Context, sql string, args ...interface{},
+) (pgx.Rows, error) {
+  tx.sql = append(tx.sql, sql)
+  tx.args = append(tx.args, args)
+  return &empty_rows {}, nil
+}
+
+type empty_rows struct {
+  pgx.Rows
+}
+
+func (rows *empty_rows) Close() {}
+
+func (rows *empty_rows) Err() error {
+  return nil
+}
+
+func (rows *empty_rows) CommandTag() pgconn.CommandTag {
+  return pgconn.NewCommandTag("CREATE INDEX")
+}
+
+// the sql of an index goes over the extended protocol, which refuses a second
+// statement, rather than the simple protocol pgx otherwise uses for
+// statements without arguments
+func TestCreateIndexSingleStatement(t *testing.T) {
+  tx := &recording_tx {}
+  body := `{"TableName":"users","IndexName":"i","ColumnName":"id",` +
+    `"Where":"x > 0; DROP TABLE users"}`
+  r := httptest.NewRequest("POST", "/createIndex", strings.NewReader(body))
+  r = r.WithContext(context.WithValue(r.Context(), tx_key{}, pgx.Tx(tx)))
+  w := httptest.NewRecorder()
+  (&PgServer {}).createIndex(w, r)
+  if w.Code != http.StatusOK {
+    t.Fatalf("status %d: %s", w.Code, w.Body)
+  }
+  stmt := `CREATE INDEX "i" ON "users" ("id") WHERE x > 0; DROP TABLE users`
+  if !reflect.DeepEqual(tx.sql, []string { stmt }) {
+    t.Fatalf("ran %q, expected %q", tx.sql, stmt)
+  }
+  mode := []interface{} { pgx.QueryExecModeExec }
+  if !reflect.DeepEqual(tx.args[0], mode) {
+    t.Errorf("ran with %v, expected %v", tx.args[0], mode)
+  }
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+  "context"
+  "fmt"
+  "net/http"
+  "strings"
+  "time"
+)
+
+import (
+  "github.com/jackc/pgx/v5"
+)
+
+type conn_key struct{}
+
+// a postgres timeout with a server-wide default that requests can override
+// with a header, up to the maximum; zero default means no timeout is set and
+// zero maximum means no cap
+type session_timeout struct {
+  setting string
+  header  string
+  def     time.Duration
+  max     time.Duration
+}
+
+// the value of the timeout for r, or false if it is not set
+func (timeout *session_timeout) value(r *http.Request) (
+  time.Duration, bool, error,
+) {
+  value, set := timeout.def, timeout.def > 0
+  if header := r.Header.Get(timeout.header); header != "" {
+    d, err := time.ParseDuration(header)
+    if err != nil || d < 0 {
+      return 0, false, fmt.Errorf("invalid %s header '%s'", timeout.header,
+        header)
+    }
+    value, set = d, true
+  }
+  if timeout.max > 0 && (value == 0 || value > timeout.max) {
+    // zero disables the timeout, which the maximum does not allow
+    value = timeout.max
+  }
+  return value, set || timeout.max > 0, nil
+}
+
+// the statements setting the session timeouts of r and resetting them
+func (server *PgServer) session_settings(r *http.Request) (
+  []string, []string, error,
+) {
+  var set, reset []string
+  for _, timeout := range server.timeouts {
+    value, ok, err := timeout.value(r)
+    if err != nil {
+      return nil, nil, err
+    }
+    if ok {
+      // rounded up, so a timeout under a millisecond doesn't become zero,
+      // which disables it
+      ms := (value + time.Millisecond - 1) / time.Millisecond
+      set = append(set, fmt.Sprintf("SET %s = %d", timeout.setting, ms))
+      reset = append(reset, "RESET " + timeout.setting)
+    }
+  }
+  return set, reset, nil
+}
+
+// acquires a connection, switches it to role if not empty, applies settings
+// and puts the connection in the request context; the returned function
+// resets the connection and releases it
+func (server *PgServer) with_session(
+  r *http.Request, role string, set []string, reset []string,
+) (*http.Request, func(), error) {
+  ctx := r.Context()
+  conn, err := server.pool.Acquire(ctx)
+  if err != nil {
+    return nil, nil, err
+  }
+  if role != "" {
+    set = append(set, "SET ROLE " + pgx.Identifier{role}.Sanitize())
+    reset = append(reset, "RESET ROLE")
+  }
+  // the simple protocol runs several statements in one round trip
+  err = conn.Conn().PgConn().Exec(ctx, strings.Join(set, "; ")).Close()
+  if err != nil {
+    conn.Release()
+    return nil, nil, err
+  }
+  release := func() {
+    err := conn.Conn().PgConn().Exec(context.Background(),
+      strings.Join(reset, "; ")).Close()
+    if err != nil {
+      // never return a connection with the role or timeouts still set to the
+      // pool
+      request_logger(ctx).Error("error resetting connection", "role", role,
+        "err", err)
+      conn.Conn().Close(context.Background())
+    }
+    conn.Release()
+  }
+  return r.WithContext(context.WithValue(ctx, conn_key{}, conn)), release, nil
+}
+
+const truncated_header = "X-Result-Truncated"
+
+func mark_truncated(w http.ResponseWriter, info *request_info) {
+  info.truncated = true
+  w.Header().Set(truncated_header, "true")
+}
+
+// whether a result of the request in ctx was cut short by the row or byte cap
+func truncated(ctx context.Context) bool {
+  info, ok := ctx.Value(request_info_key{}).(*request_info)
+  return ok && info.truncated
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+  "context"
+  "crypto/rand"
+  "encoding/hex"
+  "log/slog"
+  "net/http"
+  "regexp"
+  "strings"
+  "sync/atomic"
+  "time"
+)
+
+const request_id_header = "X-Request-ID"
+
+// headers whose values are not logged unless Options.RedactHeaders is set
+var default_redact_headers = []string {
+  "Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie",
+}
+
+var request_id_re = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,128}$`)
+
+type request_info_key struct{}
+
+// what is known about a request while it is served; the logger carries the
+// request id
+type request_info struct {
+  id     string
+  logger *slog.Logger
+  role   string
+  rows   atomic.Int64
+  // result caps, see rows_to_jsonl
+  max_rows  int
+  max_bytes int
+  truncated bool
+}
+
+// the logger of the request in ctx, or the default logger outside requests
+func request_logger(ctx context.Context) *slog.Logger {
+  if info, ok := ctx.Value(request_info_key{}).(*request_info); ok {
+    return info.logger
+  }
+  return slog.Default()
+}
+
+// the request id from the client if it looks like one, otherwise a new one
+func request_id(r *http.Request) string {
+  if id := r.Header.Get(request_id_header); request_id_re.MatchString(id) {
+    return id
+  }
+  id := make([]byte, 8)
+  rand.Read(id)
+  return hex.EncodeToString(id)
+}
+
+// logs the outcome of a request; probes and scrapes only at debug level
+func (server *PgServer) log_request(
+  ctx context.Context, r *http.Request, info *request_info, route string,
+  w *metrics_writer, duration time.Duration,
+) {
+  if !server.log_requests {
+    return
+  }
+  level := slog.LevelInfo
+  switch route {
+    case "/healthz", "/readyz", metrics_path:
+      level = slog.LevelDebug
+  }
+  if !info.logger.Enabled(ctx, level) {
+    return
+  }
+  attrs := []slog.Attr {
+    slog.String("method", r.Method),
+    slog.String("path", r.URL.Path),
+    slog.String("route", route),
+    slog.Int("status", w.status),
+    slog.Duration("duration", duration),
+    slog.Int64("rows", info.rows.Load()),
+    slog.Int("bytes", w.bytes),
+    slog.String("remote", r.RemoteAddr),
+  }
+  if info.role != "" {
+    attrs = append(attrs, slog.String("role", info.role))
+  }
+  if server.log_headers {
+    headers := make([]any, 0, len(r.Header))
+    for name, values := range r.Header {
+      value := strings.Join(values, ", ")
+      if server.redact_headers[http.CanonicalHeaderKey(name)] {
+        value = "[redacted]"
+      }
+      headers = append(headers, slog.String(name, value))
+    }
+    attrs = append(attrs, slog.Group("headers", headers...))
+  }
+  info.logger.LogAttrs(ctx, level, "request", attrs...)
+}
+
+// logs every query at debug level and queries slower than the threshold at
+// warn level
+func (tracer *query_tracer) log_query(
+  ctx context.Context, sql string, duration time.Duration, err error,
+) {
+  logger := request_logger(ctx)
+  level := slog.LevelDebug
+  msg := "query"
+  if tracer.slow_query > 0 && duration >= tracer.slow_query {
+    level = slog.LevelWarn
+    msg = "slow query"
+  }
+  if !logger.Enabled(ctx, level) {
+    return
+  }
+  if !tracer.sql_literals {
+    sql = redact_sql(sql)
+  }
+  attrs := []slog.Attr {
+    slog.String("sql", sql), slog.Duration("duration", duration),
+  }
+  if err != nil {
+    attrs = append(attrs, slog.String("err", err.Error()))
+  }
+  logger.LogAttrs(ctx, level, msg, attrs...)
+}
+
+// replaces string, dollar-quoted and numeric literals with ?, keeping quoted
+// identifiers, parameters like $1 and comments
+func redact_sql(sql string) string {
+  var b strings.Builder
+  for i := 0; i < len(sql); {
+    c := sql[i]
+    switch {
+      case c == '\'':
+        // E'' strings escape quotes with backslashes
+        escapes := i > 0 && (sql[i - 1] == 'E' || sql[i - 1] == 'e') &&
+          (i < 2 || !is_ident_byte(sql[i - 2]))
+        j := i + 1
+        for j < len(sql) {
+          if escapes && sql[j] == '\\' {
+            j += 2
+            continue
+          }
+          if sql[j] == '\'' {
+            if j + 1 < len(sql) && sql[j + 1] == '\'' {
+              j += 2
+              continue
+            }
+            break
+          }
+          j++
+        }
+        b.WriteByte('?')
+        i = j + 1
+      case c == '"':
+        end := len(sql)
+        if j := strings.IndexByte(sql[i + 1:], '"'); j >= 0 {
+          end = i + j + 2
+        }
+        b.WriteString(sql[i:end])
+        i = end
+      case c == '-' && i + 1 < len(sql) && sql[i + 1] == '-':
+        j := strings.IndexByte(sql[i:], '\n')
+        if j < 0 {
+          j = len(sql) - i
+        }
+        b.WriteString(sql[i:i + j])
+        i += j
+      case c == '$':
+        tag := dollar_tag(sql[i:])
+        if tag == "" {
+          // a parameter
+          j := i + 1
+          for j < len(sql) && is_digit(sql[j]) {
+            j++
+          }
+          b.WriteString(sql[i:j])
+          i = j
+          continue
+        }
+        end := len(sql)
+        if j := strings.Index(sql[i + len(tag):], tag); j >= 0 {
+          end = i + len(tag) + j + len(tag)
+        }
+        b.WriteByte('?')
+        i = end
+      case is_digit(c) && (i == 0 || !is_ident_byte(sql[i - 1])):
+        j := i
+        for j < len(sql) && (is_digit(sql[j]) || sql[j] == '.' ||
+          sql[j] == 'e' || sql[j] == 'E') {
+          j++
+        }
+        b.WriteByte('?')
+        i = j
+      default:
+        b.WriteByte(c)
+        i++
+    }
+  }
+  return b.String()
+}
+
+// the opening $tag$ of a dollar-quoted string at the start of s, or ""
+func dollar_tag(s string) string {
+  for j := 1; j < len(s); j++ {
+    if s[j] == '$' {
+      return s[:j + 1]
+    }
+    if !is_ident_byte(s[j]) || (j == 1 && is_digit(s[j])) {
+      return ""
+    }
+  }
+  return ""
+}
+
+func is_digit(c byte) bool {
+  return c >= '0' && c <= '9'
+}
+
+func is_ident_byte(c byte) bool {
+  return c == '_' || is_digit(c) || c >= 'a' && c <= 'z' ||
+    c >= 'A' && c <= 'Z' || c >= 0x80
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+  "testing"
+)
+
+func TestRedactSql(t *testing.T) {
+  tests := []struct {
+    sql      string
+    redacted string
+  } {
+    { "SELECT 1", "SELECT ?" },
+    { "SELECT * FROM t WHERE id = $1", "SELECT * FROM t WHERE id = $1" },
+    { "SELECT 'secret', 'it''s'", "SELECT ?, ?" },
+    { `SELECT E'a\'b', e'\\'`, "SELECT E?, e?" },
+    { "SELECT 'unterminated", "SELECT ?" },
+    { "SELECT 3.14, 1e10, .5", "SELECT ?, ?, .?" },
+    { "SELECT col1, t2.x9 FROM t3", "SELECT col1, t2.x9 FROM t3" },
+    { `SELECT "weird 'name' 1" FROM "t"`, `SELECT "weird 'name' 1" FROM "t"` },
+    { "SELECT $$secret$$, $tag$it's $$ 1$tag$", "SELECT ?, ?" },
+    {
+      "SELECT 1 -- keep 'this' 2\nFROM t",
+      "SELECT ? -- keep 'this' 2\nFROM t",
+    },
+    { "INSERT INTO t VALUES ($1, 'a', 42)", "INSERT INTO t VALUES ($1, ?, ?)" },
+  }
+  for _, test := range tests {
+    if redacted := redact_sql(test.sql); redacted != test.redacted {
+      t.Errorf("redact_sql(%q) = %q, expected %q", test.sql, redacted,
+        test.redacted)
+    }
+  }
+}
+
+func TestDollarTag(t *testing.T) {
+  tests := []struct {
+    s   string
+    tag string
+  } {
+    { "$$x$$", "$$" },
+    { "$body$x$body$", "$body$" },
+    { "$1", "" },
+    { "$1a$", "" },
+    { "$a b$", "" },
+    { "$", "" },
+  }
+  for _, test := range tests {
+    if tag := dollar_tag(test.s); tag != test.tag {
+      t.Errorf("dollar_tag(%q) = %q, expected %q", test.s, tag, test.tag)
+    }
+  }
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+  "bufio"
+  "context"
+  "errors"
+  "log/slog"
+  "net"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+import (
+  "github.com/jackc/pgx/v5"
+  "github.com/jackc/pgx/v5/pgconn"
+  "github.com/jackc/pgx/v5/pgxpool"
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/prometheus/client_golang/prometheus/collectors"
+  "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metrics_path = "/metrics"
+
+// route label of requests to unknown paths, and of queries outside requests
+const (
+  unknown_route = "unknown"
+  no_route      = "none"
+)
+
+type route_key struct{}
+
+type query_start_key struct{}
+
+type query_sql_key struct{}
+
+// each server has its own registry, so several servers in one process don't
+// clash
+type server_metrics struct {
+  registry         *prometheus.Registry
+  requests         *prometheus.CounterVec
+  request_duration *prometheus.HistogramVec
+  response_bytes   *prometheus.CounterVec
+  query_duration   *prometheus.HistogramVec
+  rows             *prometheus.CounterVec
+  pg_errors        *prometheus.CounterVec
+}
+
+func make_metrics() *server_metrics {
+  metrics := &server_metrics {
+    registry: prometheus.NewRegistry(),
+    requests: prometheus.NewCounterVec(prometheus.CounterOpts {
+      Name: "pgrest_http_requests_total",
+      Help: "HTTP requests by route, method and status code.",
+    }, []string { "route", "method", "status" }),
+    request_duration: prometheus.NewHistogramVec(prometheus.HistogramOpts {
+      Name: "pgrest_http_request_duration_seconds",
+      Help: "HTTP request latency by route and method.",
+      Buckets: prometheus.DefBuckets,
+    }, []string { "route", "method" }),
+    response_bytes: prometheus.NewCounterVec(prometheus.CounterOpts {
+      Name: "pgrest_http_response_bytes_total",
+      Help: "Bytes written in HTTP response bodies by route.",
+    }, []string { "route" }),
+    query_duration: prometheus.NewHistogramVec(prometheus.HistogramOpts {
+      Name: "pgrest_query_duration_seconds",
+      Help: "Postgres query duration by the route that ran the query.",
+      Buckets: prometheus.DefBuckets,
+    }, []string { "route" }),
+    rows: prometheus.NewCounterVec(prometheus.CounterOpts {
+      Name: "pgrest_query_rows_total",
+      Help: "Rows returned by SELECT and affected by INSERT, UPDATE and " +
+        "DELETE, by route.",
+    }, []string { "route", "kind" }),
+    pg_errors: prometheus.NewCounterVec(prometheus.CounterOpts {
+      Name: "pgrest_pg_errors_total",
+      Help: "Postgres errors by SQLSTATE class (the first two characters).",
+    }, []string { "class" }),
+  }
+  metrics.registry.MustRegister(metrics.requests, metrics.request_duration,
+    metrics.response_bytes, metrics.query_duration, metrics.rows,
+    metrics.pg_errors, collectors.NewGoCollector(),
+    collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+  return metrics
+}
+
+// registers gauges and counters reading the pool statistics at scrape time;
+// pgxpool does not count waiting acquires, so acquires that found the pool
+// empty and the time spent waiting are exported instead
+func (metrics *server_metrics) register_pool(pool *pgxpool.Pool) {
+  gauge := func(name string, help string, f func(*pgxpool.Stat) int32) {
+    metrics.registry.MustRegister(prometheus.NewGaugeFunc(
+      prometheus.GaugeOpts { Name: name, Help: help },
+      func() float64 { return float64(f(pool.Stat())) }))
+  }
+  gauge("pgrest_pool_acquired_conns", "Connections in use.",
+    (*pgxpool.Stat).AcquiredConns)
+  gauge("pgrest_pool_idle_conns", "Idle connections.",
+    (*pgxpool.Stat).IdleConns)
+  gauge("pgrest_pool_constructing_conns", "Connections being opened.",
+    (*pgxpool.Stat).ConstructingConns)
+  gauge("pgrest_pool_total_conns", "Open and opening connections.",
+    (*pgxpool.Stat).TotalConns)
+  gauge("pgrest_pool_max_conns", "Maximum pool size.",
+    (*pgxpool.Stat).MaxConns)
+  metrics.registry.MustRegister(prometheus.NewCounterFunc(
+    prometheus.CounterOpts {
+      Name: "pgrest_pool_empty_acquires_total",
+      Help: "Acquires that waited because no connection was idle.",
+    },
+    func() float64 { return float64(pool.Stat().EmptyAcquireCount()) }))
+  metrics.registry.MustRegister(prometheus.NewCounterFunc(
+    prometheus.CounterOpts {
+      Name: "pgrest_pool_acquire_wait_seconds_total",
+      Help: "Time spent acquiring connections.",
+    },
+    func() float64 { return pool.Stat().AcquireDuration().Seconds() }))
+}
+
+func (server *PgServer) scrapeMetrics(w http.ResponseWriter, r *http.Request) {
+  promhttp.HandlerFor(server.metrics.registry, promhttp.HandlerOpts{}).
+    ServeHTTP(w, r)
+}
+
+// the route label of a path, bounded to the known endpoints
+func route_label(path string) string {
+  name := endpoint_name(path)
+  if name == "/healthz" || name == "/readyz" {
+    return name
+  }
+  for _, known := range endpoint_names {
+    if name == known {
+      return name
+    }
+  }
+  return unknown_route
+}
+
+// records the status and body size of a response
+type metrics_writer struct {
+  http.ResponseWriter
+  status int
+  bytes  int
+}
+
+func (w *metrics_writer) WriteHeader(status int) {
+  if w.status == 0 {
+    w.status = status
+  }
+  w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metrics_writer) Write(b []byte) (int, error) {
+  if w.status == 0 {
+    w.status = http.StatusOK
+  }
+  n, err := w.ResponseWriter.Write(b)
+  w.bytes += n
+  return n, err
+}
+
+// lets http.ResponseController reach the underlying writer
+func (w *metrics_writer) Unwrap() http.ResponseWriter {
+  return w.ResponseWriter
+}
+
+// for websocket upgrades, which assert http.Hijacker rather than use
+// http.ResponseController
+func (w *metrics_writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+  conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+  if err == nil && w.status == 0 {
+    w.status = http.StatusSwitchingProtocols
+  }
+  return conn, rw, err
+}
+
+// runs handler with the route and the request info in the request context,
+// then records the request metrics and logs the request
+func (server *PgServer) instrument(
+  w http.ResponseWriter, r *http.Request,
+  handler func(http.ResponseWriter, *http.Request),
+) {
+  start := time.Now()
+  route := route_label(r.URL.Path)
+  id := request_id(r)
+  info := &request_info {
+    id: id,
+    logger: server.logger.With(slog.String("request_id", id)),
+    max_rows: server.max_rows,
+    max_bytes: server.max_bytes,
+  }
+  w.Header().Set(request_id_header, id)
+  mw := &metrics_writer { ResponseWriter: w }
+  ctx := context.WithValue(r.Context(), route_key{}, route)
+  ctx = context.WithValue(ctx, request_info_key{}, info)
+  handler(mw, r.WithContext(ctx))
+  if mw.status == 0 {
+    mw.status = http.StatusOK
+  }
+  duration := time.Since(start)
+  metrics := server.metrics
+  metrics.requests.WithLabelValues(route, r.Method,
+    strconv.Itoa(mw.status)).Inc()
+  metrics.request_duration.WithLabelValues(route, r.Method).Observe(
+    duration.Seconds())
+  metrics.response_bytes.WithLabelValues(route).Add(float64(mw.bytes))
+  server.log_request(ctx, r, info, route, mw, duration)
+}
+
+// a pgx tracer recording query durations, rows and errors, and logging
+// queries
+type query_tracer struct {
+  metrics      *server_metrics
+  slow_query   time.Duration
+  sql_literals bool
+}
+
+func (tracer *query_tracer) TraceQueryStart(
+  ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData,
+) context.Context {
+  ctx = context.WithValue(ctx, query_sql_key{}, data.SQL)
+  return context.WithValue(ctx, query_start_key{}, time.Now())
+}
+
+func (tracer *query_tracer) TraceQueryEnd(
+  ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData,
+) {
+  route, ok := ctx.Value(route_key{}).(string)
+  if !ok {
+    route = no_route
+  }
+  if start, ok := ctx.Value(query_start_key{}).(time.Time); ok {
+    duration := time.Since(start)
+    tracer.metrics.query_duration.WithLabelValues(route).Observe(
+      duration.Seconds())
+    sql, _ := ctx.Value(query_sql_key{}).(string)
+    tracer.log_query(ctx, sql, duration, data.Err)
+  }
+  var pg_err *pgconn.PgError
+  if errors.As(data.Err, &pg_err) {
+    tracer.metrics.pg_errors.WithLabelValues(pg_err.Code[:2]).Inc()
+  }
+  if data.Err != nil {
+    return
+  }
+  tag := data.CommandTag
+  if tag.Select() {
+    tracer.metrics.rows.WithLabelValues(route, "returned").Add(
+      float64(tag.RowsAffected()))
+  } else if tag.Insert() || tag.Update() || tag.Delete() {
+    tracer.metrics.rows.WithLabelValues(route, "affected").Add(
+      float64(tag.RowsAffected()))
+  } else {
+    return
+  }
+  if info, ok := ctx.Value(request_info_key{}).(*request_info); ok {
+    info.rows.Add(tag.RowsAffected())
+  }
+}
@@ -0,0 +1,373 @@
+package server
+
+import (
+  "context"
+  "crypto/sha256"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "net/http"
+  "os"
+  "path/filepath"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+import (
+  "github.com/georgysavva/scany/v2/pgxscan"
+  "github.com/jackc/pgx/v5/pgxpool"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+const migrations_table_ddl = `
+CREATE SCHEMA IF NOT EXISTS pgrest;
+CREATE TABLE IF NOT EXISTS pgrest.schema_migrations (
+  version    bigint PRIMARY KEY,
+  name       text NOT NULL,
+  checksum   text NOT NULL,
+  applied_at timestamptz NOT NULL DEFAULT now()
+)`
+
+// held by the connection running migrations, so servers sharing a database
+// take turns
+const migrations_lock_key = "hashtext('pgrest.schema_migrations')"
+
+var migration_file_re = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+type migration struct {
+  version  int64
+  name     string
+  up       string
+  down     string
+  has_down bool
+  // sha256 of the up file, recorded when the migration is applied
+  checksum string
+}
+
+type applied_migration struct {
+  Version    int64
+  Name       string
+  Checksum   string
+  Applied_at time.Time
+}
+
+// a migration action that can't run against the database as it is, like
+// applying migrations after one that drifted
+type migration_conflict struct {
+  msg string
+}
+
+func (err *migration_conflict) Error() string {
+  return err.msg
+}
+
+// loads the <version>_<name>.up.sql and <version>_<name>.down.sql files in
+// dir as migrations ordered by version; down files are optional
+func (server *PgServer) LoadMigrations(dir string) error {
+  paths, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+  if err != nil {
+    return err
+  }
+  by_version := make(map[int64]*migration)
+  for _, path := range paths {
+    match := migration_file_re.FindStringSubmatch(filepath.Base(path))
+    if match == nil {
+      return fmt.Errorf("migration file %s is not named " +
+        "<version>_<name>.up.sql or <version>_<name>.down.sql", path)
+    }
+    version, err := strconv.ParseInt(match[1], 10, 64)
+    if err != nil {
+      return fmt.Errorf("invalid migration version in %s: %w", path, err)
+    }
+    body, err := os.ReadFile(path)
+    if err != nil {
+      return err
+    }
+    m := by_version[version]
+    if m == nil {
+      m = &migration { version: version, name: match[2] }
+      by_version[version] = m
+    } else if m.name != match[2] {
+      return fmt.Errorf("migration %d is named both %s and %s", version,
+        m.name, match[2])
+    }
+    if match[3] == "up" {
+      if m.checksum != "" {
+        return fmt.Errorf("migration %d has more than one up file", version)
+      }
+      sum := sha256.Sum256(body)
+      m.up = string(body)
+      m.checksum = hex.EncodeToString(sum[:])
+    } else {
+      if m.has_down {
+        return fmt.Errorf("migration %d has more than one down file", version)
+      }
+      m.down = string(body)
+      m.has_down = true
+    }
+  }
+  migrations := make([]*migration, 0, len(by_version))
+  for _, m := range by_version {
+    if m.checksum == "" {
+      return fmt.Errorf("migration %d_%s has no up file", m.version, m.name)
+    }
+    migrations = append(migrations, m)
+  }
+  sort.Slice(migrations, func(i, j int) bool {
+    return migrations[i].version < migrations[j].version
+  })
+  server.migrations = migrations
+  server.logger.Info("loaded migrations", "dir", dir,
+    "migrations", len(migrations))
+  return nil
+}
+
+// runs a migration action, one transaction per migration, and returns the
+// status of every migration afterwards. Up and down refuse to run while an
+// applied migration has drifted or lost its files
+func (server *PgServer) Migrate(ctx context.Context, migrate pgrest.Migrate) (
+  []pgrest.MigrationStatus, error,
+) {
+  switch migrate.Action {
+    case "up", "down", "status":
+    default:
+      return nil, fmt.Errorf("invalid migrate action '%s'", migrate.Action)
+  }
+  conn, release, err := server.migration_conn(ctx)
+  if err != nil {
+    return nil, err
+  }
+  defer release()
+  _, err = conn.Exec(ctx, "SELECT pg_advisory_lock(" + migrations_lock_key +
+    ")")
+  if err != nil {
+    return nil, fmt.Errorf("locking migrations: %w", err)
+  }
+  // unlocked even when ctx is done; a connection closed by a cancellation
+  // has released the lock already
+  defer conn.Exec(context.Background(),
+    "SELECT pg_advisory_unlock(" + migrations_lock_key + ")")
+  _, err = conn.Exec(ctx, migrations_table_ddl)
+  if err != nil {
+    return nil, fmt.Errorf("creating migrations table: %w", err)
+  }
+  statuses, err := server.migration_statuses(ctx, conn)
+  if err != nil || migrate.Action == "status" {
+    return statuses, err
+  }
+  for _, status := range statuses {
+    if status.Drift {
+      return nil, &migration_conflict { fmt.Sprintf("migration %d_%s was " +
+        "changed after it was applied", status.Version, status.Name) }
+    }
+    if status.Missing {
+      return nil, &migration_conflict { fmt.Sprintf("applied migration " +
+        "%d_%s has no files", status.Version, status.Name) }
+    }
+  }
+  if migrate.Action == "up" {
+    err = server.migrate_up(ctx, conn, statuses, migrate.Target)
+  } else {
+    err = server.migrate_down(ctx, conn, statuses, migrate.Target)
+  }
+  if err != nil {
+    return nil, err
+  }
+  return server.migration_statuses(ctx, conn)
+}
+
+// the querier of the request, with a pool connection in place of the pool so
+// the advisory lock and the migrations share a session; in the transaction of
+// an idempotency key the migrations run in savepoints and commit with it
+func (server *PgServer) migration_conn(ctx context.Context) (
+  querier, func(), error,
+) {
+  db := server.db(ctx)
+  if _, ok := db.(*pgxpool.Pool); !ok {
+    return db, func() {}, nil
+  }
+  conn, err := server.pool.Acquire(ctx)
+  if err != nil {
+    return nil, nil, err
+  }
+  return conn, conn.Release, nil
+}
+
+// the migration files merged with the applied migrations, by version
+func (server *PgServer) migration_statuses(ctx context.Context, conn querier) (
+  []pgrest.MigrationStatus, error,
+) {
+  applied := make([]*applied_migration, 0)
+  err := pgxscan.Select(ctx, conn, &applied, "SELECT version, name, " +
+    "checksum, applied_at FROM pgrest.schema_migrations ORDER BY version")
+  if err != nil {
+    return nil, fmt.Errorf("getting applied migrations: %w", err)
+  }
+  statuses := make([]pgrest.MigrationStatus, 0,
+    len(server.migrations) + len(applied))
+  i := 0
+  for _, m := range server.migrations {
+    for ; i < len(applied) && applied[i].Version < m.version; i++ {
+      statuses = append(statuses, applied_status(applied[i]))
+      statuses[len(statuses) - 1].Missing = true
+    }
+    status := pgrest.MigrationStatus {
+      Version: m.version,
+      Name: m.name,
+      Checksum: m.checksum,
+    }
+    if i < len(applied) && applied[i].Version == m.version {
+      status = applied_status(applied[i])
+      status.Drift = applied[i].Checksum != m.checksum
+      i++
+    }
+    statuses = append(statuses, status)
+  }
+  for ; i < len(applied); i++ {
+    statuses = append(statuses, applied_status(applied[i]))
+    statuses[len(statuses) - 1].Missing = true
+  }
+  return statuses, nil
+}
+
+func applied_status(applied *applied_migration) pgrest.MigrationStatus {
+  applied_at := applied.Applied_at
+  return pgrest.MigrationStatus {
+    Version: applied.Version,
+    Name: applied.Name,
+    Checksum: applied.Checksum,
+    Applied: true,
+    Applied_at: &applied_at,
+  }
+}
+
+// applies the pending migrations up to target, or all of them without one;
+// a pending migration older than an applied one is refused rather than run
+// out of order
+func (server *PgServer) migrate_up(
+  ctx context.Context, conn querier, statuses []pgrest.MigrationStatus,
+  target *int64,
+) error {
+  applied := make(map[int64]bool)
+  latest := int64(-1)
+  for _, status := range statuses {
+    if status.Applied {
+      applied[status.Version] = true
+      latest = status.Version
+    }
+  }
+  for _, m := range server.migrations {
+    if applied[m.version] {
+      continue
+    }
+    if target != nil && m.version > *target {
+      break
+    }
+    if m.version < latest {
+      return &migration_conflict { fmt.Sprintf("pending migration %d_%s is " +
+        "older than applied migration %d", m.version, m.name, latest) }
+    }
+    err := run_migration(ctx, conn, m.up, "INSERT INTO " +
+      "pgrest.schema_migrations (version, name, checksum) " +
+      "VALUES ($1, $2, $3)", m.version, m.name, m.checksum)
+    if err != nil {
+      return fmt.Errorf("applying migration %d_%s: %w", m.version, m.name,
+        err)
+    }
+    request_logger(ctx).Info("applied migration", "version", m.version,
+      "name", m.name)
+  }
+  return nil
+}
+
+// rolls back the applied migrations after target, newest first, or only the
+// latest without a target
+func (server *PgServer) migrate_down(
+  ctx context.Context, conn querier, statuses []pgrest.MigrationStatus,
+  target *int64,
+) error {
+  files := make(map[int64]*migration)
+  for _, m := range server.migrations {
+    files[m.version] = m
+  }
+  for i := len(statuses) - 1; i >= 0; i-- {
+    if !statuses[i].Applied {
+      continue
+    }
+    if target != nil && statuses[i].Version <= *target {
+      break
+    }
+    m := files[statuses[i].Version]
+    if !m.has_down {
+      return &migration_conflict { fmt.Sprintf("migration %d_%s has no " +
+        "down file", m.version, m.name) }
+    }
+    err := run_migration(ctx, conn, m.down,
+      "DELETE FROM pgrest.schema_migrations WHERE version = $1", m.version)
+    if err != nil {
+      return fmt.Errorf("rolling back migration %d_%s: %w", m.version, m.name,
+        err)
+    }
+    request_logger(ctx).Info("rolled back migration", "version", m.version,
+      "name", m.name)
+    if target == nil {
+      break
+    }
+  }
+  return nil
+}
+
+// runs the sql of a migration and the statement recording it in one
+// transaction
+func run_migration(
+  ctx context.Context, conn querier, sql string, record string,
+  args ...interface{},
+) error {
+  tx, err := conn.Begin(ctx)
+  if err != nil {
+    return err
+  }
+  defer tx.Rollback(ctx)
+  if strings.TrimSpace(sql) != "" {
+    _, err = tx.Exec(ctx, sql)
+    if err != nil {
+      return err
+    }
+  }
+  _, err = tx.Exec(ctx, record, args...)
+  if err != nil {
+    return err
+  }
+  return tx.Commit(ctx)
+}
+
+// runs a migration action and returns the status of every migration
+func (server *PgServer) migrate(w http.ResponseWriter, r *http.Request) {
+  var migrate pgrest.Migrate
+  if !unmarshal_body(w, r, &migrate) {
+    return
+  }
+  switch migrate.Action {
+    case "up", "down", "status":
+    default:
+      http.Error(w, "error action must be up, down or status",
+        http.StatusBadRequest)
+      return
+  }
+  statuses, err := server.Migrate(r.Context(), migrate)
+  var conflict *migration_conflict
+  if errors.As(err, &conflict) {
+    http.Error(w, "error " + err.Error(), http.StatusConflict)
+    return
+  }
+  if check_err(r.Context(), w, err, "migrating") {
+    return
+  }
+  send_json(r.Context(), w, statuses, "migration statuses")
+}
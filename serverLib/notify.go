@@ -0,0 +1,381 @@
+package server
+
+import (
+  "context"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "sync"
+  "time"
+)
+
+import (
+  "github.com/gorilla/websocket"
+  "github.com/jackc/pgx/v5"
+  "github.com/jackc/pgx/v5/pgconn"
+  json "github.com/goccy/go-json"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+const (
+  // notifications waiting for a slow subscriber before it is dropped
+  subscriber_buffer = 64
+  keepalive_interval = 30 * time.Second
+  max_reconnect_backoff = 30 * time.Second
+)
+
+type subscriber struct {
+  channels      []string
+  notifications chan pgrest.Notification
+}
+
+// listens on a dedicated connection, opened on the first subscription, for the
+// channels of all subscribers and fans notifications out to them; the
+// connection is reopened and the channels listened to again when it drops,
+// and notifications sent in between are lost
+type notifier struct {
+  config  *pgx.ConnConfig
+  mutex   sync.Mutex
+  subs    map[*subscriber]bool
+  // signals the listener that the set of channels changed
+  changed chan struct{}
+  started bool
+  ctx     context.Context
+  cancel  context.CancelFunc
+  done    chan struct{}
+}
+
+func make_notifier(config *pgx.ConnConfig) *notifier {
+  ctx, cancel := context.WithCancel(context.Background())
+  return &notifier {
+    config: config,
+    subs: make(map[*subscriber]bool),
+    changed: make(chan struct{}, 1),
+    ctx: ctx,
+    cancel: cancel,
+    done: make(chan struct{}),
+  }
+}
+
+func (n *notifier) subscribe(channels []string) *subscriber {
+  sub := &subscriber {
+    channels: channels,
+    notifications: make(chan pgrest.Notification, subscriber_buffer),
+  }
+  n.mutex.Lock()
+  if n.ctx.Err() != nil {
+    n.mutex.Unlock()
+    close(sub.notifications)
+    return sub
+  }
+  n.subs[sub] = true
+  if !n.started {
+    n.started = true
+    go n.listen()
+  }
+  n.mutex.Unlock()
+  n.signal()
+  return sub
+}
+
+func (n *notifier) unsubscribe(sub *subscriber) {
+  n.mutex.Lock()
+  if n.subs[sub] {
+    delete(n.subs, sub)
+    close(sub.notifications)
+  }
+  n.mutex.Unlock()
+  n.signal()
+}
+
+func (n *notifier) signal() {
+  select {
+    case n.changed <- struct{}{}:
+    default:
+  }
+}
+
+// stops the listener and ends all subscriptions; later subscriptions end at
+// once
+func (n *notifier) close() {
+  n.cancel()
+  n.mutex.Lock()
+  started := n.started
+  for sub := range n.subs {
+    delete(n.subs, sub)
+    close(sub.notifications)
+  }
+  n.mutex.Unlock()
+  if started {
+    <-n.done
+  }
+}
+
+// the channels some subscriber wants
+func (n *notifier) channels() map[string]bool {
+  n.mutex.Lock()
+  defer n.mutex.Unlock()
+  channels := make(map[string]bool)
+  for sub := range n.subs {
+    for _, channel := range sub.channels {
+      channels[channel] = true
+    }
+  }
+  return channels
+}
+
+func (n *notifier) dispatch(notification *pgconn.Notification) {
+  n.mutex.Lock()
+  defer n.mutex.Unlock()
+  for sub := range n.subs {
+    for _, channel := range sub.channels {
+      if channel != notification.Channel {
+        continue
+      }
+      select {
+        case sub.notifications <- pgrest.Notification {
+          Channel: notification.Channel,
+          Payload: notification.Payload,
+          Pid: notification.PID,
+        }:
+        default:
+          slog.Warn("dropping slow notification subscriber")
+          delete(n.subs, sub)
+          close(sub.notifications)
+      }
+      break
+    }
+  }
+}
+
+// connects, reconnecting with backoff until the notifier is closed
+func (n *notifier) connect() *pgx.Conn {
+  backoff := 100 * time.Millisecond
+  for {
+    conn, err := pgx.ConnectConfig(n.ctx, n.config)
+    if err == nil {
+      return conn
+    }
+    if n.ctx.Err() != nil {
+      return nil
+    }
+    slog.Error("error connecting notification listener", "err", err)
+    select {
+      case <-n.ctx.Done():
+        return nil
+      case <-time.After(backoff):
+    }
+    backoff = min(2 * backoff, max_reconnect_backoff)
+  }
+}
+
+func (n *notifier) listen() {
+  defer close(n.done)
+  for {
+    conn := n.connect()
+    if conn == nil {
+      return
+    }
+    err := n.listen_on(conn)
+    conn.Close(context.Background())
+    if n.ctx.Err() != nil {
+      return
+    }
+    slog.Error("notification listener connection lost", "err", err)
+  }
+}
+
+// runs until the connection fails or the notifier is closed
+func (n *notifier) listen_on(conn *pgx.Conn) error {
+  listening := make(map[string]bool)
+  for {
+    // sync LISTEN and UNLISTEN with the channels of the subscribers
+    channels := n.channels()
+    for channel := range channels {
+      if !listening[channel] {
+        _, err := conn.Exec(n.ctx,
+          "LISTEN " + pgx.Identifier{channel}.Sanitize())
+        if err != nil {
+          return err
+        }
+        listening[channel] = true
+      }
+    }
+    for channel := range listening {
+      if !channels[channel] {
+        _, err := conn.Exec(n.ctx,
+          "UNLISTEN " + pgx.Identifier{channel}.Sanitize())
+        if err != nil {
+          return err
+        }
+        delete(listening, channel)
+      }
+    }
+    // waits for a notification until the channels change; cancelling the
+    // wait leaves the connection usable
+    wait_ctx, cancel := context.WithCancel(n.ctx)
+    stop := make(chan struct{})
+    go func() {
+      select {
+        case <-n.changed:
+          cancel()
+        case <-stop:
+      }
+    }()
+    notification, err := conn.WaitForNotification(wait_ctx)
+    close(stop)
+    canceled := wait_ctx.Err() != nil
+    cancel()
+    if err == nil {
+      n.dispatch(notification)
+      continue
+    }
+    if n.ctx.Err() != nil {
+      return n.ctx.Err()
+    }
+    if !canceled {
+      return err
+    }
+  }
+}
+
+// streams notifications on the channels given as channel query parameters,
+// as server-sent events or, for WebSocket upgrade requests, as WebSocket text
+// messages; each notification is a json pgrest.Notification
+func (server *PgServer) listen(w http.ResponseWriter, r *http.Request) {
+  if !allow_methods(w, r, "GET") {
+    return
+  }
+  channels := r.URL.Query()["channel"]
+  if len(channels) == 0 {
+    http.Error(w, "error no channel query parameter", http.StatusBadRequest)
+    return
+  }
+  if websocket.IsWebSocketUpgrade(r) {
+    server.listen_websocket(w, r, channels)
+    return
+  }
+  controller := http.NewResponseController(w)
+  // the stream outlives the read and write timeouts of the http.Server
+  controller.SetReadDeadline(time.Time{})
+  controller.SetWriteDeadline(time.Time{})
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-store")
+  w.WriteHeader(http.StatusOK)
+  err := controller.Flush()
+  if err != nil {
+    request_logger(r.Context()).Error("error flushing event stream",
+      "err", err)
+    return
+  }
+  sub := server.notifier.subscribe(channels)
+  defer server.notifier.unsubscribe(sub)
+  keepalive := time.NewTicker(keepalive_interval)
+  defer keepalive.Stop()
+  for {
+    select {
+      case <-r.Context().Done():
+        return
+      case <-keepalive.C:
+        fmt.Fprint(w, ": keepalive\n\n")
+      case notification, ok := <-sub.notifications:
+        if !ok {
+          return
+        }
+        s, _ := json.Marshal(notification)
+        fmt.Fprintf(w, "data: %s\n\n", s)
+    }
+    if controller.Flush() != nil {
+      return
+    }
+  }
+}
+
+func (server *PgServer) listen_websocket(
+  w http.ResponseWriter, r *http.Request, channels []string,
+) {
+  upgrader := websocket.Upgrader { CheckOrigin: server.check_origin }
+  conn, err := upgrader.Upgrade(w, r, nil)
+  if err != nil {
+    // the upgrader has responded
+    request_logger(r.Context()).Info("error upgrading to websocket",
+      "err", err)
+    return
+  }
+  defer conn.Close()
+  sub := server.notifier.subscribe(channels)
+  defer server.notifier.unsubscribe(sub)
+  // reads handle pings and closes; clients don't send messages
+  closed := make(chan struct{})
+  go func() {
+    defer close(closed)
+    for {
+      if _, _, err := conn.NextReader(); err != nil {
+        return
+      }
+    }
+  }()
+  keepalive := time.NewTicker(keepalive_interval)
+  defer keepalive.Stop()
+  for {
+    var err error
+    select {
+      case <-closed:
+        return
+      case <-server.notifier.ctx.Done():
+        conn.WriteControl(websocket.CloseMessage,
+          websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+          time.Now().Add(time.Second))
+        return
+      case <-keepalive.C:
+        err = conn.WriteControl(websocket.PingMessage, nil,
+          time.Now().Add(keepalive_interval))
+      case notification, ok := <-sub.notifications:
+        if !ok {
+          return
+        }
+        err = conn.WriteJSON(notification)
+    }
+    if err != nil {
+      return
+    }
+  }
+}
+
+// same origin requests are always allowed; "*" allows any origin
+func (server *PgServer) check_origin(r *http.Request) bool {
+  origin := r.Header.Get("Origin")
+  if origin == "" {
+    return true
+  }
+  for _, allowed := range server.websocket_origins {
+    if allowed == "*" || allowed == origin {
+      return true
+    }
+  }
+  return origin == "http://" + r.Host || origin == "https://" + r.Host
+}
+
+// sends a notification with pg_notify, in the request's transaction if it
+// has one
+func (server *PgServer) notify(w http.ResponseWriter, r *http.Request) {
+  var notify pgrest.Notify
+  if !unmarshal_body(w, r, &notify) {
+    return
+  }
+  if notify.Channel == "" {
+    http.Error(w, "error no channel", http.StatusBadRequest)
+    return
+  }
+  _, err := server.db(r.Context()).Exec(r.Context(),
+    "SELECT pg_notify($1, $2)", notify.Channel, notify.Payload)
+  if err != nil {
+    send_result_err(r.Context(), w, err)
+    return
+  }
+  success := "NOTIFY"
+  send_json(r.Context(), w, pgrest.Result { Success: &success }, "result")
+}
@@ -0,0 +1,651 @@
+package server
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "net/http"
+  "net/url"
+  "reflect"
+  "regexp"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+import (
+  "github.com/georgysavva/scany/v2/pgxscan"
+  "github.com/jackc/pgx/v5/pgtype"
+  json "github.com/goccy/go-json"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+const openapi_path = "/openapi.json"
+
+// the generated document is cached until the fingerprint of the catalog and
+// named queries changes
+type openapi_cache struct {
+  mutex       sync.Mutex
+  fingerprint string
+  document    []byte
+}
+
+type openapi_column struct {
+  Table_schema, Table_name, Column_name, Udt_name, Data_type, Is_nullable,
+  Column_default pgtype.Text
+  Is_primary_key bool
+  // on the search path, so the resource routes can name it
+  Is_visible bool
+}
+
+type api_endpoint struct {
+  path, method, summary string
+  request               interface{}
+  response              interface{}
+}
+
+// the fixed endpoints; request and response are zero values of the pgrestLib
+// types that are sent, a string for plain text or nil for a free-form object
+var api_endpoints = []api_endpoint {
+  { "/healthz", "get", "liveness probe", nil, pgrest.Health{} },
+  { "/readyz", "get", "readiness probe with pool statistics", nil,
+    pgrest.Health{} },
+  { metrics_path, "get", "prometheus metrics", nil, "" },
+  { quotas_path, "get", "quota usage by identity and endpoint class", nil,
+    []pgrest.QuotaUsage{} },
+  { "/dt", "get", "list tables of the schema query parameter, with sizes " +
+    "and activity for stats=true, ordered by size for sort=size", nil,
+    []pgrest.Table{} },
+  { "/dn", "get", "list schemas", nil, []pgrest.Schema{} },
+  { "/df", "get", "list functions", nil, []pgrest.Function{} },
+  { "/d", "get", "describe a table and its columns", pgrest.ReqTable{},
+    pgrest.TableDescription{} },
+  { "/dc", "get", "get the data type of a column", pgrest.ReqColumn{},
+    pgrest.DataType{} },
+  { "/idx", "get", "list indexes of a table", pgrest.ReqTable{},
+    []pgrest.Index{} },
+  { "/dv", "get", "list views of the schema query parameter", nil,
+    []pgrest.View{} },
+  { "/dm", "get", "list materialized views of the schema query parameter",
+    nil, []pgrest.MaterializedView{} },
+  { "/ds", "get", "list sequences of the schema query parameter", nil,
+    []pgrest.Sequence{} },
+  { "/triggers", "get", "list triggers of the schema and table query " +
+    "parameters", nil, []pgrest.Trigger{} },
+  { "/constraints", "get", "list constraints of the schema and table query " +
+    "parameters", nil, []pgrest.Constraint{} },
+  { "/ddl", "get", "export the database, the schema query parameter or the " +
+    "table query parameter as a sql script", nil, "" },
+  { "/create", "post", "create a table", pgrest.ReqTable{}, pgrest.Result{} },
+  { "/createIndex", "post", "create an index, concurrently outside a " +
+    "transaction with Concurrently", pgrest.CreateIndex{}, pgrest.Result{} },
+  { "/dropIndex", "post", "drop an index", pgrest.DropIndex{},
+    pgrest.Result{} },
+  { "/read", "post", "read rows as json lines", pgrest.ReadColumns{},
+    pgrest.Result{} },
+  { "/aggregate", "post", "aggregate rows per group as json lines",
+    pgrest.Aggregate{}, pgrest.Result{} },
+  { "/insert", "post", "insert a row", pgrest.Insert{}, pgrest.Result{} },
+  { "/upsert", "post", "insert or update a row by primary key",
+    pgrest.Insert{}, pgrest.Result{} },
+  { "/delete", "post", "drop columns", pgrest.Delete{}, pgrest.Result{} },
+  { "/execSql", "post", "execute sql", "", pgrest.Result{} },
+  { "/exec", "post", "execute sql fetched from a url", pgrest.Exec{},
+    pgrest.Result{} },
+  { "/own", "post", "change the owner of a table", pgrest.Own{},
+    pgrest.Result{} },
+  { "/du", "get", "list users", nil, []pgrest.User{} },
+  { "/add", "post", "create a user", pgrest.CreateUser{}, pgrest.Result{} },
+  { "/queries", "get", "list named queries", nil, []pgrest.NamedQuery{} },
+  { "/listen", "get", "stream notifications on the channel query " +
+    "parameters as server-sent events or websocket messages", nil, "" },
+  { "/notify", "post", "send a notification", pgrest.Notify{},
+    pgrest.Result{} },
+  { "/slots", "get", "list logical replication slots", nil,
+    []pgrest.ReplicationSlot{} },
+  { "/createSlot", "post", "create a pgoutput replication slot",
+    pgrest.ReqSlot{}, pgrest.Result{} },
+  { "/dropSlot", "post", "drop a replication slot", pgrest.ReqSlot{},
+    pgrest.Result{} },
+  { "/publications", "get", "list publications", nil,
+    []pgrest.Publication{} },
+  { "/createPublication", "post", "create a publication",
+    pgrest.CreatePublication{}, pgrest.Result{} },
+  { "/dropPublication", "post", "drop a publication", pgrest.ReqPublication{},
+    pgrest.Result{} },
+  { "/changes", "get", "stream the changes of the slot query parameter as " +
+    "server-sent events", nil, "" },
+  { "/ackChanges", "post", "acknowledge changes up to a resume token",
+    pgrest.AckChanges{}, pgrest.Result{} },
+  { "/migrate", "post", "apply or roll back migrations, or get their status",
+    pgrest.Migrate{}, []pgrest.MigrationStatus{} },
+  { "/defineQuery", "post", "define a named query", pgrest.NamedQuery{},
+    pgrest.Result{} },
+  { "/dropQuery", "post", "drop a named query", pgrest.ReqQuery{},
+    pgrest.Result{} },
+}
+
+var openapi_name_re = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+func (server *PgServer) openapi(w http.ResponseWriter, r *http.Request) {
+  columns := make([]*openapi_column, 0)
+  err := pgxscan.Select(r.Context(), server.db(r.Context()), &columns,
+    "SELECT c.table_schema, c.table_name, c.column_name, c.udt_name, " +
+    "c.data_type, " +
+    "c.is_nullable, c.column_default, EXISTS (" +
+    "SELECT 1 FROM information_schema.table_constraints tc " +
+    "JOIN information_schema.key_column_usage k " +
+    "ON k.constraint_schema = tc.constraint_schema " +
+    "AND k.constraint_name = tc.constraint_name " +
+    "WHERE tc.constraint_type = 'PRIMARY KEY' " +
+    "AND tc.table_schema = c.table_schema AND tc.table_name = c.table_name " +
+    "AND k.column_name = c.column_name) AS is_primary_key, " +
+    "pg_table_is_visible(format('%I.%I', c.table_schema, " +
+    "c.table_name)::regclass) AS is_visible " +
+    "FROM information_schema.columns c " +
+    "WHERE c.table_schema NOT IN ('pg_catalog', 'information_schema') " +
+    "AND c.table_schema !~ '^pg_(toast|temp_)' " +
+    "ORDER BY c.table_schema, c.table_name, c.ordinal_position")
+  if check_err(r.Context(), w, err, "getting columns") {
+    return
+  }
+  server.queries.mutex.RLock()
+  queries := make([]*pgrest.NamedQuery, 0, len(server.queries.queries))
+  for _, query := range server.queries.queries {
+    queries = append(queries, query)
+  }
+  server.queries.mutex.RUnlock()
+  sort.Slice(queries, func(i, j int) bool {
+    return queries[i].Name < queries[j].Name
+  })
+  catalog, err := json.Marshal([]interface{} { columns, queries })
+  if check_err(r.Context(), w, err, "converting catalog to json") {
+    return
+  }
+  sum := sha256.Sum256(catalog)
+  fingerprint := hex.EncodeToString(sum[:])
+  // the lock isn't held while writing, so a slow reader doesn't block others
+  server.openapi_doc.mutex.Lock()
+  if server.openapi_doc.fingerprint != fingerprint {
+    document, err := json.Marshal(openapi_document(columns, queries))
+    if err != nil {
+      server.openapi_doc.mutex.Unlock()
+      check_err(r.Context(), w, err, "converting openapi document to json")
+      return
+    }
+    server.openapi_doc.fingerprint = fingerprint
+    server.openapi_doc.document = document
+  }
+  document := server.openapi_doc.document
+  server.openapi_doc.mutex.Unlock()
+  w.Header().Set("Content-Type", "application/json")
+  w.Header().Set("ETag", "\"" + fingerprint + "\"")
+  w.Write(document)
+}
+
+func openapi_document(
+  columns []*openapi_column, queries []*pgrest.NamedQuery,
+) map[string]interface{} {
+  schemas := make(map[string]interface{})
+  paths := make(map[string]interface{})
+  for _, endpoint := range api_endpoints {
+    operation := map[string]interface{} {
+      "summary": endpoint.summary,
+      "responses": map[string]interface{} {
+        "200": json_content("success", type_schema(endpoint.response, schemas)),
+        "default": text_content("error"),
+      },
+    }
+    switch endpoint.request.(type) {
+      case nil:
+      case string:
+        operation["requestBody"] = map[string]interface{} {
+          "required": true,
+          "content": map[string]interface{} {
+            "text/plain": map[string]interface{} {
+              "schema": map[string]interface{} { "type": "string" },
+            },
+          },
+        }
+      default:
+        operation["requestBody"] = map[string]interface{} {
+          "required": true,
+          "content": map[string]interface{} {
+            "application/json": map[string]interface{} {
+              "schema": type_schema(endpoint.request, schemas),
+            },
+          },
+        }
+    }
+    paths[endpoint.path] = map[string]interface{} { endpoint.method: operation }
+  }
+  result_schema := type_schema(pgrest.Result{}, schemas)
+  for _, query := range queries {
+    properties := make(map[string]interface{})
+    required := make([]string, 0, len(query.Params))
+    for _, param := range query.Params {
+      properties[param.Name] = pg_type_schema(param.Type)
+      required = append(required, param.Name)
+    }
+    args := map[string]interface{} {
+      "type": "object", "properties": properties,
+      "additionalProperties": false,
+    }
+    if len(required) > 0 {
+      args["required"] = required
+    }
+    paths["/query/" + query.Name] = map[string]interface{} {
+      "post": map[string]interface{} {
+        "summary": "run the named query " + query.Name,
+        "requestBody": map[string]interface{} {
+          "content": map[string]interface{} {
+            "application/json": map[string]interface{} { "schema": args },
+          },
+        },
+        "responses": map[string]interface{} {
+          "200": json_content("success", result_schema),
+          "default": text_content("error"),
+        },
+      },
+    }
+  }
+  paths["/rpc/{schema}/{function}"] = map[string]interface{} {
+    "post": map[string]interface{} {
+      "summary": "call a database function with named arguments",
+      "parameters": []interface{} {
+        path_parameter("schema"), path_parameter("function"),
+      },
+      "requestBody": map[string]interface{} {
+        "content": map[string]interface{} {
+          "application/json": map[string]interface{} {
+            "schema": map[string]interface{} { "type": "object" },
+          },
+        },
+      },
+      "responses": map[string]interface{} {
+        "200": json_content("success", result_schema),
+        "default": text_content("error"),
+      },
+    },
+  }
+  paths[openapi_path] = map[string]interface{} {
+    "get": map[string]interface{} {
+      "summary": "this document",
+      "responses": map[string]interface{} {
+        "200": json_content("success",
+          map[string]interface{} { "type": "object" }),
+      },
+    },
+  }
+  // one schema per table of every user schema, table.<schema>.<table>,
+  // describing a row as returned by /read
+  tables := make(map[string]map[string]interface{})
+  visible := make([]string, 0)
+  for _, column := range columns {
+    name := table_schema_name(column.Table_schema.String,
+      column.Table_name.String)
+    table, ok := tables[name]
+    if !ok {
+      table = map[string]interface{} {
+        "type": "object",
+        "properties": make(map[string]interface{}),
+        "x-table-schema": column.Table_schema.String,
+        "x-table-name": column.Table_name.String,
+      }
+      tables[name] = table
+      schemas[name] = table
+      if column.Is_visible {
+        visible = append(visible, name)
+      }
+    }
+    schema := pg_type_schema(column.Udt_name.String)
+    schema["x-data-type"] = column.Data_type.String
+    if column.Is_nullable.String == "YES" {
+      schema["nullable"] = true
+    }
+    if column.Column_default.Valid {
+      schema["x-default"] = column.Column_default.String
+    }
+    if column.Is_primary_key {
+      schema["x-primary-key"] = true
+      primary_key, _ := table["x-primary-key"].([]string)
+      table["x-primary-key"] = append(primary_key, column.Column_name.String)
+    }
+    table["properties"].(map[string]interface{})[column.Column_name.String] =
+      schema
+    if column.Is_nullable.String != "YES" && !column.Column_default.Valid {
+      required, _ := table["required"].([]string)
+      table["required"] = append(required, column.Column_name.String)
+    }
+  }
+  resource_paths(paths, schemas, visible)
+  return map[string]interface{} {
+    "openapi": "3.0.3",
+    "info": map[string]interface{} {
+      "title": "pgrest",
+      "description": "Postgres REST API",
+      "version": "1",
+    },
+    "paths": paths,
+    "components": map[string]interface{} { "schemas": schemas },
+  }
+}
+
+// the component name of the row schema of a table
+func table_schema_name(schema string, table string) string {
+  return "table." + openapi_name_re.ReplaceAllString(schema, "_") + "." +
+    openapi_name_re.ReplaceAllString(table, "_")
+}
+
+func json_content(description string, schema interface{}) interface{} {
+  return map[string]interface{} {
+    "description": description,
+    "content": map[string]interface{} {
+      "application/json": map[string]interface{} { "schema": schema },
+    },
+  }
+}
+
+func text_content(description string) interface{} {
+  return map[string]interface{} {
+    "description": description,
+    "content": map[string]interface{} {
+      "text/plain": map[string]interface{} {
+        "schema": map[string]interface{} { "type": "string" },
+      },
+    },
+  }
+}
+
+func path_parameter(name string) interface{} {
+  return map[string]interface{} {
+    "name": name, "in": "path", "required": true,
+    "schema": map[string]interface{} { "type": "string" },
+  }
+}
+
+// schemas of the types with their own json encoding: the pgtype scalars are
+// nullable values and times are RFC 3339 strings
+var scalar_schemas = map[reflect.Type]map[string]interface{} {
+  reflect.TypeOf(pgtype.Bool{}): { "type": "boolean", "nullable": true },
+  reflect.TypeOf(pgtype.Int2{}): { "type": "integer", "nullable": true },
+  reflect.TypeOf(pgtype.Int4{}): { "type": "integer", "nullable": true },
+  reflect.TypeOf(pgtype.Int8{}): { "type": "integer", "nullable": true },
+  reflect.TypeOf(pgtype.Float8{}): { "type": "number", "nullable": true },
+  reflect.TypeOf(pgtype.Numeric{}): { "type": "number", "nullable": true },
+  reflect.TypeOf(pgtype.Text{}): { "type": "string", "nullable": true },
+  reflect.TypeOf(pgtype.UUID{}): {
+    "type": "string", "format": "uuid", "nullable": true,
+  },
+  reflect.TypeOf(pgtype.Date{}): {
+    "type": "string", "format": "date", "nullable": true,
+  },
+  reflect.TypeOf(pgtype.Timestamp{}): {
+    "type": "string", "format": "date-time", "nullable": true,
+  },
+  reflect.TypeOf(pgtype.Timestamptz{}): {
+    "type": "string", "format": "date-time", "nullable": true,
+  },
+  reflect.TypeOf(pgtype.Point{}): { "type": "string", "nullable": true },
+  reflect.TypeOf(time.Time{}): { "type": "string", "format": "date-time" },
+}
+
+// returns the schema for the json encoding of v; named struct types are added
+// to schemas and referenced
+func type_schema(v interface{}, schemas map[string]interface{}) interface{} {
+  return reflect_schema(reflect.TypeOf(v), schemas)
+}
+
+func reflect_schema(
+  t reflect.Type, schemas map[string]interface{},
+) map[string]interface{} {
+  if scalar, ok := scalar_schemas[t]; ok {
+    // a copy, since pointers add nullable to it
+    schema := make(map[string]interface{}, len(scalar) + 1)
+    for key, value := range scalar {
+      schema[key] = value
+    }
+    return schema
+  }
+  switch t.Kind() {
+    case reflect.Pointer:
+      schema := reflect_schema(t.Elem(), schemas)
+      if _, ok := schema["$ref"]; ok {
+        return map[string]interface{} {
+          "allOf": []interface{} { schema }, "nullable": true,
+        }
+      }
+      schema["nullable"] = true
+      return schema
+    case reflect.String:
+      return map[string]interface{} { "type": "string" }
+    case reflect.Bool:
+      return map[string]interface{} { "type": "boolean" }
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+      reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+      reflect.Uint64:
+      return map[string]interface{} { "type": "integer" }
+    case reflect.Float32, reflect.Float64:
+      return map[string]interface{} { "type": "number" }
+    case reflect.Slice, reflect.Array:
+      return map[string]interface{} {
+        "type": "array", "items": reflect_schema(t.Elem(), schemas),
+      }
+    case reflect.Map:
+      return map[string]interface{} {
+        "type": "object",
+        "additionalProperties": reflect_schema(t.Elem(), schemas),
+      }
+    case reflect.Struct:
+      name := t.Name()
+      if _, ok := schemas[name]; !ok {
+        // placeholder in case of recursive types
+        schemas[name] = map[string]interface{} {}
+        properties := make(map[string]interface{})
+        for i := 0; i < t.NumField(); i++ {
+          field := t.Field(i)
+          if !field.IsExported() {
+            continue
+          }
+          properties[field.Name] = reflect_schema(field.Type, schemas)
+        }
+        schemas[name] = map[string]interface{} {
+          "type": "object", "properties": properties,
+        }
+      }
+      return map[string]interface{} {
+        "$ref": "#/components/schemas/" + name,
+      }
+  }
+  return map[string]interface{} {}
+}
+
+// schema of a column value as encoded in json lines by rows_to_jsonl
+func pg_type_schema(type_name string) map[string]interface{} {
+  type_name = strings.ToLower(strings.TrimSpace(type_name))
+  if strings.HasPrefix(type_name, "_") {
+    return map[string]interface{} {
+      "type": "array", "items": pg_type_schema(type_name[1:]),
+    }
+  }
+  if strings.HasSuffix(type_name, "[]") {
+    return map[string]interface{} {
+      "type": "array",
+      "items": pg_type_schema(strings.TrimSuffix(type_name, "[]")),
+    }
+  }
+  switch type_name {
+    case "int2", "smallint", "int4", "int", "integer":
+      return map[string]interface{} { "type": "integer", "format": "int32" }
+    case "int8", "bigint":
+      return map[string]interface{} { "type": "integer", "format": "int64" }
+    case "float4", "real":
+      return map[string]interface{} { "type": "number", "format": "float" }
+    case "float8", "double precision":
+      return map[string]interface{} { "type": "number", "format": "double" }
+    case "numeric", "decimal":
+      return map[string]interface{} { "type": "number" }
+    case "bool", "boolean":
+      return map[string]interface{} { "type": "boolean" }
+    case "json", "jsonb":
+      return map[string]interface{} {}
+    case "uuid":
+      return map[string]interface{} { "type": "string", "format": "uuid" }
+    case "date", "timestamp", "timestamptz", "timestamp without time zone",
+      "timestamp with time zone":
+      return map[string]interface{} { "type": "string", "format": "date-time" }
+    case "bytea":
+      return map[string]interface{} { "type": "string", "format": "byte" }
+  }
+  return map[string]interface{} { "type": "string", "x-pg-type": type_name }
+}
+
+// the resource routes, with filters and the like passed in the query string:
+// the generic {table} routes and, for the tables named by visible, the routes
+// of each table with its row schema
+func resource_paths(
+  paths map[string]interface{}, schemas map[string]interface{},
+  visible []string,
+) {
+  not_found := text_content("no such table or row")
+  paths["/tables"] = map[string]interface{} {
+    "get": map[string]interface{} {
+      "summary": "list tables",
+      "responses": map[string]interface{} {
+        "200": json_content("success", type_schema([]pgrest.Table{}, schemas)),
+      },
+    },
+  }
+  paths["/tables/{table}/columns"] = map[string]interface{} {
+    "parameters": []interface{} { path_parameter("table") },
+    "get": map[string]interface{} {
+      "summary": "list columns of a table",
+      "responses": map[string]interface{} {
+        "200": json_content("success",
+          type_schema([]pgrest.Column{}, schemas)),
+        "404": not_found,
+      },
+    },
+  }
+  object := map[string]interface{} { "type": "object" }
+  row_paths(paths, "{table}", []interface{} { path_parameter("table") },
+    object, object, true)
+  for _, name := range visible {
+    table := schemas[name].(map[string]interface{})
+    row := map[string]interface{} { "$ref": "#/components/schemas/" + name }
+    // any of the columns, none required
+    patch := map[string]interface{} {
+      "type": "object", "properties": table["properties"],
+    }
+    primary_key, _ := table["x-primary-key"].([]string)
+    row_paths(paths, url.PathEscape(table["x-table-name"].(string)), nil, row,
+      patch, len(primary_key) == 1)
+  }
+}
+
+// the rows routes of table, a path segment, with the path parameters naming
+// it; row is the schema of the rows and of the bodies of inserts and
+// replacements, patch that of updates. by_pk adds the routes of a row by its
+// primary key
+func row_paths(
+  paths map[string]interface{}, table string, parameters []interface{},
+  row map[string]interface{}, patch map[string]interface{}, by_pk bool,
+) {
+  rows := map[string]interface{} { "type": "array", "items": row }
+  body := func(schema interface{}) interface{} {
+    return map[string]interface{} {
+      "required": true,
+      "content": map[string]interface{} {
+        "application/json": map[string]interface{} { "schema": schema },
+      },
+    }
+  }
+  query_parameter := func(name, description string) interface{} {
+    return map[string]interface{} {
+      "name": name, "in": "query", "description": description,
+      "schema": map[string]interface{} { "type": "string" },
+    }
+  }
+  filters := map[string]interface{} {
+    "name": "filters", "in": "query", "style": "form", "explode": true,
+    "description": "column=op.value where op is one of eq, neq, lt, lte, " +
+      "gt, gte, like, ilike, is or in",
+    "schema": map[string]interface{} {
+      "type": "object",
+      "additionalProperties": map[string]interface{} { "type": "string" },
+    },
+  }
+  sel := query_parameter("select", "comma separated columns")
+  no_content := map[string]interface{} { "description": "no content" }
+  not_found := text_content("no such table or row")
+  rows_path := map[string]interface{} {
+    "get": map[string]interface{} {
+      "summary": "read rows",
+      "parameters": []interface{} {
+        sel, query_parameter("order", "col.asc or col.desc, comma separated"),
+        query_parameter("limit", "maximum number of rows"),
+        query_parameter("offset", "number of rows to skip"), filters,
+      },
+      "responses": map[string]interface{} {
+        "200": json_content("rows", rows), "404": not_found,
+      },
+    },
+    "post": map[string]interface{} {
+      "summary": "insert a row",
+      "requestBody": body(row),
+      "responses": map[string]interface{} {
+        "201": json_content("inserted rows", rows), "404": not_found,
+      },
+    },
+    "patch": map[string]interface{} {
+      "summary": "update the rows matching the filters",
+      "parameters": []interface{} { filters },
+      "requestBody": body(patch),
+      "responses": map[string]interface{} {
+        "200": json_content("updated rows", rows), "404": not_found,
+      },
+    },
+    "delete": map[string]interface{} {
+      "summary": "delete the rows matching the filters",
+      "parameters": []interface{} { filters },
+      "responses": map[string]interface{} {
+        "204": no_content, "404": not_found,
+      },
+    },
+  }
+  if parameters != nil {
+    rows_path["parameters"] = parameters
+  }
+  paths["/tables/" + table + "/rows"] = rows_path
+  if !by_pk {
+    return
+  }
+  paths["/tables/" + table + "/rows/{pk}"] = map[string]interface{} {
+    "parameters": append(append([]interface{} {}, parameters...),
+      path_parameter("pk")),
+    "get": map[string]interface{} {
+      "summary": "read a row by primary key",
+      "parameters": []interface{} { sel },
+      "responses": map[string]interface{} {
+        "200": json_content("row", row), "404": not_found,
+      },
+    },
+    "put": map[string]interface{} {
+      "summary": "insert or replace a row by primary key",
+      "requestBody": body(row),
+      "responses": map[string]interface{} {
+        "201": map[string]interface{} { "description": "created" },
+        "204": no_content, "404": not_found,
+      },
+    },
+    "delete": map[string]interface{} {
+      "summary": "delete a row by primary key",
+      "responses": map[string]interface{} {
+        "204": no_content, "404": not_found,
+      },
+    },
+  }
+}
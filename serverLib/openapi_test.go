@@ -0,0 +1,103 @@
+package server
+
+import (
+  "reflect"
+  "testing"
+)
+
+import (
+  "github.com/jackc/pgx/v5/pgtype"
+)
+
+func test_column(
+  schema, table, column, udt string, pk bool, visible bool,
+) *openapi_column {
+  text := func(s string) pgtype.Text {
+    return pgtype.Text { String: s, Valid: true }
+  }
+  return &openapi_column {
+    Table_schema: text(schema), Table_name: text(table),
+    Column_name: text(column), Udt_name: text(udt), Data_type: text(udt),
+    Is_nullable: text("NO"), Is_primary_key: pk, Is_visible: visible,
+  }
+}
+
+// the value at keys of nested objects, nil if there is none
+func lookup(v interface{}, keys ...string) interface{} {
+  for _, key := range keys {
+    object, _ := v.(map[string]interface{})
+    v = object[key]
+  }
+  return v
+}
+
+func TestOpenapiTables(t *testing.T) {
+  columns := []*openapi_column {
+    test_column("app", "events", "id", "int8", false, false),
+    test_column("public", "users", "id", "int4", true, true),
+    test_column("public", "users", "name", "text", false, true),
+    test_column("public", "log", "line", "text", false, true),
+  }
+  doc := openapi_document(columns, nil)
+  schemas := lookup(doc, "components", "schemas").(map[string]interface{})
+  for _, name := range []string {
+    "table.app.events", "table.public.users", "table.public.log",
+  } {
+    if _, ok := schemas[name]; !ok {
+      t.Errorf("no schema %s", name)
+    }
+  }
+  users := schemas["table.public.users"].(map[string]interface{})
+  if !reflect.DeepEqual(users["required"], []string { "id", "name" }) ||
+    !reflect.DeepEqual(users["x-primary-key"], []string { "id" }) {
+    t.Errorf("users schema %v", users)
+  }
+  paths := doc["paths"].(map[string]interface{})
+  row := map[string]interface{} {
+    "$ref": "#/components/schemas/table.public.users",
+  }
+  tests := []struct {
+    path   string
+    method string
+    schema interface{}
+  } {
+    { "/tables/users/rows/{pk}", "get", row },
+    {
+      "/tables/users/rows", "get",
+      map[string]interface{} { "type": "array", "items": row },
+    },
+    {
+      "/tables/{table}/rows/{pk}", "get",
+      map[string]interface{} { "type": "object" },
+    },
+  }
+  for _, test := range tests {
+    path, ok := paths[test.path].(map[string]interface{})
+    if !ok {
+      t.Errorf("no path %s", test.path)
+      continue
+    }
+    schema := lookup(path, test.method, "responses", "200", "content",
+      "application/json", "schema")
+    if !reflect.DeepEqual(schema, test.schema) {
+      t.Errorf("%s %s returns %v, expected %v", test.method, test.path,
+        schema, test.schema)
+    }
+  }
+  // no primary key, and not on the search path
+  for _, path := range []string {
+    "/tables/log/rows/{pk}", "/tables/events/rows",
+  } {
+    if _, ok := paths[path]; ok {
+      t.Errorf("unexpected path %s", path)
+    }
+  }
+  if _, ok := paths["/tables/log/rows"]; !ok {
+    t.Error("no path /tables/log/rows")
+  }
+  patch := lookup(paths, "/tables/users/rows", "patch", "requestBody",
+    "content", "application/json", "schema")
+  if lookup(patch, "required") != nil || lookup(patch, "properties") == nil {
+    t.Errorf("patch body %v, expected the columns without required", patch)
+  }
+}
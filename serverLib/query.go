@@ -0,0 +1,354 @@
+package server
+
+import (
+  "bufio"
+  "context"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path/filepath"
+  "regexp"
+  "sort"
+  "strings"
+  "sync"
+)
+
+import (
+  "github.com/jackc/pgx/v5/pgxpool"
+  json "github.com/goccy/go-json"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+// registry of named queries; queries are run by their sql text so the pgx
+// statement cache prepares each one once per pool connection
+type query_registry struct {
+  mutex   sync.RWMutex
+  queries map[string]*pgrest.NamedQuery
+}
+
+var query_name_re = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func make_query_registry() *query_registry {
+  return &query_registry { queries: make(map[string]*pgrest.NamedQuery) }
+}
+
+// loads every *.sql file in dir as a named query; the query name is the file
+// name without extension and parameters are declared in leading comment lines
+// of the form "-- param: <name> <type>"
+func (server *PgServer) LoadQueries(ctx context.Context, dir string) error {
+  paths, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+  if err != nil {
+    return err
+  }
+  sort.Strings(paths)
+  for _, path := range paths {
+    query, err := parse_query_file(path)
+    if err != nil {
+      server.logger.Error("error parsing query file", "path", path,
+        "err", err)
+      return err
+    }
+    err = server.define_query(ctx, query)
+    if err != nil {
+      server.logger.Error("error defining query", "query", query.Name,
+        "err", err)
+      return err
+    }
+    server.logger.Info("loaded query", "query", query.Name, "path", path)
+  }
+  return nil
+}
+
+func parse_query_file(path string) (*pgrest.NamedQuery, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+  query := pgrest.NamedQuery { Name: name }
+  var sql, header []string
+  scanner := bufio.NewScanner(file)
+  for scanner.Scan() {
+    line := scanner.Text()
+    trimmed := strings.TrimSpace(line)
+    // the leading comments may mix parameters with other comments, which
+    // are kept with the sql
+    if len(sql) == 0 && strings.HasPrefix(trimmed, "--") {
+      decl := strings.TrimSpace(strings.TrimPrefix(trimmed, "--"))
+      if strings.HasPrefix(decl, "param:") {
+        fields := strings.Fields(strings.TrimPrefix(decl, "param:"))
+        if len(fields) < 2 {
+          return nil, fmt.Errorf("invalid param declaration: %s", trimmed)
+        }
+        query.Params = append(query.Params, pgrest.QueryParam {
+          Name: fields[0], Type: strings.Join(fields[1:], " "),
+        })
+      } else {
+        header = append(header, line)
+      }
+      continue
+    }
+    if len(sql) == 0 && trimmed == "" {
+      continue
+    }
+    if len(sql) == 0 {
+      sql = append(sql, header...)
+    }
+    sql = append(sql, line)
+  }
+  if err := scanner.Err(); err != nil {
+    return nil, err
+  }
+  query.Sql = strings.TrimSpace(strings.Join(sql, "\n"))
+  return &query, nil
+}
+
+// prepares the query and checks the declared parameter types against the
+// types inferred by postgres before adding it to the registry
+func (server *PgServer) define_query(
+  ctx context.Context, query *pgrest.NamedQuery,
+) error {
+  if !query_name_re.MatchString(query.Name) {
+    return fmt.Errorf("invalid query name '%s'", query.Name)
+  }
+  if query.Sql == "" {
+    return fmt.Errorf("query '%s' has no sql", query.Name)
+  }
+  seen := make(map[string]bool)
+  for _, param := range query.Params {
+    if param.Name == "" || param.Type == "" {
+      return fmt.Errorf("query '%s' has a parameter without name or type",
+        query.Name)
+    }
+    if seen[param.Name] {
+      return fmt.Errorf("query '%s' declares parameter '%s' twice", query.Name,
+        param.Name)
+    }
+    seen[param.Name] = true
+  }
+  conn, err := server.pool.Acquire(ctx)
+  if err != nil {
+    return err
+  }
+  defer conn.Release()
+  // the unnamed statement is replaced by the next query on the connection
+  desc, err := conn.Conn().PgConn().Prepare(ctx, "", query.Sql, nil)
+  if err != nil {
+    return err
+  }
+  err = check_param_types(ctx, conn, query, desc.ParamOIDs)
+  if err != nil {
+    return err
+  }
+  server.queries.mutex.Lock()
+  server.queries.queries[query.Name] = query
+  server.queries.mutex.Unlock()
+  return nil
+}
+
+func check_param_types(
+  ctx context.Context, conn *pgxpool.Conn, query *pgrest.NamedQuery,
+  param_oids []uint32,
+) error {
+  if len(param_oids) != len(query.Params) {
+    return fmt.Errorf("query '%s' declares %d parameters but uses %d",
+      query.Name, len(query.Params), len(param_oids))
+  }
+  for i, param := range query.Params {
+    var oid uint32
+    err := conn.QueryRow(ctx, "SELECT $1::regtype::oid",
+      param.Type).Scan(&oid)
+    if err != nil {
+      return fmt.Errorf("unknown type '%s' for parameter '%s': %v", param.Type,
+        param.Name, err)
+    }
+    if oid != param_oids[i] {
+      return fmt.Errorf("parameter '%s' is declared as %s but $%d has type " +
+        "oid %d; add an explicit cast to the query", param.Name, param.Type,
+        i + 1, param_oids[i])
+    }
+  }
+  return nil
+}
+
+func (server *PgServer) queryList(w http.ResponseWriter, r *http.Request) {
+  server.queries.mutex.RLock()
+  queries := make([]*pgrest.NamedQuery, 0, len(server.queries.queries))
+  for _, query := range server.queries.queries {
+    queries = append(queries, query)
+  }
+  server.queries.mutex.RUnlock()
+  sort.Slice(queries, func(i, j int) bool {
+    return queries[i].Name < queries[j].Name
+  })
+  send_json(r.Context(), w, queries, "queries")
+}
+
+func (server *PgServer) defineQuery(w http.ResponseWriter, r *http.Request) {
+  var query pgrest.NamedQuery
+  if !unmarshal_body(w, r, &query) {
+    return
+  }
+  err := server.define_query(r.Context(), &query)
+  if err != nil {
+    send_result_err(r.Context(), w, err)
+    return
+  }
+  res_string := fmt.Sprintf("DEFINE QUERY %s", query.Name)
+  send_json(r.Context(), w, pgrest.Result { Success: &res_string }, "result")
+}
+
+func (server *PgServer) dropQuery(w http.ResponseWriter, r *http.Request) {
+  var req_query pgrest.ReqQuery
+  if !unmarshal_body(w, r, &req_query) {
+    return
+  }
+  server.queries.mutex.Lock()
+  _, ok := server.queries.queries[req_query.Name]
+  delete(server.queries.queries, req_query.Name)
+  server.queries.mutex.Unlock()
+  if !ok {
+    http.Error(w, fmt.Sprintf("error no such query '%s'", req_query.Name),
+      http.StatusNotFound)
+    return
+  }
+  res_string := fmt.Sprintf("DROP QUERY %s", req_query.Name)
+  send_json(r.Context(), w, pgrest.Result { Success: &res_string }, "result")
+}
+
+// runs the named query in the url path /query/<name> with the JSON object in
+// the request body as arguments
+func (server *PgServer) query(w http.ResponseWriter, r *http.Request) {
+  name := strings.TrimPrefix(r.URL.Path, "/query/")
+  server.queries.mutex.RLock()
+  query, ok := server.queries.queries[name]
+  server.queries.mutex.RUnlock()
+  if !ok {
+    http.Error(w, fmt.Sprintf("error no such query '%s'", name),
+      http.StatusNotFound)
+    return
+  }
+  body, err := ioutil.ReadAll(r.Body)
+  if check_err(r.Context(), w, err, "reading request body") {
+    return
+  }
+  defer r.Body.Close()
+  json_args := make(map[string]json.RawMessage)
+  if len(strings.TrimSpace(string(body))) > 0 {
+    err = json.Unmarshal(body, &json_args)
+    if check_err(r.Context(), w, err, "unmarshaling query arguments") {
+      return
+    }
+  }
+  args, err := bind_query_args(query, json_args)
+  if err != nil {
+    http.Error(w, fmt.Sprintf("error binding query arguments: %v", err),
+      http.StatusBadRequest)
+    return
+  }
+  rows, err := server.db(r.Context()).Query(r.Context(), query.Sql,
+    args...)
+  if err != nil {
+    send_result_err(r.Context(), w, err)
+    return
+  }
+  defer rows.Close()
+  if len(rows.FieldDescriptions()) == 0 {
+    rows.Close()
+    if err := rows.Err(); err != nil {
+      send_result_err(r.Context(), w, err)
+      return
+    }
+    res_string := rows.CommandTag().String()
+    send_json(r.Context(), w, pgrest.Result { Success: &res_string }, "result")
+    return
+  }
+  rows_jsonl, err := rows_to_jsonl(r.Context(), w, rows)
+  if err != nil {
+    return
+  }
+  if err := rows.Err(); err != nil {
+    send_result_err(r.Context(), w, err)
+    return
+  }
+  send_json(r.Context(), w, pgrest.Result {
+    Success: rows_jsonl, Truncated: truncated(r.Context()),
+  }, "result")
+}
+
+// converts the JSON arguments to positional parameters; values are passed in
+// text format so postgres parses them according to the parameter types
+func bind_query_args(
+  query *pgrest.NamedQuery, json_args map[string]json.RawMessage,
+) ([]interface{}, error) {
+  declared := make(map[string]bool)
+  args := make([]interface{}, len(query.Params))
+  for i, param := range query.Params {
+    declared[param.Name] = true
+    raw, ok := json_args[param.Name]
+    if !ok {
+      return nil, fmt.Errorf("missing argument '%s'", param.Name)
+    }
+    arg, err := json_to_text(raw, strings.HasSuffix(param.Type, "[]"))
+    if err != nil {
+      return nil, fmt.Errorf("argument '%s': %v", param.Name, err)
+    }
+    args[i] = arg
+  }
+  for name := range json_args {
+    if !declared[name] {
+      return nil, fmt.Errorf("unknown argument '%s'", name)
+    }
+  }
+  return args, nil
+}
+
+// returns nil for JSON null, otherwise the text representation of the value;
+// JSON arrays become postgres array literals when is_array is set
+func json_to_text(raw json.RawMessage, is_array bool) (interface{}, error) {
+  var value interface{}
+  decoder := json.NewDecoder(strings.NewReader(string(raw)))
+  decoder.UseNumber()
+  err := decoder.Decode(&value)
+  if err != nil {
+    return nil, err
+  }
+  switch v := value.(type) {
+    case nil:
+      return nil, nil
+    case string:
+      return v, nil
+    case []interface{}:
+      if is_array {
+        return array_literal(v)
+      }
+  }
+  return strings.TrimSpace(string(raw)), nil
+}
+
+func array_literal(values []interface{}) (string, error) {
+  elems := make([]string, len(values))
+  for i, value := range values {
+    switch v := value.(type) {
+      case nil:
+        elems[i] = "NULL"
+      case string:
+        escaped := strings.ReplaceAll(v, `\`, `\\`)
+        escaped = strings.ReplaceAll(escaped, `"`, `\"`)
+        elems[i] = `"` + escaped + `"`
+      case json.Number:
+        elems[i] = v.String()
+      case bool:
+        elems[i] = fmt.Sprintf("%t", v)
+      default:
+        return "", errors.New("nested arrays and objects are not supported")
+    }
+  }
+  return "{" + strings.Join(elems, ",") + "}", nil
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+  "os"
+  "path/filepath"
+  "reflect"
+  "testing"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+func TestParseQueryFile(t *testing.T) {
+  tests := []struct {
+    name   string
+    file   string
+    params []pgrest.QueryParam
+    sql    string
+    err    bool
+  } {
+    {
+      name: "no params",
+      file: "SELECT 1\n",
+      sql: "SELECT 1",
+    },
+    {
+      name: "params",
+      file: "-- param: id integer\n-- param: since timestamp with time zone\n" +
+        "SELECT * FROM foo\nWHERE id = $1 AND ts > $2\n",
+      params: []pgrest.QueryParam {
+        { Name: "id", Type: "integer" },
+        { Name: "since", Type: "timestamp with time zone" },
+      },
+      sql: "SELECT * FROM foo\nWHERE id = $1 AND ts > $2",
+    },
+    {
+      name: "leading comments and blank lines",
+      file: "-- lists the foos\n\n--param: id int\n\nSELECT $1::int\n",
+      params: []pgrest.QueryParam { { Name: "id", Type: "int" } },
+      sql: "-- lists the foos\nSELECT $1::int",
+    },
+    {
+      name: "param comments after the sql are sql",
+      file: "SELECT 1\n-- param: id int\n",
+      sql: "SELECT 1\n-- param: id int",
+    },
+    {
+      name: "param without type",
+      file: "-- param: id\nSELECT $1\n",
+      err: true,
+    },
+  }
+  dir := t.TempDir()
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      path := filepath.Join(dir, "foo.sql")
+      err := os.WriteFile(path, []byte(test.file), 0644)
+      if err != nil {
+        t.Fatal(err)
+      }
+      query, err := parse_query_file(path)
+      if test.err {
+        if err == nil {
+          t.Fatalf("expected an error, got %+v", query)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatal(err)
+      }
+      if query.Name != "foo" {
+        t.Errorf("name %q, expected foo", query.Name)
+      }
+      if !reflect.DeepEqual(query.Params, test.params) {
+        t.Errorf("params %+v, expected %+v", query.Params, test.params)
+      }
+      if query.Sql != test.sql {
+        t.Errorf("sql %q, expected %q", query.Sql, test.sql)
+      }
+    })
+  }
+}
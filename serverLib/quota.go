@@ -0,0 +1,217 @@
+package server
+
+import (
+  "math"
+  "net"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+const quotas_path = "/admin/quotas"
+
+// endpoint classes quotas are set for
+const (
+  CatalogClass = "catalog"
+  ReadClass    = "read"
+  WriteClass   = "write"
+  ExecSqlClass = "execSql"
+)
+
+// idle quota entries are forgotten after this long
+const quota_idle_expiry = 10 * time.Minute
+
+// a token bucket refilled at Rate requests per second up to Burst, and a cap
+// on requests in flight; zero Rate or Concurrency is unlimited, zero Burst
+// means a burst of one
+type Quota struct {
+  Rate        float64
+  Burst       int
+  Concurrency int
+}
+
+type quota_key struct {
+  identity string
+  class    string
+}
+
+type quota_state struct {
+  tokens    float64
+  updated   time.Time
+  in_flight int
+}
+
+type quota_store struct {
+  quotas map[string]Quota
+  mutex  sync.Mutex
+  states map[quota_key]*quota_state
+  pruned time.Time
+}
+
+func make_quota_store(quotas map[string]Quota) *quota_store {
+  return &quota_store {
+    quotas: quotas,
+    states: make(map[quota_key]*quota_state),
+  }
+}
+
+func (quota Quota) burst() float64 {
+  return math.Max(1, float64(quota.Burst))
+}
+
+// the endpoint class of r; named queries and functions count as reads
+func endpoint_class(r *http.Request) string {
+  switch endpoint_name(r.URL.Path) {
+    case "/execSql", "/exec", "/defineQuery", "/dropQuery":
+      return ExecSqlClass
+    case "/read", "/aggregate", "/query", "/rpc", "/listen", "/changes":
+      return ReadClass
+    case "/create", "/createIndex", "/dropIndex", "/insert", "/upsert",
+      "/delete", "/own", "/add", "/notify", "/createSlot", "/dropSlot",
+      "/createPublication", "/dropPublication", "/ackChanges", "/migrate":
+      return WriteClass
+    case "/tables":
+      if strings.Count(strings.Trim(r.URL.Path, "/"), "/") < 2 {
+        return CatalogClass
+      }
+      if r.Method == "GET" || r.Method == "HEAD" {
+        return ReadClass
+      }
+      return WriteClass
+  }
+  return CatalogClass
+}
+
+// the caller of quotas and idempotency keys: the client certificate role of
+// the request if there is one, otherwise the client IP address
+func quota_identity(r *http.Request, role string) string {
+  if role != "" {
+    return "role:" + role
+  }
+  host, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil {
+    host = r.RemoteAddr
+  }
+  return "ip:" + host
+}
+
+// takes a token and an in-flight slot for the request; returns the function
+// giving back the slot, or how long to wait before retrying
+func (store *quota_store) acquire(identity string, class string) (
+  func(), time.Duration, bool,
+) {
+  quota, ok := store.quotas[class]
+  if !ok || (quota.Rate <= 0 && quota.Concurrency <= 0) {
+    return func() {}, 0, true
+  }
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  now := time.Now()
+  store.prune(now)
+  key := quota_key { identity, class }
+  state, ok := store.states[key]
+  if !ok {
+    state = &quota_state { tokens: quota.burst(), updated: now }
+    store.states[key] = state
+  }
+  if quota.Rate > 0 {
+    elapsed := now.Sub(state.updated).Seconds()
+    state.tokens = math.Min(quota.burst(), state.tokens + elapsed * quota.Rate)
+  }
+  state.updated = now
+  if quota.Concurrency > 0 && state.in_flight >= quota.Concurrency {
+    return nil, time.Second, false
+  }
+  if quota.Rate > 0 {
+    if state.tokens < 1 {
+      wait := time.Duration((1 - state.tokens) / quota.Rate *
+        float64(time.Second))
+      return nil, wait, false
+    }
+    state.tokens--
+  }
+  state.in_flight++
+  // updated stays at the last refill, so the tokens earned while the request
+  // runs are added by the next acquire
+  release := func() {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    state.in_flight--
+  }
+  return release, 0, true
+}
+
+// forgets idle states with full buckets, at most once a minute
+func (store *quota_store) prune(now time.Time) {
+  if now.Sub(store.pruned) < time.Minute {
+    return
+  }
+  store.pruned = now
+  for key, state := range store.states {
+    if state.in_flight == 0 && now.Sub(state.updated) > quota_idle_expiry {
+      delete(store.states, key)
+    }
+  }
+}
+
+func (store *quota_store) usage() []pgrest.QuotaUsage {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  now := time.Now()
+  usage := make([]pgrest.QuotaUsage, 0, len(store.states))
+  for key, state := range store.states {
+    quota := store.quotas[key.class]
+    tokens := state.tokens
+    if quota.Rate > 0 {
+      tokens = math.Min(quota.burst(),
+        tokens + now.Sub(state.updated).Seconds() * quota.Rate)
+    }
+    usage = append(usage, pgrest.QuotaUsage {
+      Identity: key.identity,
+      Class: key.class,
+      Tokens: tokens,
+      InFlight: state.in_flight,
+      Rate: quota.Rate,
+      Burst: quota.Burst,
+      Concurrency: quota.Concurrency,
+    })
+  }
+  sort.Slice(usage, func(i, j int) bool {
+    if usage[i].Identity != usage[j].Identity {
+      return usage[i].Identity < usage[j].Identity
+    }
+    return usage[i].Class < usage[j].Class
+  })
+  return usage
+}
+
+// rejects the request with 429 if its identity is over the quota of the
+// endpoint class; otherwise the returned function must be called when the
+// request is done
+func (server *PgServer) check_quota(
+  w http.ResponseWriter, r *http.Request, role string,
+) (func(), bool) {
+  release, wait, ok := server.quotas.acquire(quota_identity(r, role),
+    endpoint_class(r))
+  if !ok {
+    seconds := int(math.Ceil(wait.Seconds()))
+    w.Header().Set("Retry-After", strconv.Itoa(max(1, seconds)))
+    http.Error(w, "error quota exceeded", http.StatusTooManyRequests)
+    return nil, false
+  }
+  return release, true
+}
+
+func (server *PgServer) quotaUsage(w http.ResponseWriter, r *http.Request) {
+  if !allow_methods(w, r, "GET") {
+    return
+  }
+  send_json(r.Context(), w, server.quotas.usage(), "quota usage")
+}
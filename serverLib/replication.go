@@ -0,0 +1,111 @@
+package server
+
+import (
+  "fmt"
+  "net/http"
+  "strings"
+)
+
+import (
+  "github.com/georgysavva/scany/v2/pgxscan"
+  "github.com/jackc/pgx/v5"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+// logical replication slots and publications, which /changes streams from
+
+func (server *PgServer) slots(w http.ResponseWriter, r *http.Request) {
+  slots := make([]*pgrest.ReplicationSlot, 0)
+  err := pgxscan.Select(r.Context(), server.db(r.Context()), &slots,
+    "SELECT slot_name, restart_lsn::text, confirmed_flush_lsn::text, active " +
+    "FROM pg_replication_slots WHERE slot_type = 'logical' " +
+    "AND plugin = 'pgoutput' ORDER BY slot_name")
+  if check_err(r.Context(), w, err, "getting replication slots") {
+    return
+  }
+  send_json(r.Context(), w, slots, "replication slots")
+}
+
+func (server *PgServer) createSlot(w http.ResponseWriter, r *http.Request) {
+  var req_slot pgrest.ReqSlot
+  if !unmarshal_body(w, r, &req_slot) {
+    return
+  }
+  var lsn string
+  err := server.db(r.Context()).QueryRow(r.Context(),
+    "SELECT lsn::text FROM pg_create_logical_replication_slot($1, " +
+    "'pgoutput')", req_slot.Name).Scan(&lsn)
+  if err != nil {
+    send_result_err(r.Context(), w, err)
+    return
+  }
+  res_string := fmt.Sprintf("CREATE SLOT %s AT %s", req_slot.Name, lsn)
+  send_json(r.Context(), w, pgrest.Result { Success: &res_string }, "result")
+}
+
+func (server *PgServer) dropSlot(w http.ResponseWriter, r *http.Request) {
+  var req_slot pgrest.ReqSlot
+  if !unmarshal_body(w, r, &req_slot) {
+    return
+  }
+  _, err := server.db(r.Context()).Exec(r.Context(),
+    "SELECT pg_drop_replication_slot($1)", req_slot.Name)
+  if err != nil {
+    send_result_err(r.Context(), w, err)
+    return
+  }
+  server.change_acks.mutex.Lock()
+  delete(server.change_acks.lsns, req_slot.Name)
+  server.change_acks.mutex.Unlock()
+  res_string := fmt.Sprintf("DROP SLOT %s", req_slot.Name)
+  send_json(r.Context(), w, pgrest.Result { Success: &res_string }, "result")
+}
+
+func (server *PgServer) publications(w http.ResponseWriter, r *http.Request) {
+  publications := make([]*pgrest.Publication, 0)
+  err := pgxscan.Select(r.Context(), server.db(r.Context()), &publications,
+    "SELECT p.pubname, p.puballtables, coalesce(array_agg(t.schemaname || " +
+    "'.' || t.tablename ORDER BY t.schemaname, t.tablename) FILTER (WHERE " +
+    "t.tablename IS NOT NULL), '{}') AS tables FROM pg_publication p " +
+    "LEFT JOIN pg_publication_tables t ON t.pubname = p.pubname " +
+    "GROUP BY p.pubname, p.puballtables ORDER BY p.pubname")
+  if check_err(r.Context(), w, err, "getting publications") {
+    return
+  }
+  send_json(r.Context(), w, publications, "publications")
+}
+
+func (server *PgServer) createPublication(
+  w http.ResponseWriter, r *http.Request,
+) {
+  var create_pub pgrest.CreatePublication
+  if !unmarshal_body(w, r, &create_pub) {
+    return
+  }
+  target := "ALL TABLES"
+  if len(create_pub.Tables) > 0 {
+    tables := make([]string, len(create_pub.Tables))
+    for i, table := range create_pub.Tables {
+      tables[i] = pgx.Identifier(strings.SplitN(table, ".", 2)).Sanitize()
+    }
+    target = "TABLE " + strings.Join(tables, ", ")
+  }
+  stmt := fmt.Sprintf("CREATE PUBLICATION %s FOR %s",
+    pgx.Identifier{create_pub.Name}.Sanitize(), target)
+  server.exec_stmt(r.Context(), w, stmt)
+}
+
+func (server *PgServer) dropPublication(
+  w http.ResponseWriter, r *http.Request,
+) {
+  var req_pub pgrest.ReqPublication
+  if !unmarshal_body(w, r, &req_pub) {
+    return
+  }
+  stmt := fmt.Sprintf("DROP PUBLICATION %s",
+    pgx.Identifier{req_pub.Name}.Sanitize())
+  server.exec_stmt(r.Context(), w, stmt)
+}
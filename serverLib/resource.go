@@ -0,0 +1,678 @@
+package server
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+)
+
+import (
+  "github.com/georgysavva/scany/v2/pgxscan"
+  "github.com/jackc/pgx/v5"
+  "github.com/jackc/pgx/v5/pgconn"
+  json "github.com/goccy/go-json"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+// a table addressed by the resource routes with its column types and primary
+// key
+type resource_table struct {
+  oid         uint32
+  name        string
+  ident       string
+  columns     map[string]string
+  primary_key []string
+}
+
+type resource_column struct {
+  Column_name string
+  Data_type   string
+}
+
+var filter_ops = map[string]string {
+  "eq": "=", "neq": "<>", "lt": "<", "lte": "<=", "gt": ">", "gte": ">=",
+  "like": "LIKE", "ilike": "ILIKE",
+}
+
+// query string parameters that are not column filters
+var reserved_params = map[string]bool {
+  "select": true, "order": true, "limit": true, "offset": true,
+}
+
+var errTableNotFound = errors.New("table not found")
+
+// dispatches the resource routes:
+//
+//   GET                      /tables
+//   GET                      /tables/{t}/columns
+//   GET, POST, PATCH, DELETE /tables/{t}/rows
+//   GET, PUT, DELETE         /tables/{t}/rows/{pk}
+func (server *PgServer) tables(w http.ResponseWriter, r *http.Request) {
+  segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+  switch {
+    case len(segments) == 1:
+      if allow_methods(w, r, "GET") {
+        server.dt(w, r)
+      }
+    case len(segments) == 3 && segments[2] == "columns":
+      if allow_methods(w, r, "GET") {
+        server.tableColumns(w, r, segments[1])
+      }
+    case len(segments) == 3 && segments[2] == "rows":
+      if !allow_methods(w, r, "GET", "POST", "PATCH", "DELETE") {
+        return
+      }
+      table, ok := server.resource_table(w, r, segments[1])
+      if !ok {
+        return
+      }
+      switch r.Method {
+        case "GET": server.getRows(w, r, table)
+        case "POST": server.postRows(w, r, table)
+        case "PATCH": server.patchRows(w, r, table)
+        case "DELETE": server.deleteRows(w, r, table)
+      }
+    case len(segments) == 4 && segments[2] == "rows":
+      if !allow_methods(w, r, "GET", "PUT", "DELETE") {
+        return
+      }
+      table, ok := server.resource_table(w, r, segments[1])
+      if !ok {
+        return
+      }
+      if len(table.primary_key) != 1 {
+        http.Error(w, fmt.Sprintf("error table '%s' has no single column " +
+          "primary key", table.name), http.StatusBadRequest)
+        return
+      }
+      switch r.Method {
+        case "GET": server.getRow(w, r, table, segments[3])
+        case "PUT": server.putRow(w, r, table, segments[3])
+        case "DELETE": server.deleteRow(w, r, table, segments[3])
+      }
+    default:
+      http.Error(w, "Invalid request URL", http.StatusNotFound)
+  }
+}
+
+// returns false and responds 405 if the request method is not allowed
+func allow_methods(
+  w http.ResponseWriter, r *http.Request, methods ...string,
+) bool {
+  for _, method := range methods {
+    if r.Method == method {
+      return true
+    }
+  }
+  w.Header().Set("Allow", strings.Join(methods, ", "))
+  http.Error(w, fmt.Sprintf("Method %s not allowed", r.Method),
+    http.StatusMethodNotAllowed)
+  return false
+}
+
+// looks up the table columns and primary key; responds 404 if there is no
+// such table
+func (server *PgServer) resource_table(
+  w http.ResponseWriter, r *http.Request, table_name string,
+) (*resource_table, bool) {
+  table, err := server.get_resource_table(r.Context(), table_name)
+  if err == errTableNotFound {
+    http.Error(w, fmt.Sprintf("error no such table '%s'", table_name),
+      http.StatusNotFound)
+    return nil, false
+  }
+  if check_err(r.Context(), w, err, "getting table") {
+    return nil, false
+  }
+  return table, true
+}
+
+func (server *PgServer) get_resource_table(
+  ctx context.Context, table_name string,
+) (*resource_table, error) {
+  ident := pgx.Identifier{table_name}.Sanitize()
+  var oid *uint32
+  err := server.db(ctx).QueryRow(ctx, "SELECT to_regclass($1)::oid",
+    ident).Scan(&oid)
+  if err != nil {
+    return nil, err
+  }
+  if oid == nil {
+    return nil, errTableNotFound
+  }
+  columns := make([]*resource_column, 0)
+  err = pgxscan.Select(ctx, server.db(ctx), &columns,
+    "SELECT attname AS column_name, " +
+    "format_type(atttypid, atttypmod) AS data_type FROM pg_attribute " +
+    "WHERE attrelid = $1 AND attnum > 0 AND NOT attisdropped ORDER BY attnum",
+    *oid)
+  if err != nil {
+    return nil, err
+  }
+  table := resource_table {
+    oid: *oid, name: table_name, ident: ident,
+    columns: make(map[string]string),
+  }
+  for _, column := range columns {
+    table.columns[column.Column_name] = column.Data_type
+  }
+  err = pgxscan.Select(ctx, server.db(ctx), &table.primary_key,
+    "SELECT a.attname FROM pg_index i JOIN pg_attribute a " +
+    "ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey) " +
+    "WHERE i.indrelid = $1 AND i.indisprimary " +
+    "ORDER BY array_position(i.indkey::int2[], a.attnum)", *oid)
+  if err != nil {
+    return nil, err
+  }
+  return &table, nil
+}
+
+func (server *PgServer) tableColumns(
+  w http.ResponseWriter, r *http.Request, table_name string,
+) {
+  oid, err := server.table_oid(r.Context(), "", table_name)
+  if err == errTableNotFound {
+    http.Error(w, fmt.Sprintf("error no such table '%s'", table_name),
+      http.StatusNotFound)
+    return
+  }
+  if check_err(r.Context(), w, err, "getting table") {
+    return
+  }
+  columns, err := server.column_metadata(r.Context(), oid)
+  if check_err(r.Context(), w, err, "getting columns") {
+    return
+  }
+  send_json(r.Context(), w, columns, "columns")
+}
+
+func (server *PgServer) getRows(
+  w http.ResponseWriter, r *http.Request, table *resource_table,
+) {
+  params := r.URL.Query()
+  sel_cols, err := table.select_list(params.Get("select"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  filters, err := parse_filters(params)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  var args []interface{}
+  where, err := table.where_clause(filters, &args)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  order, err := table.order_clause(params.Get("order"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  query := fmt.Sprintf("SELECT %s FROM %s%s%s", sel_cols, table.ident, where,
+    order)
+  for _, param := range []string { "limit", "offset" } {
+    if value := params.Get(param); value != "" {
+      n, err := strconv.ParseUint(value, 10, 63)
+      if err != nil {
+        http.Error(w, fmt.Sprintf("error invalid %s '%s'", param, value),
+          http.StatusBadRequest)
+        return
+      }
+      query += fmt.Sprintf(" %s %d", strings.ToUpper(param), n)
+    }
+  }
+  server.send_rows(r.Context(), w, http.StatusOK, query, args...)
+}
+
+func (server *PgServer) postRows(
+  w http.ResponseWriter, r *http.Request, table *resource_table,
+) {
+  values, ok := unmarshal_row(w, r)
+  if !ok {
+    return
+  }
+  var args []interface{}
+  cols, placeholders, err := table.bind_values(values, &args)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  var query string
+  if len(cols) == 0 {
+    query = fmt.Sprintf("INSERT INTO %s DEFAULT VALUES RETURNING *",
+      table.ident)
+  } else {
+    query = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) RETURNING *",
+      table.ident, strings.Join(cols, ", "), strings.Join(placeholders, ", "))
+  }
+  if len(table.primary_key) == 1 {
+    pk := table.primary_key[0]
+    if value, ok := values[pk]; ok {
+      if text, err := json_to_text(value, false); err == nil && text != nil {
+        w.Header().Set("Location", fmt.Sprintf("/tables/%s/rows/%s",
+          url.PathEscape(table.name), url.PathEscape(text.(string))))
+      }
+    }
+  }
+  server.send_rows(r.Context(), w, http.StatusCreated, query, args...)
+}
+
+func (server *PgServer) patchRows(
+  w http.ResponseWriter, r *http.Request, table *resource_table,
+) {
+  filters, err := parse_filters(r.URL.Query())
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  if len(filters) == 0 {
+    http.Error(w, "error PATCH requires at least one filter",
+      http.StatusBadRequest)
+    return
+  }
+  values, ok := unmarshal_row(w, r)
+  if !ok {
+    return
+  }
+  var args []interface{}
+  cols, placeholders, err := table.bind_values(values, &args)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  if len(cols) == 0 {
+    http.Error(w, "error PATCH requires at least one column",
+      http.StatusBadRequest)
+    return
+  }
+  sets := make([]string, len(cols))
+  for i := range cols {
+    sets[i] = cols[i] + " = " + placeholders[i]
+  }
+  where, err := table.where_clause(filters, &args)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  query := fmt.Sprintf("UPDATE %s SET %s%s RETURNING *", table.ident,
+    strings.Join(sets, ", "), where)
+  server.send_rows(r.Context(), w, http.StatusOK, query, args...)
+}
+
+func (server *PgServer) deleteRows(
+  w http.ResponseWriter, r *http.Request, table *resource_table,
+) {
+  filters, err := parse_filters(r.URL.Query())
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  if len(filters) == 0 {
+    http.Error(w, "error DELETE requires at least one filter",
+      http.StatusBadRequest)
+    return
+  }
+  var args []interface{}
+  where, err := table.where_clause(filters, &args)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  query := fmt.Sprintf("DELETE FROM %s%s", table.ident, where)
+  _, err = server.db(r.Context()).Exec(r.Context(), query, args...)
+  if err != nil {
+    send_pg_err(w, err)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *PgServer) getRow(
+  w http.ResponseWriter, r *http.Request, table *resource_table, pk string,
+) {
+  sel_cols, err := table.select_list(r.URL.Query().Get("select"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  var args []interface{}
+  where, _ := table.where_clause(table.pk_filter(pk), &args)
+  query := fmt.Sprintf("SELECT %s FROM %s%s", sel_cols, table.ident, where)
+  rows, err := server.db(r.Context()).Query(r.Context(), query, args...)
+  if err != nil {
+    send_pg_err(w, err)
+    return
+  }
+  defer rows.Close()
+  rows_jsonl, err := rows_to_jsonl(r.Context(), w, rows)
+  if err != nil {
+    return
+  }
+  if err := rows.Err(); err != nil {
+    send_pg_err(w, err)
+    return
+  }
+  if *rows_jsonl == "" {
+    http.Error(w, fmt.Sprintf("error no row with primary key '%s'", pk),
+      http.StatusNotFound)
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  fmt.Fprint(w, *rows_jsonl)
+}
+
+// inserts or replaces the row with the primary key in the path; responds 201
+// when the row was created
+func (server *PgServer) putRow(
+  w http.ResponseWriter, r *http.Request, table *resource_table, pk string,
+) {
+  values, ok := unmarshal_row(w, r)
+  if !ok {
+    return
+  }
+  pk_col := table.primary_key[0]
+  pk_json, _ := json.Marshal(pk)
+  if value, ok := values[pk_col]; ok {
+    text, err := json_to_text(value, false)
+    if err != nil || text != pk {
+      http.Error(w, fmt.Sprintf("error column '%s' does not match the " +
+        "primary key in the url", pk_col), http.StatusBadRequest)
+      return
+    }
+  }
+  values[pk_col] = pk_json
+  var args []interface{}
+  cols, placeholders, err := table.bind_values(values, &args)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  pk_ident := pgx.Identifier{pk_col}.Sanitize()
+  var updates []string
+  for _, col := range cols {
+    if col != pk_ident {
+      updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", col, col))
+    }
+  }
+  conflict := "DO NOTHING"
+  if len(updates) > 0 {
+    conflict = "DO UPDATE SET " + strings.Join(updates, ", ")
+  }
+  query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) %s " +
+    "RETURNING xmax = 0 AS inserted", table.ident, strings.Join(cols, ", "),
+    strings.Join(placeholders, ", "), pk_ident, conflict)
+  var inserted bool
+  err = server.db(r.Context()).QueryRow(r.Context(), query,
+    args...).Scan(&inserted)
+  if err == pgx.ErrNoRows {
+    // DO NOTHING on an existing row returns nothing
+    w.WriteHeader(http.StatusNoContent)
+    return
+  }
+  if err != nil {
+    send_pg_err(w, err)
+    return
+  }
+  if inserted {
+    w.Header().Set("Location", r.URL.Path)
+    w.WriteHeader(http.StatusCreated)
+  } else {
+    w.WriteHeader(http.StatusNoContent)
+  }
+}
+
+func (server *PgServer) deleteRow(
+  w http.ResponseWriter, r *http.Request, table *resource_table, pk string,
+) {
+  var args []interface{}
+  where, _ := table.where_clause(table.pk_filter(pk), &args)
+  query := fmt.Sprintf("DELETE FROM %s%s", table.ident, where)
+  tag, err := server.db(r.Context()).Exec(r.Context(), query, args...)
+  if err != nil {
+    send_pg_err(w, err)
+    return
+  }
+  if tag.RowsAffected() == 0 {
+    http.Error(w, fmt.Sprintf("error no row with primary key '%s'", pk),
+      http.StatusNotFound)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+// runs the query and responds with the rows as a json array
+func (server *PgServer) send_rows(
+  ctx context.Context, w http.ResponseWriter, status int, query string,
+  args ...interface{},
+) {
+  rows, err := server.db(ctx).Query(ctx, query, args...)
+  if err != nil {
+    send_pg_err(w, err)
+    return
+  }
+  defer rows.Close()
+  rows_jsonl, err := rows_to_jsonl(ctx, w, rows)
+  if err != nil {
+    return
+  }
+  if err := rows.Err(); err != nil {
+    send_pg_err(w, err)
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  fmt.Fprintln(w, jsonl_to_array(*rows_jsonl))
+}
+
+func jsonl_to_array(rows_jsonl string) string {
+  lines := strings.Split(strings.TrimSuffix(rows_jsonl, "\n"), "\n")
+  if len(lines) == 1 && lines[0] == "" {
+    lines = nil
+  }
+  return "[" + strings.Join(lines, ",") + "]"
+}
+
+// responds with the postgres error as a result, with the status code chosen
+// by SQLSTATE class
+func send_pg_err(w http.ResponseWriter, err error) {
+  status := http.StatusInternalServerError
+  var pg_err *pgconn.PgError
+  if errors.As(err, &pg_err) {
+    switch pg_err.Code[:2] {
+      case "22", "42":
+        status = http.StatusBadRequest
+      case "23":
+        status = http.StatusConflict
+    }
+  }
+  err_string := err.Error()
+  s, _ := json.Marshal(pgrest.Result { Error: &err_string })
+  http.Error(w, string(s), status)
+}
+
+func unmarshal_row(w http.ResponseWriter, r *http.Request) (
+  map[string]json.RawMessage, bool,
+) {
+  body, err := ioutil.ReadAll(r.Body)
+  if check_err(r.Context(), w, err, "reading request body") {
+    return nil, false
+  }
+  defer r.Body.Close()
+  values := make(map[string]json.RawMessage)
+  if len(strings.TrimSpace(string(body))) > 0 {
+    err = json.Unmarshal(body, &values)
+    if err != nil {
+      http.Error(w, fmt.Sprintf("error body must be a json object: %v", err),
+        http.StatusBadRequest)
+      return nil, false
+    }
+  }
+  return values, true
+}
+
+// parses filters of the form column=op.value from the query string, e.g.
+// id=eq.5, name=ilike.a%, deleted=is.null or id=in.(1,2,3)
+func parse_filters(params url.Values) ([]pgrest.Filter, error) {
+  var filters []pgrest.Filter
+  for column, values := range params {
+    if reserved_params[column] {
+      continue
+    }
+    for _, value := range values {
+      op, operand, ok := strings.Cut(value, ".")
+      if !ok {
+        return nil, fmt.Errorf("error filter on '%s' must be of the form " +
+          "op.value", column)
+      }
+      filter := pgrest.Filter { ColumnName: column, Op: op, Value: operand }
+      if op == "in" {
+        operand = strings.TrimSuffix(strings.TrimPrefix(operand, "("), ")")
+        filter.Value = ""
+        filter.Values = strings.Split(operand, ",")
+      }
+      filters = append(filters, filter)
+    }
+  }
+  return filters, nil
+}
+
+func (table *resource_table) pk_filter(pk string) []pgrest.Filter {
+  return []pgrest.Filter {
+    { ColumnName: table.primary_key[0], Op: "eq", Value: pk },
+  }
+}
+
+func (table *resource_table) column_ident(column string) (string, error) {
+  if _, ok := table.columns[column]; !ok {
+    return "", fmt.Errorf("error no column '%s' in table '%s'", column,
+      table.name)
+  }
+  return pgx.Identifier{column}.Sanitize(), nil
+}
+
+// builds the WHERE clause, appending the filter values to args
+func (table *resource_table) where_clause(
+  filters []pgrest.Filter, args *[]interface{},
+) (string, error) {
+  if len(filters) == 0 {
+    return "", nil
+  }
+  conds := make([]string, len(filters))
+  for i, filter := range filters {
+    col, err := table.column_ident(filter.ColumnName)
+    if err != nil {
+      return "", err
+    }
+    conds[i], err = filter_cond(col, table.columns[filter.ColumnName], filter,
+      args)
+    if err != nil {
+      return "", err
+    }
+  }
+  return " WHERE " + strings.Join(conds, " AND "), nil
+}
+
+// the condition of a filter on the expression col of type data_type,
+// appending the filter values to args
+func filter_cond(
+  col string, data_type string, filter pgrest.Filter, args *[]interface{},
+) (string, error) {
+  switch filter.Op {
+    case "is":
+      switch strings.ToLower(filter.Value) {
+        case "null": return col + " IS NULL", nil
+        case "true": return col + " IS TRUE", nil
+        case "false": return col + " IS FALSE", nil
+      }
+      return "", fmt.Errorf("error invalid is filter value '%s'",
+        filter.Value)
+    case "in":
+      placeholders := make([]string, len(filter.Values))
+      for j, value := range filter.Values {
+        *args = append(*args, value)
+        placeholders[j] = fmt.Sprintf("$%d::%s", len(*args), data_type)
+      }
+      return fmt.Sprintf("%s IN (%s)", col, strings.Join(placeholders, ", ")),
+        nil
+  }
+  op, ok := filter_ops[filter.Op]
+  if !ok {
+    return "", fmt.Errorf("error unknown filter operator '%s'", filter.Op)
+  }
+  *args = append(*args, filter.Value)
+  if op == "LIKE" || op == "ILIKE" {
+    return fmt.Sprintf("%s::text %s $%d", col, op, len(*args)), nil
+  }
+  return fmt.Sprintf("%s %s $%d::%s", col, op, len(*args), data_type), nil
+}
+
+func (table *resource_table) select_list(sel string) (string, error) {
+  if sel == "" {
+    return "*", nil
+  }
+  columns := strings.Split(sel, ",")
+  for i, column := range columns {
+    col, err := table.column_ident(strings.TrimSpace(column))
+    if err != nil {
+      return "", err
+    }
+    columns[i] = col
+  }
+  return strings.Join(columns, ", "), nil
+}
+
+// parses order=col.asc,col2.desc
+func (table *resource_table) order_clause(order string) (string, error) {
+  if order == "" {
+    return "", nil
+  }
+  terms := strings.Split(order, ",")
+  for i, term := range terms {
+    column, dir, _ := strings.Cut(strings.TrimSpace(term), ".")
+    col, err := table.column_ident(column)
+    if err != nil {
+      return "", err
+    }
+    switch strings.ToLower(dir) {
+      case "", "asc": terms[i] = col + " ASC"
+      case "desc": terms[i] = col + " DESC"
+      default:
+        return "", fmt.Errorf("error invalid order direction '%s'", dir)
+    }
+  }
+  return " ORDER BY " + strings.Join(terms, ", "), nil
+}
+
+// converts the json values to text arguments cast to the column types
+func (table *resource_table) bind_values(
+  values map[string]json.RawMessage, args *[]interface{},
+) ([]string, []string, error) {
+  var cols, placeholders []string
+  for column, raw := range values {
+    col, err := table.column_ident(column)
+    if err != nil {
+      return nil, nil, err
+    }
+    data_type := table.columns[column]
+    arg, err := json_to_text(raw, strings.HasSuffix(data_type, "[]"))
+    if err != nil {
+      return nil, nil, fmt.Errorf("error column '%s': %v", column, err)
+    }
+    *args = append(*args, arg)
+    cols = append(cols, col)
+    placeholders = append(placeholders, fmt.Sprintf("$%d::%s", len(*args),
+      data_type))
+  }
+  return cols, placeholders, nil
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "strings"
+)
+
+import (
+  "github.com/georgysavva/scany/v2/pgxscan"
+  "github.com/jackc/pgx/v5"
+  json "github.com/goccy/go-json"
+)
+
+import (
+  pgrest "pgrest/pgrestLib"
+)
+
+// input arguments of one overload of a function from pg_proc
+type function_signature struct {
+  Oid          uint32
+  Nargdefaults int
+  Arg_names    []string
+  Arg_modes    []string
+  Arg_types    []string
+}
+
+const function_signatures_query = `
+SELECT p.oid, p.pronargdefaults::int AS nargdefaults,
+  array(
+    SELECT coalesce(p.proargnames[a.n], '')
+    FROM generate_series(1, coalesce(array_length(p.proallargtypes, 1),
+      p.pronargs)) AS a(n)
+    WHERE p.proargmodes IS NULL OR p.proargmodes[a.n] IN ('i', 'b', 'v')
+    ORDER BY a.n
+  ) AS arg_names,
+  array(
+    SELECT coalesce(p.proargmodes[a.n]::text, 'i')
+    FROM generate_series(1, coalesce(array_length(p.proallargtypes, 1),
+      p.pronargs)) AS a(n)
+    WHERE p.proargmodes IS NULL OR p.proargmodes[a.n] IN ('i', 'b', 'v')
+    ORDER BY a.n
+  ) AS arg_modes,
+  array(
+    SELECT format_type(t.typ, NULL)
+    FROM unnest(p.proargtypes::oid[]) WITH ORDINALITY AS t(typ, n)
+    ORDER BY t.n
+  ) AS arg_types
+FROM pg_catalog.pg_proc p
+JOIN pg_catalog.pg_namespace n ON n.oid = p.pronamespace
+WHERE n.nspname = $1 AND p.proname = $2 AND p.prokind = 'f'`
+
+// calls the function in the url path /rpc/<schema>/<function> with the
+// JSON object in the request body as named arguments
+func (server *PgServer) rpc(w http.ResponseWriter, r *http.Request) {
+  path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/rpc/"), "/", 2)
+  if len(path) != 2 || path[0] == "" || path[1] == "" {
+    http.Error(w, "error rpc path must be /rpc/{schema}/{function}",
+      http.StatusBadRequest)
+    return
+  }
+  schema_name, function_name := path[0], path[1]
+  body, err := ioutil.ReadAll(r.Body)
+  if check_err(r.Context(), w, err, "reading request body") {
+    return
+  }
+  defer r.Body.Close()
+  json_args := make(map[string]json.RawMessage)
+  if len(strings.TrimSpace(string(body))) > 0 {
+    err = json.Unmarshal(body, &json_args)
+    if check_err(r.Context(), w, err, "unmarshaling function arguments") {
+      return
+    }
+  }
+  signatures := make([]*function_signature, 0)
+  err = pgxscan.Select(r.Context(), server.db(r.Context()), &signatures,
+    function_signatures_query, schema_name, function_name)
+  if check_err(r.Context(), w, err, "getting function signatures") {
+    return
+  }
+  if len(signatures) == 0 {
+    http.Error(w, fmt.Sprintf("error no such function %s.%s", schema_name,
+      function_name), http.StatusNotFound)
+    return
+  }
+  var matched []*function_signature
+  for _, signature := range signatures {
+    if signature.matches(json_args) {
+      matched = append(matched, signature)
+    }
+  }
+  if len(matched) == 0 {
+    http.Error(w, fmt.Sprintf("error no overload of %s.%s matches the " +
+      "arguments", schema_name, function_name), http.StatusBadRequest)
+    return
+  }
+  if len(matched) > 1 {
+    http.Error(w, fmt.Sprintf("error call to %s.%s is ambiguous between %d " +
+      "overloads", schema_name, function_name, len(matched)),
+      http.StatusBadRequest)
+    return
+  }
+  signature := matched[0]
+  var call_args []string
+  var args []interface{}
+  for i, arg_name := range signature.Arg_names {
+    raw, ok := json_args[arg_name]
+    if !ok {
+      continue
+    }
+    arg_type := signature.Arg_types[i]
+    arg, err := json_to_text(raw, strings.HasSuffix(arg_type, "[]"))
+    if err != nil {
+      http.Error(w, fmt.Sprintf("error binding argument '%s': %v", arg_name,
+        err), http.StatusBadRequest)
+      return
+    }
+    args = append(args, arg)
+    call_arg := fmt.Sprintf("%s => $%d::%s", pgx.Identifier{arg_name}.Sanitize(),
+      len(args), arg_type)
+    if signature.Arg_modes[i] == "v" {
+      call_arg = "VARIADIC " + call_arg
+    }
+    call_args = append(call_args, call_arg)
+  }
+  // selecting from the function returns scalar, composite and set results
+  // alike as rows
+  query := fmt.Sprintf("SELECT * FROM %s(%s)",
+    pgx.Identifier{schema_name, function_name}.Sanitize(),
+    strings.Join(call_args, ", "))
+  rows, err := server.db(r.Context()).Query(r.Context(), query, args...)
+  if err != nil {
+    send_result_err(r.Context(), w, err)
+    return
+  }
+  defer rows.Close()
+  rows_jsonl, err := rows_to_jsonl(r.Context(), w, rows)
+  if err != nil {
+    return
+  }
+  if err := rows.Err(); err != nil {
+    send_result_err(r.Context(), w, err)
+    return
+  }
+  send_json(r.Context(), w, pgrest.Result {
+    Success: rows_jsonl, Truncated: truncated(r.Context()),
+  }, "result")
+}
+
+// true if every argument names an input parameter and every parameter
+// without a default is given
+func (signature *function_signature) matches(
+  json_args map[string]json.RawMessage,
+) bool {
+  params := make(map[string]bool)
+  nrequired := len(signature.Arg_names) - signature.Nargdefaults
+  for i, arg_name := range signature.Arg_names {
+    if _, ok := json_args[arg_name]; !ok && i < nrequired {
+      return false
+    }
+    params[arg_name] = true
+  }
+  for arg_name := range json_args {
+    if arg_name == "" || !params[arg_name] {
+      return false
+    }
+  }
+  return true
+}
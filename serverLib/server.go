@@ -2,17 +2,24 @@ package server
 
 import (
   "context"
+  "crypto/subtle"
+  "errors"
   "fmt"
   "io/ioutil"
   "log"
+  "log/slog"
   "net/http"
   "strings"
+  "sync/atomic"
+  "time"
 )
 
 import (
   "github.com/georgysavva/scany/v2/pgxscan"
   "github.com/jackc/pgx/v5"
+  "github.com/jackc/pgx/v5/pgconn"
   "github.com/jackc/pgx/v5/pgtype"
+  "github.com/jackc/pgx/v5/pgxpool"
   json "github.com/goccy/go-json"
 )
 
@@ -21,10 +28,48 @@ import (
 )
 
 type PgServer struct {
-  conn  *pgx.Conn
-  ctx   context.Context
+  pool        *pgxpool.Pool
+  queries     *query_registry
+  migrations  []*migration
+  openapi_doc *openapi_cache
+  idempotency *idempotency_store
+  cert_roles  *client_cert_roles
+  // first path segments of disabled endpoints
+  disabled     map[string]bool
+  auth_token   string
+  log_requests bool
+  draining     *atomic.Bool
+  metrics      *server_metrics
+  logger       *slog.Logger
+  log_headers  bool
+  // canonical names of headers not to log
+  redact_headers map[string]bool
+  timeouts       []*session_timeout
+  max_rows       int
+  max_bytes      int
+  quotas         *quota_store
+  notifier       *notifier
+  change_acks    *change_acks
+  // done when the server drains, ending change streams
+  streams      context.Context
+  stop_streams context.CancelFunc
+  // origins allowed to open websockets besides the server's own
+  websocket_origins []string
 }
 
+// the methods handlers run queries with; implemented by the pool, by the
+// connection of a request with a client certificate role and by the
+// transaction of a request with an idempotency key
+type querier interface {
+  Begin(ctx context.Context) (pgx.Tx, error)
+  Exec(ctx context.Context, sql string, args ...interface{}) (
+    pgconn.CommandTag, error)
+  Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+  QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+type tx_key struct{}
+
 type constraint_name struct {
   Conname pgtype.Text
 }
@@ -33,24 +78,311 @@ type column_name struct {
   Column_name pgtype.Text
 }
 
+type Options struct {
+  // pool settings; zero keeps the value from the connection string or the
+  // pgxpool default
+  MaxConns        int32
+  MinConns        int32
+  MaxConnLifetime time.Duration
+  MaxConnIdleTime time.Duration
+  // how long idempotency keys are remembered; zero means 24 hours
+  IdempotencyRetention time.Duration
+  // endpoints by their first path segment, e.g. "/execSql" or "/tables";
+  // empty Endpoints enables all of them but /admin, which lists every
+  // caller and has to be named, and Disabled wins over Endpoints.
+  // Disabling /execSql also disables /defineQuery and /dropQuery
+  Endpoints         []string
+  DisabledEndpoints []string
+  // when set, requests need an "Authorization: Bearer <AuthToken>" header
+  AuthToken string
+  // nil logs with slog.Default()
+  Logger      *slog.Logger
+  LogRequests bool
+  // logs the request headers, with the values of RedactHeaders (by default
+  // Authorization, Proxy-Authorization, Cookie and Set-Cookie) replaced
+  LogHeaders    bool
+  RedactHeaders []string
+  // logs SQL with its literals; by default they are replaced with ?
+  LogSQLLiterals bool
+  // queries taking at least this long are logged at warn level, others at
+  // debug level; zero disables the slow query log
+  SlowQuery time.Duration
+  // defaults for statement_timeout, lock_timeout and
+  // idle_in_transaction_session_timeout, which requests can override with the
+  // X-Statement-Timeout, X-Lock-Timeout and X-Idle-In-Transaction-Timeout
+  // headers, up to the maximums; zero sets no default or no maximum
+  StatementTimeout            time.Duration
+  MaxStatementTimeout         time.Duration
+  LockTimeout                 time.Duration
+  MaxLockTimeout              time.Duration
+  IdleInTransactionTimeout    time.Duration
+  MaxIdleInTransactionTimeout time.Duration
+  // caps on the rows and bytes of json lines results; longer results are cut
+  // short and marked as truncated; zero means no cap
+  MaxRows  int
+  MaxBytes int
+  // quotas by endpoint class (CatalogClass, ReadClass, WriteClass and
+  // ExecSqlClass), applied to each client certificate role or client IP
+  // address; classes without a quota are unlimited
+  Quotas map[string]Quota
+  // origins, e.g. "https://dashboard.example.com", allowed to subscribe to
+  // notifications over websockets besides the server's own; "*" allows any
+  WebSocketOrigins []string
+}
+
+// the first path segments of the routes, for enabling and disabling endpoints
+var endpoint_names = []string {
+  "/dt", "/dn", "/df", "/d", "/dc", "/idx", "/create", "/createIndex", "/read",
+  "/insert", "/upsert", "/delete", "/priv", "/execSql", "/exec", "/own", "/du",
+  "/add", "/queries", "/defineQuery", "/dropQuery", openapi_path, "/tables",
+  "/query", "/rpc", metrics_path, "/admin", "/listen", "/notify", "/slots",
+  "/createSlot", "/dropSlot", "/publications", "/createPublication",
+  "/dropPublication", "/changes", "/ackChanges", "/dv", "/dm", "/ds",
+  "/triggers", "/constraints", "/migrate", "/ddl", "/dropIndex",
+  "/aggregate",
+}
+
+// queries run on the request context, so a client that disconnects or times
+// out cancels its running query; the pool replaces the connection pgx closes
+// on cancellation
 func MakeServer(connString string) (PgServer, error) {
-  cfg, err := pgx.ParseConfig(connString)
+  return MakeServerWithOptions(connString, Options { LogRequests: true })
+}
+
+func MakeServerWithOptions(connString string, opts Options) (PgServer, error) {
+  disabled, err := disabled_endpoints(opts.Endpoints, opts.DisabledEndpoints)
   if err != nil {
-    log.Println("error parsing pg connection string:", err)
     return PgServer{}, err
   }
-  ctx := context.Background()
-  conn, err := pgx.ConnectConfig(ctx, cfg)
+  cfg, err := pgxpool.ParseConfig(connString)
   if err != nil {
-    log.Println("error creating pg connection:", err)
-    return PgServer{}, err
+    return PgServer{}, fmt.Errorf("error parsing pg connection string: %w", err)
+  }
+  if opts.MaxConns > 0 {
+    cfg.MaxConns = opts.MaxConns
+  }
+  if opts.MinConns > 0 {
+    cfg.MinConns = opts.MinConns
+  }
+  if opts.MaxConnLifetime > 0 {
+    cfg.MaxConnLifetime = opts.MaxConnLifetime
+  }
+  if opts.MaxConnIdleTime > 0 {
+    cfg.MaxConnIdleTime = opts.MaxConnIdleTime
+  }
+  metrics := make_metrics()
+  cfg.ConnConfig.Tracer = &query_tracer {
+    metrics: metrics,
+    slow_query: opts.SlowQuery,
+    sql_literals: opts.LogSQLLiterals,
+  }
+  pool, err := pgxpool.NewWithConfig(context.Background(), cfg)
+  if err != nil {
+    return PgServer{}, fmt.Errorf("error creating pg connection pool: %w", err)
+  }
+  metrics.register_pool(pool)
+  logger := opts.Logger
+  if logger == nil {
+    logger = slog.Default()
+  }
+  redact_headers := make(map[string]bool)
+  if opts.RedactHeaders == nil {
+    opts.RedactHeaders = default_redact_headers
+  }
+  for _, name := range opts.RedactHeaders {
+    redact_headers[http.CanonicalHeaderKey(name)] = true
+  }
+  idempotency := &idempotency_store {
+    retention: default_idempotency_retention,
+  }
+  if opts.IdempotencyRetention > 0 {
+    idempotency.retention = opts.IdempotencyRetention
+  }
+  streams, stop_streams := context.WithCancel(context.Background())
+  return PgServer {
+    pool: pool,
+    queries: make_query_registry(),
+    openapi_doc: &openapi_cache{},
+    idempotency: idempotency,
+    disabled: disabled,
+    auth_token: opts.AuthToken,
+    log_requests: opts.LogRequests,
+    draining: &atomic.Bool{},
+    metrics: metrics,
+    logger: logger,
+    log_headers: opts.LogHeaders,
+    redact_headers: redact_headers,
+    timeouts: []*session_timeout {
+      { "statement_timeout", "X-Statement-Timeout", opts.StatementTimeout,
+        opts.MaxStatementTimeout },
+      { "lock_timeout", "X-Lock-Timeout", opts.LockTimeout,
+        opts.MaxLockTimeout },
+      { "idle_in_transaction_session_timeout",
+        "X-Idle-In-Transaction-Timeout", opts.IdleInTransactionTimeout,
+        opts.MaxIdleInTransactionTimeout },
+    },
+    max_rows: opts.MaxRows,
+    max_bytes: opts.MaxBytes,
+    quotas: make_quota_store(opts.Quotas),
+    notifier: make_notifier(cfg.ConnConfig.Copy()),
+    websocket_origins: opts.WebSocketOrigins,
+    change_acks: &change_acks { lsns: make(map[string]uint64) },
+    streams: streams,
+    stop_streams: stop_streams,
+  }, nil
+}
+
+// returns the set of endpoints not enabled
+func disabled_endpoints(enabled []string, disabled []string) (
+  map[string]bool, error,
+) {
+  known := make(map[string]bool)
+  for _, name := range endpoint_names {
+    known[name] = true
+  }
+  // /admin shows the address and usage of every caller, so it is only
+  // served when named in enabled
+  result := map[string]bool { "/admin": true }
+  for _, names := range [][]string { enabled, disabled } {
+    for _, name := range names {
+      if !known["/" + strings.TrimPrefix(name, "/")] {
+        return nil, fmt.Errorf("unknown endpoint '%s'", name)
+      }
+    }
+  }
+  if len(enabled) > 0 {
+    for name := range known {
+      result[name] = true
+    }
+    for _, name := range enabled {
+      delete(result, "/" + strings.TrimPrefix(name, "/"))
+    }
+  }
+  for _, name := range disabled {
+    result["/" + strings.TrimPrefix(name, "/")] = true
+  }
+  // defining a named query runs arbitrary sql through /query, so it goes
+  // with /execSql
+  if result["/execSql"] {
+    result["/defineQuery"] = true
+    result["/dropQuery"] = true
+  }
+  return result, nil
+}
+
+func (server *PgServer) Close() {
+  server.notifier.close()
+  server.stop_streams()
+  server.pool.Close()
+}
+
+// returns the transaction of the request context if there is one, otherwise
+// its role connection if there is one, otherwise the pool
+func (server *PgServer) db(ctx context.Context) querier {
+  if tx, ok := ctx.Value(tx_key{}).(pgx.Tx); ok {
+    return tx
+  }
+  if conn, ok := ctx.Value(conn_key{}).(*pgxpool.Conn); ok {
+    return conn
   }
-  return PgServer { conn, ctx }, nil
+  return server.pool
 }
 
 func (server *PgServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-  log.Printf("received: %+v\n", r)
-  log.Printf("URL: %v -----------------------------------------------\n", r.URL)
+  server.instrument(w, r, server.serve)
+}
+
+func (server *PgServer) serve(w http.ResponseWriter, r *http.Request) {
+  // probes need neither auth nor a role
+  switch r.URL.Path {
+    case "/healthz":
+      server.healthz(w, r)
+      return
+    case "/readyz":
+      server.readyz(w, r)
+      return
+  }
+  if server.auth_token != "" {
+    token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    if subtle.ConstantTimeCompare([]byte(token),
+      []byte(server.auth_token)) != 1 {
+      w.Header().Set("WWW-Authenticate", "Bearer")
+      http.Error(w, "error invalid or missing auth token",
+        http.StatusUnauthorized)
+      return
+    }
+  }
+  if server.disabled[endpoint_name(r.URL.Path)] {
+    http.Error(w, "error endpoint is disabled", http.StatusNotFound)
+    return
+  }
+  if r.URL.Path == metrics_path {
+    server.scrapeMetrics(w, r)
+    return
+  }
+  role, err := server.client_cert_role(r)
+  if err != nil {
+    http.Error(w, "error " + err.Error(), http.StatusForbidden)
+    return
+  }
+  release_quota, ok := server.check_quota(w, r, role)
+  if !ok {
+    return
+  }
+  defer release_quota()
+  if r.URL.Path == quotas_path {
+    server.quotaUsage(w, r)
+    return
+  }
+  // streams don't hold a pool connection while they stream
+  switch r.URL.Path {
+    case "/listen":
+      server.listen(w, r)
+      return
+    case "/changes":
+      r.Context().Value(request_info_key{}).(*request_info).role = role
+      server.changes(w, r, role)
+      return
+  }
+  set, reset, err := server.session_settings(r)
+  if err != nil {
+    http.Error(w, "error " + err.Error(), http.StatusBadRequest)
+    return
+  }
+  if role != "" || len(set) > 0 {
+    r.Context().Value(request_info_key{}).(*request_info).role = role
+    session_r, release, err := server.with_session(r, role, set, reset)
+    var pg_err *pgconn.PgError
+    if role != "" && errors.As(err, &pg_err) {
+      http.Error(w, fmt.Sprintf("error switching to role %s: %v", role, err),
+        http.StatusForbidden)
+      return
+    }
+    if check_err(r.Context(), w, err, "setting up the connection") {
+      return
+    }
+    defer release()
+    r = session_r
+  }
+  if key := r.Header.Get(idempotency_header); key != "" && is_mutating(r) {
+    server.with_idempotency_key(w, r, role, key, server.route)
+    return
+  }
+  server.route(w, r)
+}
+
+// the first segment of path
+func endpoint_name(path string) string {
+  if path == "" {
+    return path
+  }
+  if i := strings.Index(path[1:], "/"); i >= 0 {
+    return path[:i + 1]
+  }
+  return path
+}
+
+func (server *PgServer) route(w http.ResponseWriter, r *http.Request) {
   switch r.URL.Path {
     case "/dt": server.dt(w, r)
     case "/dn": server.dn(w, r)
@@ -58,9 +390,17 @@ func (server *PgServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
     case "/d": server.d(w, r)
     case "/dc": server.dc(w, r)
     case "/idx": server.idx(w, r)
+    case "/dv": server.dv(w, r)
+    case "/dm": server.dm(w, r)
+    case "/ds": server.ds(w, r)
+    case "/triggers": server.triggers(w, r)
+    case "/constraints": server.constraints(w, r)
+    case "/ddl": server.ddl(w, r)
     case "/create": server.create(w, r)
     case "/createIndex": server.createIndex(w, r)
+    case "/dropIndex": server.dropIndex(w, r)
     case "/read": server.read(w, r)
+    case "/aggregate": server.aggregate(w, r)
     case "/insert": server.insert(w, r)
     case "/upsert": server.upsert(w, r)
     case "/delete": server.delete(w, r)
@@ -70,63 +410,56 @@ func (server *PgServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
     case "/own": server.own(w, r)
     case "/du": server.du(w, r)
     case "/add": server.add(w, r)
+    case "/queries": server.queryList(w, r)
+    case "/defineQuery": server.defineQuery(w, r)
+    case "/dropQuery": server.dropQuery(w, r)
+    case openapi_path: server.openapi(w, r)
+    case "/tables": server.tables(w, r)
+    case "/notify": server.notify(w, r)
+    case "/slots": server.slots(w, r)
+    case "/createSlot": server.createSlot(w, r)
+    case "/dropSlot": server.dropSlot(w, r)
+    case "/publications": server.publications(w, r)
+    case "/createPublication": server.createPublication(w, r)
+    case "/dropPublication": server.dropPublication(w, r)
+    case "/ackChanges": server.ackChanges(w, r)
+    case "/migrate": server.migrate(w, r)
     default:
+      if strings.HasPrefix(r.URL.Path, "/query/") {
+        server.query(w, r)
+        return
+      }
+      if strings.HasPrefix(r.URL.Path, "/rpc/") {
+        server.rpc(w, r)
+        return
+      }
+      if strings.HasPrefix(r.URL.Path, "/tables/") {
+        server.tables(w, r)
+        return
+      }
       http.Error(w, "Invalid request URL", http.StatusBadRequest)
   }
 }
 
-func (server *PgServer) dt(w http.ResponseWriter, r *http.Request) {
-  tables := make([]*pgrest.Table, 0)
-  err := pgxscan.Select(server.ctx, server.conn, &tables,
-    "SELECT * FROM pg_catalog.pg_tables WHERE schemaname = 'public'")
-  if check_err(w, err, "getting tables") {
-    return
-  }
-  send_json(w, tables, "tables")
-}
-
 func (server *PgServer) dn(w http.ResponseWriter, r *http.Request) {
   schemas := make([]*pgrest.Schema, 0)
-  err := pgxscan.Select(server.ctx, server.conn, &schemas,
+  err := pgxscan.Select(r.Context(), server.db(r.Context()), &schemas,
     "SELECT * FROM information_schema.schemata")
-  if check_err(w, err, "getting schemas") {
+  if check_err(r.Context(), w, err, "getting schemas") {
     return
   }
-  send_json(w, schemas, "schemas")
+  send_json(r.Context(), w, schemas, "schemas")
 }
 
 func (server *PgServer) df(w http.ResponseWriter, r *http.Request) {
   functions := make([]*pgrest.Function, 0)
-  err := pgxscan.Select(server.ctx, server.conn, &functions,
+  err := pgxscan.Select(r.Context(), server.db(r.Context()), &functions,
     "SELECT specific_schema, specific_name, type_udt_name " +
     "FROM information_schema.routines WHERE specific_schema = 'public'")
-  if check_err(w, err, "getting functions") {
-    return
-  }
-  send_json(w, functions, "functions")
-}
-
-func (server *PgServer) d(w http.ResponseWriter, r *http.Request) {
-  var req_table pgrest.ReqTable
-  if !unmarshal_body(w, r, &req_table) {
-    return
-  }
-  columns := make([]*pgrest.Column, 0)
-  var query   string
-  if req_table.TableName == "all" {
-    query = "SELECT column_name, data_type, collation_name, is_nullable, column_default " +
-      "FROM information_schema.columns"
-  } else {
-    query = fmt.Sprintf(
-      "SELECT column_name, data_type, collation_name, is_nullable, column_default " +
-      "FROM information_schema.columns WHERE table_name = '%s'",
-      req_table.TableName)
-  }
-  err := pgxscan.Select(server.ctx, server.conn, &columns, query)
-  if check_err(w, err, "getting columns") {
+  if check_err(r.Context(), w, err, "getting functions") {
     return
   }
-  send_json(w, columns, "columns")
+  send_json(r.Context(), w, functions, "functions")
 }
 
 func (server *PgServer) dc(w http.ResponseWriter, r *http.Request) {
@@ -138,23 +471,24 @@ func (server *PgServer) dc(w http.ResponseWriter, r *http.Request) {
   query := fmt.Sprintf("SELECT data_type FROM information_schema.columns " +
     "WHERE table_name = '%s' AND column_name = '%s'",
     req_col.TableName, req_col.ColumnName)
-  err := pgxscan.Select(server.ctx, server.conn, &data_type, query)
-  if check_err(w, err, "getting column data type") {
+  err := pgxscan.Select(r.Context(), server.db(r.Context()),
+    &data_type, query)
+  if check_err(r.Context(), w, err, "getting column data type") {
     return
   }
   if len(data_type) == 0 {
-    log.Println("error column not found")
+    request_logger(r.Context()).Error("error column not found")
     http.Error(w, fmt.Sprintf("error no such column"),
       http.StatusInternalServerError)
     return
   }
   if len(data_type) > 1 {
-    log.Println("error got multiple columns")
+    request_logger(r.Context()).Error("error got multiple columns")
     http.Error(w, fmt.Sprintf("error matched multiple columns: %+v\n", data_type),
       http.StatusInternalServerError)
     return
   }
-  send_json(w, data_type[0], "data type")
+  send_json(r.Context(), w, data_type[0], "data type")
 }
 
 func (server *PgServer) idx(w http.ResponseWriter, r *http.Request) {
@@ -165,11 +499,12 @@ func (server *PgServer) idx(w http.ResponseWriter, r *http.Request) {
   indexes := make([]*pgrest.Index, 0)
   query := fmt.Sprintf("SELECT * FROM pg_indexes WHERE tablename = '%s'",
     req_table.TableName)
-  err := pgxscan.Select(server.ctx, server.conn, &indexes, query)
-  if check_err(w, err, "getting indexes") {
+  err := pgxscan.Select(r.Context(), server.db(r.Context()),
+    &indexes, query)
+  if check_err(r.Context(), w, err, "getting indexes") {
     return
   }
-  send_json(w, indexes, "indexes")
+  send_json(r.Context(), w, indexes, "indexes")
 }
 
 func (server *PgServer) create(w http.ResponseWriter, r *http.Request) {
@@ -178,17 +513,7 @@ func (server *PgServer) create(w http.ResponseWriter, r *http.Request) {
     return
   }
   stmt := fmt.Sprintf("CREATE TABLE \"%s\"()", req_table.TableName)
-  server.exec_stmt(w, stmt)
-}
-
-func (server *PgServer) createIndex(w http.ResponseWriter, r *http.Request) {
-  var cre_idx pgrest.CreateIndex
-  if !unmarshal_body(w, r, &cre_idx) {
-    return
-  }
-  stmt := fmt.Sprintf("CREATE INDEX \"%s\" ON \"%s\" (\"%s\")", cre_idx.IndexName,
-    cre_idx.TableName, cre_idx.ColumnName)
-  server.exec_stmt(w, stmt)
+  server.exec_stmt(r.Context(), w, stmt)
 }
 
 func (server *PgServer) read(w http.ResponseWriter, r *http.Request) {
@@ -196,31 +521,35 @@ func (server *PgServer) read(w http.ResponseWriter, r *http.Request) {
   if !unmarshal_body(w, r, &read_cols) {
     return
   }
-  var sel_cols string
-  ncols := len(read_cols.ColumnNames)
-  if ncols == 0 {
-    sel_cols = "*"
-  } else {
-    quoted_cols := make([]string, ncols)
-    for i, s := range read_cols.ColumnNames {
-      quoted_cols[i] = fmt.Sprintf("\"%s\"", s)
-    }
-    sel_cols = strings.Join(quoted_cols, ", ")
+  query, args, err := server.read_query(r.Context(), read_cols)
+  var read_err *read_error
+  if errors.As(err, &read_err) {
+    http.Error(w, err.Error(), read_err.status)
+    return
   }
-  query := fmt.Sprintf("SELECT %s FROM \"%s\"", sel_cols, read_cols.TableName)
-  rows, err := server.conn.Query(server.ctx, query)
-  if check_err(w, err, "getting rows") {
+  if check_err(r.Context(), w, err, "building query") {
+    return
+  }
+  rows, err := server.db(r.Context()).Query(r.Context(), query, args...)
+  if err != nil {
+    send_pg_err(w, err)
     return
   }
   defer rows.Close()
-  rows_jsonl, err := rows_to_jsonl(w, rows)
-  if check_err(w, err, "converting rows to json lines") {
+  rows_jsonl, err := rows_to_jsonl(r.Context(), w, rows)
+  if err != nil {
+    return
+  }
+  // filter casts and embed subqueries fail while the rows are read
+  if err := rows.Err(); err != nil {
+    send_pg_err(w, err)
     return
   }
   result := pgrest.Result {
     Success: rows_jsonl,
+    Truncated: truncated(r.Context()),
   }
-  send_json(w, result, "result")
+  send_json(r.Context(), w, result, "result")
 }
 
 func (server *PgServer) insert(w http.ResponseWriter, r *http.Request) {
@@ -238,7 +567,7 @@ func (server *PgServer) insert(w http.ResponseWriter, r *http.Request) {
   vals_string := strings.Join(vals, ",")
   stmt := fmt.Sprintf("INSERT INTO \"%s\" (%s) VALUES (%s)", insert.TableName,
     cols_string, vals_string)
-  server.exec_stmt(w, stmt)
+  server.exec_stmt(r.Context(), w, stmt)
 }
 
 func (server *PgServer) upsert(w http.ResponseWriter, r *http.Request) {
@@ -251,8 +580,9 @@ func (server *PgServer) upsert(w http.ResponseWriter, r *http.Request) {
   query := fmt.Sprintf("SELECT conname FROM pg_constraint " +
     "WHERE conrelid = '%s'::regclass AND confrelid = 0",
     insert.TableName)
-  err := pgxscan.Select(server.ctx, server.conn, &conname, query)
-  if check_err(w, err, "getting primary key constraint name") {
+  err := pgxscan.Select(r.Context(), server.db(r.Context()),
+    &conname, query)
+  if check_err(r.Context(), w, err, "getting primary key constraint name") {
     return
   }
   if len(conname) == 0 {
@@ -260,7 +590,7 @@ func (server *PgServer) upsert(w http.ResponseWriter, r *http.Request) {
     result := pgrest.Result {
       Error: &errmsg,
     }
-    send_json_err(w, result, "result")
+    send_json_err(r.Context(), w, result, "result")
     return
   }
   pkey_conname := conname[0].Conname.String;
@@ -269,8 +599,9 @@ func (server *PgServer) upsert(w http.ResponseWriter, r *http.Request) {
     "SELECT column_name FROM information_schema.key_column_usage " +
     "WHERE table_name = '%s' AND constraint_name = '%s'",
     insert.TableName, pkey_conname)
-  err = pgxscan.Select(server.ctx, server.conn, &keyname, query)
-  if check_err(w, err, "getting primary key") {
+  err = pgxscan.Select(r.Context(), server.db(r.Context()),
+    &keyname, query)
+  if check_err(r.Context(), w, err, "getting primary key") {
     return
   }
   // do the upsert
@@ -290,7 +621,7 @@ func (server *PgServer) upsert(w http.ResponseWriter, r *http.Request) {
     "ON CONFLICT (%s) DO UPDATE SET %s",
     insert.TableName, cols_string, vals_string, keyname[0].Column_name.String,
     update_string)
-  server.exec_stmt(w, stmt)
+  server.exec_stmt(r.Context(), w, stmt)
 }
 
 func (server *PgServer) delete(w http.ResponseWriter, r *http.Request) {
@@ -305,7 +636,7 @@ func (server *PgServer) delete(w http.ResponseWriter, r *http.Request) {
   cols_string := strings.Join(cols, ",")
   stmt := fmt.Sprintf("ALTER TABLE \"%s\" DROP COLUMN %s", delete.TableName,
     cols_string)
-  server.exec_stmt(w, stmt)
+  server.exec_stmt(r.Context(), w, stmt)
 }
 
 func (server *PgServer) priv(w http.ResponseWriter, r *http.Request) {
@@ -314,12 +645,12 @@ func (server *PgServer) priv(w http.ResponseWriter, r *http.Request) {
 
 func (server *PgServer) execSql(w http.ResponseWriter, r *http.Request) {
   body, err := ioutil.ReadAll(r.Body)
-  if check_err(w, err, "reading request body") {
+  if check_err(r.Context(), w, err, "reading request body") {
     return
   }
   defer r.Body.Close()
   sql := string(body)
-  server.exec_user_stmt(w, sql)
+  server.exec_user_stmt(r.Context(), w, sql)
 }
 
 func (server *PgServer) exec(w http.ResponseWriter, r *http.Request) {
@@ -329,7 +660,12 @@ func (server *PgServer) exec(w http.ResponseWriter, r *http.Request) {
   }
   var sql string
   // TODO: support other url schemes besides http?
-  resp, err := http.Get(exec.Url.String())
+  req, err := http.NewRequestWithContext(r.Context(), "GET", exec.Url.String(),
+    nil)
+  if check_err(r.Context(), w, err, "creating exec URL request") {
+    return
+  }
+  resp, err := http.DefaultClient.Do(req)
   if err != nil {
     // NOTE: not using the check_err function here because status is bad
     // gateway instead of internal server error
@@ -340,7 +676,7 @@ func (server *PgServer) exec(w http.ResponseWriter, r *http.Request) {
   }
   defer resp.Body.Close()
   body, err := ioutil.ReadAll(resp.Body)
-  if check_err(w, err, "reading get exec response body") {
+  if check_err(r.Context(), w, err, "reading get exec response body") {
     return
   }
   if resp.StatusCode != 200 {
@@ -351,7 +687,7 @@ func (server *PgServer) exec(w http.ResponseWriter, r *http.Request) {
     return
   }
   sql = string(body)
-  server.exec_user_stmt(w, sql)
+  server.exec_user_stmt(r.Context(), w, sql)
 }
 
 func (server *PgServer) own(w http.ResponseWriter, r *http.Request) {
@@ -361,17 +697,17 @@ func (server *PgServer) own(w http.ResponseWriter, r *http.Request) {
   }
   stmt := fmt.Sprintf("ALTER TABLE \"%s\" OWNER TO \"%s\"", own.TableName,
     own.Owner)
-  server.exec_stmt(w, stmt)
+  server.exec_stmt(r.Context(), w, stmt)
 }
 
 func (server *PgServer) du(w http.ResponseWriter, r *http.Request) {
   users := make([]*pgrest.User, 0)
-  err := pgxscan.Select(server.ctx, server.conn, &users,
+  err := pgxscan.Select(r.Context(), server.db(r.Context()), &users,
     "SELECT usename FROM pg_user")
-  if check_err(w, err, "getting users") {
+  if check_err(r.Context(), w, err, "getting users") {
     return
   }
-  send_json(w, users, "users")
+  send_json(r.Context(), w, users, "users")
 }
 
 func (server *PgServer) add(w http.ResponseWriter, r *http.Request) {
@@ -380,61 +716,125 @@ func (server *PgServer) add(w http.ResponseWriter, r *http.Request) {
     return
   }
   stmt := fmt.Sprintf("CREATE USER \"%s\"", create_user.UserName)
-  server.exec_stmt(w, stmt)
+  server.exec_stmt(r.Context(), w, stmt)
 }
 
-func (server *PgServer) exec_user_stmt(w http.ResponseWriter, stmt string) {
+func (server *PgServer) exec_user_stmt(
+  ctx context.Context, w http.ResponseWriter, stmt string,
+) {
   if strings.HasPrefix(stmt, "SELECT") {
-    rows, err := server.conn.Query(server.ctx, stmt)
-    if check_err(w, err, "getting rows") {
+    rows, err := server.db(ctx).Query(ctx, stmt)
+    if check_err(ctx, w, err, "getting rows") {
       return
     }
     defer rows.Close()
-    rows_jsonl, err := rows_to_jsonl(w, rows)
-    if check_err(w, err, "converting rows to json lines") {
+    rows_jsonl, err := rows_to_jsonl(ctx, w, rows)
+    if check_err(ctx, w, err, "converting rows to json lines") {
+      return
+    }
+    // a statement timeout or cancellation ends the rows early
+    if err := rows.Err(); err != nil {
+      send_pg_err(w, err)
       return
     }
     result := pgrest.Result {
       Success: rows_jsonl,
+      Truncated: truncated(ctx),
     }
-    send_json(w, result, "result")
+    send_json(ctx, w, result, "result")
   } else {
-    server.exec_stmt(w, stmt)
+    // the simple protocol, which runs every statement of the sql
+    server.run_stmt(ctx, w, stmt, func(tx pgx.Tx) (pgconn.CommandTag, error) {
+      return tx.Exec(ctx, stmt)
+    })
   }
 }
 
-// returns false on error
-func (server *PgServer) exec_stmt(w http.ResponseWriter, stmt string) bool {
-  tx, err := server.conn.Begin(server.ctx)
-  if check_err(w, err, "beginning transaction") {
+// runs a single statement over the extended protocol. pgx sends statements
+// without arguments over the simple protocol, which runs every statement of a
+// string with semicolons, so sql from a request, like the expressions of an
+// index, could append statements of its own
+func exec_single(
+  ctx context.Context, db querier, stmt string,
+) (pgconn.CommandTag, error) {
+  rows, err := db.Query(ctx, stmt, pgx.QueryExecModeExec)
+  if err != nil {
+    return pgconn.CommandTag{}, err
+  }
+  rows.Close()
+  return rows.CommandTag(), rows.Err()
+}
+
+// runs stmt, a single statement, in a transaction; returns false on error
+func (server *PgServer) exec_stmt(
+  ctx context.Context, w http.ResponseWriter, stmt string,
+) bool {
+  return server.run_stmt(ctx, w, stmt,
+    func(tx pgx.Tx) (pgconn.CommandTag, error) {
+      return exec_single(ctx, tx, stmt)
+    })
+}
+
+// runs stmt with exec in a transaction; returns false on error
+func (server *PgServer) run_stmt(
+  ctx context.Context, w http.ResponseWriter, stmt string,
+  exec func(tx pgx.Tx) (pgconn.CommandTag, error),
+) bool {
+  tx, err := server.db(ctx).Begin(ctx)
+  if check_err(ctx, w, err, "beginning transaction") {
     return false
   }
-  defer tx.Rollback(server.ctx)
-  res, err := tx.Exec(server.ctx, stmt)
+  defer tx.Rollback(ctx)
+  res, err := exec(tx)
   if err != nil {
     err_string := err.Error()
     result := pgrest.Result {
       Error: &err_string,
     }
-    send_json_err(w, result, "result")
+    send_json_err(ctx, w, result, "result")
+    return false
+  }
+  err = tx.Commit(ctx)
+  if check_err(ctx, w, err, "committing transaction") {
+    return false
+  }
+  res_string := res.String()
+  result := pgrest.Result {
+    Success: &res_string,
+  }
+  send_json(ctx, w, result, "result")
+  return true
+}
+
+// runs stmt, a single statement, outside a transaction, as statements like
+// CREATE INDEX CONCURRENTLY need; returns false on error
+func (server *PgServer) exec_stmt_no_tx(
+  ctx context.Context, w http.ResponseWriter, stmt string,
+) bool {
+  if _, ok := ctx.Value(tx_key{}).(pgx.Tx); ok {
+    http.Error(w, "error statement can't run in the transaction of an " +
+      "idempotency key", http.StatusBadRequest)
     return false
   }
-  err = tx.Commit(server.ctx)
-  if check_err(w, err, "committing transaction") {
+  res, err := exec_single(ctx, server.db(ctx), stmt)
+  if err != nil {
+    send_result_err(ctx, w, err)
     return false
   }
   res_string := res.String()
   result := pgrest.Result {
     Success: &res_string,
   }
-  send_json(w, result, "result")
+  send_json(ctx, w, result, "result")
   return true
 }
 
 // returns true if error
-func check_err(w http.ResponseWriter, err error, msg string) bool {
+func check_err(
+  ctx context.Context, w http.ResponseWriter, err error, msg string,
+) bool {
   if err != nil {
-    log.Printf("error %s: %+v\n", msg, err)
+    request_logger(ctx).Error("error " + msg, "err", err)
     http.Error(w, fmt.Sprintf("error %s: %+v\n", msg, err),
       http.StatusInternalServerError)
     return true
@@ -446,67 +846,105 @@ func check_err(w http.ResponseWriter, err error, msg string) bool {
 // returns false if failed
 func unmarshal_body(w http.ResponseWriter, r *http.Request, t interface{}) bool {
   body, err := ioutil.ReadAll(r.Body)
-  if check_err(w, err, "reading request body") {
+  if check_err(r.Context(), w, err, "reading request body") {
     return false
   }
   defer r.Body.Close()
   err = json.Unmarshal(body, t)
-  if check_err(w, err, "unmarshaling") {
+  if check_err(r.Context(), w, err, "unmarshaling") {
     return false
   }
   return true
 }
 
-func send_json(w http.ResponseWriter, v interface{}, name string) {
+func send_json(
+  ctx context.Context, w http.ResponseWriter, v interface{}, name string,
+) {
   s, err := json.Marshal(v)
-  if check_err(w, err, fmt.Sprintf("converting %s to json", name)) {
+  if check_err(ctx, w, err, fmt.Sprintf("converting %s to json", name)) {
     return
   }
   fmt.Fprintln(w, string(s))
 }
 
-func send_json_err(w http.ResponseWriter, v interface{}, name string) {
+func send_json_err(
+  ctx context.Context, w http.ResponseWriter, v interface{}, name string,
+) {
   s, err := json.Marshal(v)
-  if check_err(w, err, fmt.Sprintf("converting %s to json", name)) {
+  if check_err(ctx, w, err, fmt.Sprintf("converting %s to json", name)) {
     return
   }
   http.Error(w, fmt.Sprintf("%s", string(s)), http.StatusInternalServerError)
 }
 
-func rows_to_jsonl(w http.ResponseWriter, rows pgx.Rows) (*string, error) {
+func send_result_err(ctx context.Context, w http.ResponseWriter, err error) {
+  err_string := err.Error()
+  result := pgrest.Result {
+    Error: &err_string,
+  }
+  send_json_err(ctx, w, result, "result")
+}
+
+// stops at the row and byte caps of the request, marking the response as
+// truncated
+func rows_to_jsonl(
+  ctx context.Context, w http.ResponseWriter, rows pgx.Rows,
+) (*string, error) {
+  info, _ := ctx.Value(request_info_key{}).(*request_info)
+  if info == nil {
+    info = &request_info{}
+  }
   fields := rows.FieldDescriptions()
   col_names := make([]string, len(fields))
   for i, field := range fields {
-    col_names[i] = string(field.Name)
+    name, err := json.Marshal(string(field.Name))
+    if check_err(ctx, w, err, "converting column name to json") {
+      return nil, err
+    }
+    col_names[i] = string(name)
   }
   //log.Println("column names:", col_names)
-  var rows_jsonl string
-  for rows.Next() {
-    values := make([]interface{}, len(col_names))
-    for i := range values {
-      values[i] = new(interface{})
+  var rows_jsonl strings.Builder
+  for n := 0; rows.Next(); n++ {
+    if info.max_rows > 0 && n >= info.max_rows {
+      mark_truncated(w, info)
+      break
     }
-    err := rows.Scan(values...)
-    if check_err(w, err, "scanning values") {
+    values, err := rows.Values()
+    if check_err(ctx, w, err, "scanning values") {
       return nil, err
     }
-    rows_jsonl += "{"
-    for i, value := range values {
-      if i != 0 {
-        rows_jsonl += ","
-      }
-      var val string
-      if str, ok := (*value.(*interface{})).(string); ok {
-        val = fmt.Sprintf("\"%s\"", str)
-      } else {
-        val = fmt.Sprintf("%v", *value.(*interface{}))
-      }
-      if val == "<nil>" {
-        val = "null"
-      }
-      rows_jsonl += fmt.Sprintf("\"%s\":%s", col_names[i], val)
+    line, err := row_json(col_names, values)
+    if check_err(ctx, w, err, "converting value to json") {
+      return nil, err
+    }
+    if info.max_bytes > 0 &&
+      rows_jsonl.Len() + len(line) + 1 > info.max_bytes {
+      mark_truncated(w, info)
+      break
+    }
+    rows_jsonl.WriteString(line + "\n")
+  }
+  rows_jsonl_string := rows_jsonl.String()
+  return &rows_jsonl_string, nil
+}
+
+// a row as a json object; names are json strings
+func row_json(names []string, values []interface{}) (string, error) {
+  var line strings.Builder
+  line.WriteString("{")
+  for i, value := range values {
+    if i != 0 {
+      line.WriteString(",")
+    }
+    // values are marshaled individually so strings are escaped and types
+    // like timestamps and numerics come out as valid json
+    val, err := json.Marshal(value)
+    if err != nil {
+      return "", err
     }
-    rows_jsonl += ("}\n")
+    line.WriteString(names[i] + ":" + string(val))
   }
-  return &rows_jsonl, nil
+  line.WriteString("}")
+  return line.String(), nil
 }
@@ -0,0 +1,60 @@
+package server
+
+import (
+  "testing"
+)
+
+func TestDisabledEndpoints(t *testing.T) {
+  tests := []struct {
+    name     string
+    enabled  []string
+    disabled []string
+    off      []string
+    on       []string
+  } {
+    {
+      name: "all but admin",
+      off: []string { "/admin" },
+      on: []string { "/dt", "/execSql", "/metrics" },
+    },
+    {
+      name: "admin named",
+      enabled: []string { "/dt", "admin" },
+      off: []string { "/execSql", "/tables" },
+      on: []string { "/dt", "/admin" },
+    },
+    {
+      name: "disabled wins",
+      enabled: []string { "/admin" },
+      disabled: []string { "/admin" },
+      off: []string { "/admin", "/dt" },
+    },
+    {
+      name: "exec sql takes named queries along",
+      disabled: []string { "/execSql" },
+      off: []string { "/execSql", "/defineQuery", "/dropQuery", "/admin" },
+      on: []string { "/query", "/exec" },
+    },
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      result, err := disabled_endpoints(test.enabled, test.disabled)
+      if err != nil {
+        t.Fatal(err)
+      }
+      for _, name := range test.off {
+        if !result[name] {
+          t.Errorf("%s is enabled", name)
+        }
+      }
+      for _, name := range test.on {
+        if result[name] {
+          t.Errorf("%s is disabled", name)
+        }
+      }
+    })
+  }
+  if _, err := disabled_endpoints([]string { "/nope" }, nil); err == nil {
+    t.Error("expected an error for an unknown endpoint")
+  }
+}
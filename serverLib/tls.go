@@ -0,0 +1,192 @@
+package server
+
+import (
+  "crypto/tls"
+  "crypto/x509"
+  "errors"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "os"
+  "sync"
+  "time"
+)
+
+type TLSOptions struct {
+  CertFile string
+  KeyFile  string
+  // CA bundle for verifying client certificates; empty disables client
+  // certificates
+  ClientCAFile      string
+  RequireClientCert bool
+}
+
+// where the identity of a client certificate is taken from
+const (
+  RoleFromCommonName = "cn"
+  RoleFromSAN        = "san"
+)
+
+// maps verified client certificates to postgres roles
+type client_cert_roles struct {
+  source string
+  roles  map[string]string
+}
+
+// reloads the certificate files when their modification time changes,
+// checking at most once a second
+type cert_reloader struct {
+  opts      TLSOptions
+  mutex     sync.Mutex
+  checked   time.Time
+  mod_times []time.Time
+  config    *tls.Config
+}
+
+// returns a server TLS config that picks up changes to the certificate, key
+// and CA files without a restart
+func MakeTLSConfig(opts TLSOptions) (*tls.Config, error) {
+  reloader := &cert_reloader { opts: opts }
+  err := reloader.load()
+  if err != nil {
+    return nil, err
+  }
+  return &tls.Config {
+    MinVersion: tls.VersionTLS12,
+    GetConfigForClient: reloader.get_config,
+  }, nil
+}
+
+func (reloader *cert_reloader) files() []string {
+  files := []string { reloader.opts.CertFile, reloader.opts.KeyFile }
+  if reloader.opts.ClientCAFile != "" {
+    files = append(files, reloader.opts.ClientCAFile)
+  }
+  return files
+}
+
+func (reloader *cert_reloader) load() error {
+  mod_times := make([]time.Time, 0, 3)
+  for _, file := range reloader.files() {
+    info, err := os.Stat(file)
+    if err != nil {
+      return err
+    }
+    mod_times = append(mod_times, info.ModTime())
+  }
+  cert, err := tls.LoadX509KeyPair(reloader.opts.CertFile,
+    reloader.opts.KeyFile)
+  if err != nil {
+    return err
+  }
+  // the config returned for a client replaces the server's, which net/http
+  // gave h2 for ALPN, so it has to offer HTTP/2 itself
+  config := &tls.Config {
+    MinVersion: tls.VersionTLS12,
+    Certificates: []tls.Certificate { cert },
+    NextProtos: []string { "h2", "http/1.1" },
+  }
+  if reloader.opts.ClientCAFile != "" {
+    pem, err := os.ReadFile(reloader.opts.ClientCAFile)
+    if err != nil {
+      return err
+    }
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(pem) {
+      return fmt.Errorf("no certificates in %s", reloader.opts.ClientCAFile)
+    }
+    config.ClientCAs = pool
+    if reloader.opts.RequireClientCert {
+      config.ClientAuth = tls.RequireAndVerifyClientCert
+    } else {
+      config.ClientAuth = tls.VerifyClientCertIfGiven
+    }
+  }
+  reloader.mod_times = mod_times
+  reloader.config = config
+  return nil
+}
+
+func (reloader *cert_reloader) get_config(*tls.ClientHelloInfo) (
+  *tls.Config, error,
+) {
+  reloader.mutex.Lock()
+  defer reloader.mutex.Unlock()
+  if time.Since(reloader.checked) < time.Second {
+    return reloader.config, nil
+  }
+  reloader.checked = time.Now()
+  for i, file := range reloader.files() {
+    info, err := os.Stat(file)
+    if err != nil {
+      slog.Error("error checking certificate file for changes",
+        "path", file, "err", err)
+      break
+    }
+    if !info.ModTime().Equal(reloader.mod_times[i]) {
+      // keep serving the old certificate if the new files are incomplete
+      if err := reloader.load(); err != nil {
+        slog.Error("error reloading certificates", "err", err)
+      } else {
+        slog.Info("reloaded certificates")
+      }
+      break
+    }
+  }
+  return reloader.config, nil
+}
+
+// runs the queries of requests with a verified client certificate as the
+// postgres role mapped from the certificate common name or subject alternative
+// names (DNS names, email addresses and URIs). roles is required: taking the
+// identity itself as the role would let any certificate from the CA name a
+// superuser or a role bypassing row level security
+//
+// The role is switched with SET ROLE, which /execSql could undo, so disable
+// /execSql and /exec when relying on certificate roles. Roles that send
+// Idempotency-Key headers need access to pgrest.idempotency_keys. Requests
+// without a verified client certificate are refused with 403.
+func (server *PgServer) SetClientCertRoles(
+  source string, roles map[string]string,
+) error {
+  if source != RoleFromCommonName && source != RoleFromSAN {
+    return fmt.Errorf("invalid client certificate role source '%s'", source)
+  }
+  if len(roles) == 0 {
+    return errors.New("client certificate roles without a role map")
+  }
+  server.cert_roles = &client_cert_roles { source, roles }
+  return nil
+}
+
+// returns the role for the client certificate of the request, or "" without
+// certificate roles. Once they are set a request without a verified
+// certificate is refused rather than run as the pool user
+func (server *PgServer) client_cert_role(r *http.Request) (string, error) {
+  if server.cert_roles == nil {
+    return "", nil
+  }
+  if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+    return "", errors.New("client certificate required")
+  }
+  cert := r.TLS.VerifiedChains[0][0]
+  var identities []string
+  if server.cert_roles.source == RoleFromCommonName {
+    identities = []string { cert.Subject.CommonName }
+  } else {
+    identities = append(identities, cert.DNSNames...)
+    identities = append(identities, cert.EmailAddresses...)
+    for _, uri := range cert.URIs {
+      identities = append(identities, uri.String())
+    }
+  }
+  for _, identity := range identities {
+    if identity == "" {
+      continue
+    }
+    if role, ok := server.cert_roles.roles[identity]; ok {
+      return role, nil
+    }
+  }
+  return "", errors.New("no role for client certificate")
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "net/http/httptest"
+  "testing"
+)
+
+func TestClientCertRole(t *testing.T) {
+  roles := map[string]string { "app": "app_role", "svc.local": "svc_role" }
+  tests := []struct {
+    name   string
+    source string
+    cn     string
+    dns    []string
+    tls    bool
+    role   string
+    err    bool
+  } {
+    {
+      name: "cn", source: RoleFromCommonName, cn: "app", tls: true,
+      role: "app_role",
+    },
+    {
+      name: "san", source: RoleFromSAN, dns: []string { "x", "svc.local" },
+      tls: true, role: "svc_role",
+    },
+    {
+      name: "unmapped", source: RoleFromCommonName, cn: "postgres",
+      tls: true, err: true,
+    },
+    {
+      name: "san ignores the cn", source: RoleFromSAN, cn: "app", tls: true,
+      err: true,
+    },
+    {
+      name: "no certificate", source: RoleFromCommonName, tls: true,
+      err: true,
+    },
+    { name: "no tls", source: RoleFromCommonName, err: true },
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      server := &PgServer {}
+      err := server.SetClientCertRoles(test.source, roles)
+      if err != nil {
+        t.Fatal(err)
+      }
+      r := httptest.NewRequest("GET", "/dt", nil)
+      if test.tls {
+        r.TLS = &tls.ConnectionState {}
+        if test.cn != "" || len(test.dns) > 0 {
+          cert := &x509.Certificate {
+            Subject: pkix.Name { CommonName: test.cn },
+            DNSNames: test.dns,
+          }
+          r.TLS.VerifiedChains = [][]*x509.Certificate { { cert } }
+        }
+      }
+      role, err := server.client_cert_role(r)
+      if test.err {
+        if err == nil {
+          t.Fatalf("role %q, expected an error", role)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatal(err)
+      }
+      if role != test.role {
+        t.Errorf("role %q, expected %q", role, test.role)
+      }
+    })
+  }
+}
+
+func TestClientCertRoleUnset(t *testing.T) {
+  role, err := (&PgServer {}).client_cert_role(httptest.NewRequest("GET",
+    "/dt", nil))
+  if role != "" || err != nil {
+    t.Errorf("role %q and error %v without certificate roles", role, err)
+  }
+}
+
+func TestSetClientCertRoles(t *testing.T) {
+  server := &PgServer {}
+  if err := server.SetClientCertRoles(RoleFromCommonName, nil); err == nil {
+    t.Error("expected an error without a role map")
+  }
+  roles := map[string]string { "app": "app_role" }
+  if err := server.SetClientCertRoles("subject", roles); err == nil {
+    t.Error("expected an error for an unknown source")
+  }
+}